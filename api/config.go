@@ -38,6 +38,7 @@ package main
 import (
 	"flag"
 	"sync"
+	"time"
 
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
 )
@@ -54,6 +55,19 @@ type ProducerConfig struct {
 	BrokerPort           int
 	CertFile             string
 	KeyFile              string
+	Relay                bool
+	RelaySource          string
+	RelayPollInterval    time.Duration
+	RelayEventName       string
+	RelayLedgerPath      string
+	RelayTTL             time.Duration
+	RelayClaimTTL        time.Duration
+	EvaluateLedgerPath   string
+	LedgerURL            string
+	LedgerToken          string
+	EvaluateTTL          time.Duration
+	LogLevel             string
+	OTLPEndpoint         string
 
 	lock sync.Mutex
 }
@@ -91,6 +105,23 @@ func NewProducerConfig() (conf *ProducerConfig) {
 		brokerPort    int
 		certFile      string
 		keyFile       string
+
+		relay             bool
+		relaySource       string
+		relayPollInterval time.Duration
+		relayEventName    string
+		relayLedgerPath   string
+		relayTTL          time.Duration
+		relayClaimTTL     time.Duration
+
+		evaluateLedgerPath string
+		evaluateTTL        time.Duration
+
+		ledgerURL   string
+		ledgerToken string
+
+		logLevel     string
+		otlpEndpoint string
 	)
 
 	// CLI Flags
@@ -103,6 +134,19 @@ func NewProducerConfig() (conf *ProducerConfig) {
 	flag.IntVar(&brokerPort, "broker-port", 4160, "The port of the NSQ Broker to talk to")
 	flag.StringVar(&certFile, "cert", "", "The TLS certs to serve to clients (leave blank for no TLS)")
 	flag.StringVar(&keyFile, "key", "", "The TLS key used to encrypt connection (leave blank for no TLS)")
+	flag.BoolVar(&relay, "relay", true, "Relay the learnuplets with status \"todo\" on the peer to the broker")
+	flag.StringVar(&relaySource, "relay-source", RelaySourcePoll, "How new learnuplets are retrieved from the peer ('poll' or 'events')")
+	flag.DurationVar(&relayPollInterval, "relay-poll-interval", 5*time.Second, "Delay between two queries of the peer for new learnuplets (with the 'poll' relay source), and before restarting a relay that stopped")
+	flag.StringVar(&relayEventName, "relay-event", "learnuplet", "Name of the chaincode event emitted on learnuplet creation (with the 'events' relay source)")
+	flag.StringVar(&relayLedgerPath, "relay-ledger", "relay.db", "File keeping track of the learnuplets already pushed to the broker (on a local volume, unused with -ledger-url)")
+	flag.DurationVar(&relayTTL, "relay-ttl", 24*time.Hour, "After this delay, learnuplets that are still \"todo\" are pushed to the broker again")
+	flag.DurationVar(&relayClaimTTL, "relay-claim-ttl", time.Minute, "After this delay, learnuplets claimed by a relay that didn't push them (e.g. it crashed) can be claimed again")
+	flag.StringVar(&evaluateLedgerPath, "evaluate-ledger", "evaluate.db", "File keeping track of the re-evaluations already pushed to the broker (on a local volume, unused with -ledger-url)")
+	flag.StringVar(&ledgerURL, "ledger-url", "", "URL of the API replica holding the ledgers, e.g. http://compute-api-0:8000 (leave blank to hold them: set it on every other replica)")
+	flag.StringVar(&ledgerToken, "ledger-token", "", "Secret shared by API replicas to access the ledgers of the replica holding them (leave blank not to serve them)")
+	flag.DurationVar(&evaluateTTL, "evaluate-ttl", 24*time.Hour, "After this delay, models that have been re-evaluated can be re-evaluated again")
+	flag.StringVar(&logLevel, "log-level", "debug", "Lowest level of the log lines written to stdout: debug, info, warning or error")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "URL of the OTLP/HTTP collector traces are sent to, e.g. http://otel-collector:4318 (leave blank to disable tracing)")
 	flag.Parse()
 
 	// Apply custom defaults on list flags if necessary
@@ -125,6 +169,19 @@ func NewProducerConfig() (conf *ProducerConfig) {
 		BrokerPort:           brokerPort,
 		CertFile:             certFile,
 		KeyFile:              keyFile,
+		Relay:                relay,
+		RelaySource:          relaySource,
+		RelayPollInterval:    relayPollInterval,
+		RelayEventName:       relayEventName,
+		RelayLedgerPath:      relayLedgerPath,
+		RelayTTL:             relayTTL,
+		RelayClaimTTL:        relayClaimTTL,
+		EvaluateLedgerPath:   evaluateLedgerPath,
+		EvaluateTTL:          evaluateTTL,
+		LedgerURL:            ledgerURL,
+		LedgerToken:          ledgerToken,
+		LogLevel:             logLevel,
+		OTLPEndpoint:         otlpEndpoint,
 	}
 	return
 }
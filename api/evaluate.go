@@ -0,0 +1,180 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/satori/go.uuid"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+)
+
+// EvaluateTopic is the broker topic of re-evaluation tasks
+const EvaluateTopic = "evaluate"
+
+// TaskStatusPerfFailed is the status compute workers give to learnuplets whose model was trained
+// but whose performance couldn't be computed
+const TaskStatusPerfFailed = "perf_failed"
+
+// Evaluplet describes a re-evaluation task: the performance of a model that has already been
+// trained is computed again on its test data. Compute workers have the same definition.
+type Evaluplet struct {
+	Key        string      `json:"key"`
+	Learnuplet string      `json:"learnuplet"`
+	Problem    uuid.UUID   `json:"problem"`
+	Model      uuid.UUID   `json:"model"`
+	TestData   []uuid.UUID `json:"test_data"`
+}
+
+func (s *apiServer) reevaluateProblem(c *iris.Context) {
+	problem, err := uuid.FromString(c.Param("problem"))
+	if err != nil {
+		msg := fmt.Sprintf("Invalid problem UUID: %s", err)
+		logging.Default().With(logging.FieldComponent, "evaluate").Infof("%s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	n, skipped, err := s.pushEvaluplets(c.Request.Context(), problem)
+	if err != nil {
+		msg := fmt.Sprintf("Failed to push re-evaluations of problem %s into broker (%d pushed): %s", problem, n, err)
+		logging.Default().With(logging.FieldComponent, "evaluate").Errorf("%s", msg)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(msg))
+		return
+	}
+
+	c.JSON(iris.StatusAccepted, map[string]interface{}{
+		"message": fmt.Sprintf("%d re-evaluation(s) of problem %s ingested (%d skipped)", n, problem, skipped),
+		"count":   n,
+		"skipped": skipped,
+	})
+}
+
+// evalupletKey is the key of the re-evaluation of the model trained by a learnuplet
+func evalupletKey(learnupletKey string) string {
+	return "evaluplet-" + learnupletKey
+}
+
+// pushEvaluplets puts an evaluplet in the evaluate topic of our broker for each model trained on a
+// problem (that is, for each of its learnuplets that are done or whose perf failed). Evaluplets
+// are keyed after their learnuplet: the ones that have already been pushed (and recorded in the
+// evaluation ledger, if the API has one) are skipped. It returns the number of evaluplets pushed
+// and skipped.
+func (s *apiServer) pushEvaluplets(ctx context.Context, problem uuid.UUID) (n, skipped int, err error) {
+	logger := logging.Default().With(logging.FieldComponent, "evaluate")
+	if s.evaluations != nil {
+		if _, err := s.evaluations.Evict(); err != nil {
+			return n, skipped, fmt.Errorf("Failed to evict expired re-evaluations from the ledger: %s", err)
+		}
+	}
+
+	for _, status := range []string{common.TaskStatusDone, TaskStatusPerfFailed} {
+		learnupletsBytes, err := s.peer.QueryStatusLearnuplet(status)
+		if err != nil {
+			return n, skipped, fmt.Errorf("Failed to queryStatusLearnuplet: %s", err)
+		}
+		learnuplets, err := parseLearnuplets(learnupletsBytes)
+		if err != nil {
+			return n, skipped, err
+		}
+
+		for _, learnuplet := range learnuplets {
+			if !uuid.Equal(learnuplet.Problem, problem) || uuid.Equal(learnuplet.ModelEnd, uuid.Nil) || len(learnuplet.TestData) == 0 {
+				continue
+			}
+			evaluplet := Evaluplet{
+				Key:        evalupletKey(learnuplet.Key),
+				Learnuplet: learnuplet.Key,
+				Problem:    learnuplet.Problem,
+				Model:      learnuplet.ModelEnd,
+				TestData:   learnuplet.TestData,
+			}
+			pushed, err := s.pushEvaluplet(ctx, evaluplet)
+			if err != nil {
+				return n, skipped, err
+			}
+			if !pushed {
+				logger.With(logging.FieldTask, evaluplet.Key).Debugf("Skipping %s: it has already been re-evaluated", learnuplet.Key)
+				skipped++
+				continue
+			}
+			n++
+		}
+	}
+	logger.Infof("%d re-evaluation(s) of problem %s pushed to broker (%d skipped)", n, problem, skipped)
+	return n, skipped, nil
+}
+
+// pushEvaluplet pushes an evaluplet to the broker unless the evaluation ledger says it has already
+// been pushed. It returns whether it was pushed.
+func (s *apiServer) pushEvaluplet(ctx context.Context, evaluplet Evaluplet) (pushed bool, err error) {
+	taskBytes, err := json.Marshal(evaluplet)
+	if err != nil {
+		return false, fmt.Errorf("Failed to marshal evaluplet to JSON: %s", err)
+	}
+
+	if s.evaluations != nil {
+		claimed, err := s.evaluations.Claim(evaluplet.Key)
+		if err != nil {
+			return false, fmt.Errorf("Failed to claim %s in the evaluation ledger: %s", evaluplet.Key, err)
+		}
+		if !claimed {
+			return false, nil
+		}
+	}
+
+	messageID := uuid.NewV4().String()
+	if err := s.pushTask(ctx, EvaluateTopic, evaluplet.Key, messageID, taskBytes); err != nil {
+		if s.evaluations != nil {
+			if err := s.evaluations.Release(evaluplet.Key); err != nil {
+				logging.Default().With(logging.FieldComponent, "evaluate").Errorf("Failed to release %s in the evaluation ledger: %s", evaluplet.Key, err)
+			}
+		}
+		return false, fmt.Errorf("Failed to push evaluplet for %s into broker: %s", evaluplet.Learnuplet, err)
+	}
+	if s.evaluations != nil {
+		if err := s.evaluations.Confirm(evaluplet.Key, messageID); err != nil {
+			return true, fmt.Errorf("Failed to record %s in the evaluation ledger: %s", evaluplet.Key, err)
+		}
+	}
+	return true, nil
+}
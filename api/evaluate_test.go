@@ -0,0 +1,162 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// statusPeer returns a fixed set of learnuplets for each status
+type statusPeer struct {
+	client.Peer
+	learnuplets map[string][]map[string]interface{}
+}
+
+func (p *statusPeer) QueryStatusLearnuplet(status string) ([]byte, error) {
+	return json.Marshal(p.learnuplets[status])
+}
+
+// recordingProducer records the messages pushed to each topic
+type recordingProducer struct {
+	common.ProducerMOCK
+	messages map[string][][]byte
+}
+
+func (p *recordingProducer) Push(topic string, body []byte) error {
+	p.messages[topic] = append(p.messages[topic], body)
+	return nil
+}
+
+func TestPushEvaluplets(t *testing.T) {
+	problem := uuid.NewV4()
+	learnuplet := func(key string, problem uuid.UUID) map[string]interface{} {
+		return map[string]interface{}{
+			"key":       key,
+			"problem":   problem,
+			"algo":      uuid.NewV4(),
+			"model_end": uuid.NewV4(),
+			"test_data": []uuid.UUID{uuid.NewV4()},
+		}
+	}
+	peer := &statusPeer{
+		Peer: &client.PeerMock{},
+		learnuplets: map[string][]map[string]interface{}{
+			common.TaskStatusTodo:   {learnuplet("todo", problem)},
+			common.TaskStatusDone:   {learnuplet("done", problem), learnuplet("other", uuid.NewV4())},
+			TaskStatusPerfFailed:    {learnuplet("perf_failed", problem)},
+			common.TaskStatusFailed: {learnuplet("failed", problem)},
+		},
+	}
+	tmpDir, err := ioutil.TempDir("", "morpheo_evaluate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	ledger := newTestLedger(t, filepath.Join(tmpDir, "evaluate.db"))
+	defer ledger.Close()
+	producer := &recordingProducer{messages: make(map[string][][]byte)}
+	s := &apiServer{producer: producer, peer: peer, evaluations: ledger}
+
+	// Models trained on the problem are re-evaluated, whether their perf was computed or not
+	n, skipped, err := s.pushEvaluplets(context.Background(), problem)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 0, skipped)
+	var keys []string
+	for _, message := range producer.messages[EvaluateTopic] {
+		// Evaluplets are pushed in an envelope carrying their key
+		envelope := logging.Unwrap(message)
+		assert.NotEqual(t, "", envelope.MessageID)
+		var evaluplet Evaluplet
+		assert.Nil(t, json.Unmarshal(envelope.Task, &evaluplet))
+		assert.Equal(t, evaluplet.Key, envelope.Key)
+		assert.Equal(t, "evaluplet-"+evaluplet.Learnuplet, evaluplet.Key)
+		assert.Equal(t, problem, evaluplet.Problem)
+		assert.NotEqual(t, uuid.Nil, evaluplet.Model)
+		assert.Equal(t, 1, len(evaluplet.TestData))
+		keys = append(keys, evaluplet.Learnuplet)
+	}
+	assert.Equal(t, []string{"done", "perf_failed"}, keys)
+
+	// Models that have already been re-evaluated are skipped
+	n, skipped, err = s.pushEvaluplets(context.Background(), problem)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 2, skipped)
+	assert.Equal(t, 2, len(producer.messages[EvaluateTopic]))
+}
+
+func TestPushTaskTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	defer tracing.SetExporter("compute-api", exporter)(context.Background())
+
+	producer := &recordingProducer{messages: make(map[string][][]byte)}
+	s := &apiServer{producer: producer}
+
+	// Tasks are pushed in a span, child of the request's, whose context travels in their envelope
+	ctx, request := tracing.Start(context.Background(), "POST /learnuplet")
+	assert.Nil(t, s.pushTask(ctx, common.TrainTopic, "learnuplet1", "message1", []byte("{}")))
+	request.End()
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	push := spans[0]
+	assert.Equal(t, "push "+common.TrainTopic, push.Name)
+	assert.Equal(t, request.SpanContext().SpanID(), push.Parent.SpanID())
+	assert.Contains(t, push.Attributes, tracing.AttributeTopic.String(common.TrainTopic))
+	assert.Contains(t, push.Attributes, tracing.AttributeTask.String("learnuplet1"))
+
+	envelope := logging.Unwrap(producer.messages[common.TrainTopic][0])
+	carried := trace.SpanContextFromContext(tracing.Extract(context.Background(), propagation.MapCarrier(envelope.Trace)))
+	assert.Equal(t, push.SpanContext.TraceID(), carried.TraceID())
+	assert.Equal(t, push.SpanContext.SpanID(), carried.SpanID())
+}
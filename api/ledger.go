@@ -0,0 +1,218 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// API replicas share the ledgers of one of them, so that a given learnuplet (or evaluplet) is
+// pushed by a single replica: the replica holding the ledger files serves them on LedgerRoute, and
+// the others claim and confirm pushes through it (see remoteLedger).
+
+// Ledgers served on LedgerRoute
+const (
+	LedgerRelay    = "relay"
+	LedgerEvaluate = "evaluate"
+)
+
+// Operations on a served ledger, one per RelayStore method
+const (
+	ledgerClaim   = "claim"
+	ledgerConfirm = "confirm"
+	ledgerRelease = "release"
+	ledgerRetain  = "retain"
+	ledgerEvict   = "evict"
+)
+
+// ledgerRequest is an operation on a served ledger, on behalf of the relay identified by Owner
+type ledgerRequest struct {
+	Ledger    string   `json:"ledger"`
+	Operation string   `json:"operation"`
+	Owner     string   `json:"owner"`
+	Key       string   `json:"key,omitempty"`
+	Keys      []string `json:"keys,omitempty"`
+	MessageID string   `json:"message_id,omitempty"`
+}
+
+// ledgerResponse is the outcome of an operation on a served ledger
+type ledgerResponse struct {
+	Claimed bool `json:"claimed"`
+	Evicted int  `json:"evicted"`
+}
+
+// ledgerOperation runs an operation on one of the ledgers held by this replica
+func (s *apiServer) ledgerOperation(c *iris.Context) {
+	token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	if s.conf == nil || s.conf.LedgerToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.LedgerToken)) != 1 {
+		c.JSON(iris.StatusUnauthorized, common.NewAPIError("Invalid ledger token"))
+		return
+	}
+
+	var req ledgerRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(fmt.Sprintf("Error decoding body to JSON: %s", err)))
+		return
+	}
+	ledger, ok := s.ledgers[req.Ledger]
+	if !ok {
+		c.JSON(iris.StatusNotFound, common.NewAPIError(fmt.Sprintf("Unknown ledger %q", req.Ledger)))
+		return
+	}
+	if req.Owner == "" {
+		c.JSON(iris.StatusBadRequest, common.NewAPIError("owner field is unset"))
+		return
+	}
+	ledger = ledger.forOwner(req.Owner)
+
+	var (
+		res ledgerResponse
+		err error
+	)
+	switch req.Operation {
+	case ledgerClaim:
+		res.Claimed, err = ledger.Claim(req.Key)
+	case ledgerConfirm:
+		err = ledger.Confirm(req.Key, req.MessageID)
+	case ledgerRelease:
+		err = ledger.Release(req.Key)
+	case ledgerRetain:
+		err = ledger.Retain(req.Keys)
+	case ledgerEvict:
+		res.Evicted, err = ledger.Evict()
+	default:
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(fmt.Sprintf("Unknown ledger operation %q", req.Operation)))
+		return
+	}
+	if err != nil {
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(err.Error()))
+		return
+	}
+	c.JSON(iris.StatusOK, res)
+}
+
+// remoteLedger is a RelayStore served by another API replica on LedgerRoute
+type remoteLedger struct {
+	url    string
+	token  string
+	ledger string
+	owner  string
+	client *http.Client
+}
+
+// newRemoteLedger returns the ledger of a given name served by the API replica at baseURL, on
+// behalf of the relay identified by owner
+func newRemoteLedger(baseURL, token, ledger, owner string) *remoteLedger {
+	return &remoteLedger{
+		url:    strings.TrimSuffix(baseURL, "/") + LedgerRoute,
+		token:  token,
+		ledger: ledger,
+		owner:  owner,
+		client: &http.Client{Timeout: ledgerLockTimeout},
+	}
+}
+
+func (l *remoteLedger) do(req ledgerRequest) (*ledgerResponse, error) {
+	req.Ledger = l.ledger
+	req.Owner = l.owner
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshaling %s request: %s", req.Operation, err)
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating %s request: %s", req.Operation, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+l.token)
+
+	resp, err := l.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("Error sending %s request to ledger %s at %s: %s", req.Operation, l.ledger, l.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Error running %s on ledger %s at %s: status %d: %s", req.Operation, l.ledger, l.url, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	var res ledgerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("Error decoding %s response from ledger %s at %s: %s", req.Operation, l.ledger, l.url, err)
+	}
+	return &res, nil
+}
+
+func (l *remoteLedger) Claim(key string) (bool, error) {
+	res, err := l.do(ledgerRequest{Operation: ledgerClaim, Key: key})
+	if err != nil {
+		return false, err
+	}
+	return res.Claimed, nil
+}
+
+func (l *remoteLedger) Confirm(key, messageID string) error {
+	_, err := l.do(ledgerRequest{Operation: ledgerConfirm, Key: key, MessageID: messageID})
+	return err
+}
+
+func (l *remoteLedger) Release(key string) error {
+	_, err := l.do(ledgerRequest{Operation: ledgerRelease, Key: key})
+	return err
+}
+
+func (l *remoteLedger) Retain(keys []string) error {
+	_, err := l.do(ledgerRequest{Operation: ledgerRetain, Keys: keys})
+	return err
+}
+
+func (l *remoteLedger) Evict() (int, error) {
+	res, err := l.do(ledgerRequest{Operation: ledgerEvict})
+	if err != nil {
+		return 0, err
+	}
+	return res.Evicted, nil
+}
@@ -36,39 +36,69 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/kataras/iris.v6"
 	"gopkg.in/kataras/iris.v6/adaptors/httprouter"
 	"gopkg.in/kataras/iris.v6/middleware/logger"
 
 	"github.com/MorpheoOrg/morpheo-go-packages/client"
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
 )
 
 // TODO: write tests for the two main views
 
 // Available HTTP Routes
 const (
-	RootRoute   = "/"
-	HealthRoute = "/health"
+	RootRoute       = "/"
+	HealthRoute     = "/health"
+	ReadyRoute      = "/ready"
+	MetricsRoute    = "/metrics"
+	LearnRoute      = "/learn"
+	PredRoute       = "/pred"
+	ReevaluateRoute = "/problem/:problem/reevaluate"
+	QueryRoute      = "/query"
+	InvokeRoute     = "/invoke"
+	LedgerRoute     = "/ledger"
 )
 
 type apiServer struct {
 	conf     *ProducerConfig
 	producer common.Producer
 	peer     client.Peer
+	relay    *learnupletRelay
+	metrics  *apiMetrics
+	// Evaluplets already pushed to the broker (optional: none are skipped without it)
+	evaluations RelayStore
+	// Ledgers held by this replica, served to the others on LedgerRoute (by name)
+	ledgers map[string]*boltLedger
 }
 
 func (s *apiServer) configureRoutes(app *iris.Framework) {
-	app.Get(RootRoute, s.index)
-	app.Get(HealthRoute, s.health)
-	app.Get("/query", s.query)   // For test purposes
-	app.Get("/invoke", s.invoke) // For test purposes
+	app.Get(RootRoute, s.instrument(RootRoute, s.index))
+	app.Get(HealthRoute, s.instrument(HealthRoute, s.health))
+	app.Get(ReadyRoute, s.instrument(ReadyRoute, s.ready))
+	app.Post(LearnRoute, s.instrument(LearnRoute, s.postLearnuplet))
+	app.Post(PredRoute, s.instrument(PredRoute, s.postPreduplet))
+	app.Post(ReevaluateRoute, s.instrument(ReevaluateRoute, s.reevaluateProblem))
+	app.Get(QueryRoute, s.instrument(QueryRoute, s.query))    // For test purposes
+	app.Get(InvokeRoute, s.instrument(InvokeRoute, s.invoke)) // For test purposes
+	if s.metrics != nil {
+		app.Get(MetricsRoute, s.metricsHandler)
+	}
+	if len(s.ledgers) > 0 {
+		app.Post(LedgerRoute, s.instrument(LedgerRoute, s.ledgerOperation))
+	}
 }
 
 // SetIrisApp sets the base for the Iris App
@@ -95,44 +125,116 @@ func main() {
 	// App-specific config (parses CLI flags)
 	conf := NewProducerConfig()
 
+	// Let's log JSON lines, one per event, so that they can be joined by task key with the workers'
+	logLevel, err := logging.ParseLevel(conf.LogLevel)
+	if err != nil {
+		logging.Default().Panicf("Impossible to parse log level: %s", err)
+	}
+	logging.SetDefault(logging.New(os.Stdout, logLevel))
+	logger := logging.Default().With(logging.FieldComponent, "main")
+
+	// Let's trace tasks from their ingestion to their completion by workers (if we have a collector)
+	shutdownTracing, err := tracing.Setup("compute-api", conf.OTLPEndpoint)
+	if err != nil {
+		logger.Panicf("Impossible to set tracing up: %s", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Let's dependency inject the producer for the chosen Broker
 	var producer common.Producer
 	switch conf.Broker {
 	case common.BrokerNSQ:
-		var err error
 		producer, err = common.NewNSQProducer(conf.BrokerHost, conf.BrokerPort)
 		defer producer.Stop()
 		if err != nil {
-			log.Panicln(err)
+			logger.Panicf("%s", err)
 		}
 	case common.BrokerMOCK:
 		producer = &common.ProducerMOCK{}
 	default:
-		log.Panicf("Unsupported broker (%s). Available brokers: 'nsq', 'mock'", conf.Broker)
+		logger.Panicf("Unsupported broker (%s). Available brokers: 'nsq', 'mock'", conf.Broker)
 	}
 
 	// Let's create our peer client to request the blockchain
 	// TODO: WITH ADMIN/USER ID INSTEAD
-	peer, err := client.NewPeerAPI(
+	peerAPI, err := client.NewPeerAPI(
 		"secrets/config.yaml",
 		"Aphp",
 		"mychannel",
 		"mycc",
 	)
 	if err != nil {
-		log.Panicf("Error creating peer client: %s", err)
+		logger.Panicf("Error creating peer client: %s", err)
 	}
+	metrics := newAPIMetrics()
+	peer := &meteredPeer{Peer: peerAPI, metrics: metrics}
 
 	// Handlers configuration
 	api := &apiServer{
 		conf:     conf,
 		producer: producer,
 		peer:     peer,
+		metrics:  metrics,
 	}
 
-	app := api.SetIrisApp()
+	// Let's keep track of the learnuplets and re-evaluations we push, so that they're pushed once.
+	// Replicas share the ledgers of the one holding them: it serves them to the others.
+	owner := uuid.NewV4().String()
+	var relayLedger RelayStore
+	if conf.LedgerURL != "" {
+		relayLedger = newRemoteLedger(conf.LedgerURL, conf.LedgerToken, LedgerRelay, owner)
+		api.evaluations = newRemoteLedger(conf.LedgerURL, conf.LedgerToken, LedgerEvaluate, owner)
+	} else {
+		ledger, err := newBoltLedger(conf.RelayLedgerPath, owner, conf.RelayTTL, conf.RelayClaimTTL)
+		if err != nil {
+			logger.Panicf("Error loading relay ledger: %s", err)
+		}
+		defer ledger.Close()
+		evaluations, err := newBoltLedger(conf.EvaluateLedgerPath, owner, conf.EvaluateTTL, conf.RelayClaimTTL)
+		if err != nil {
+			logger.Panicf("Error loading evaluation ledger: %s", err)
+		}
+		defer evaluations.Close()
+		relayLedger = ledger
+		api.evaluations = evaluations
+		if conf.LedgerToken != "" {
+			api.ledgers = map[string]*boltLedger{LedgerRelay: ledger, LedgerEvaluate: evaluations}
+		}
+	}
 
-	go api.relayNewLearnuplet()
+	// Let's relay the learnuplets with status "todo" on the peer to the broker
+	if conf.Relay {
+		var source LearnupletSource
+		switch conf.RelaySource {
+		case RelaySourcePoll:
+			source = &pollingSource{peer: peer, interval: conf.RelayPollInterval}
+		case RelaySourceEvents:
+			subscriber, ok := interface{}(peerAPI).(ChaincodeEventSubscriber)
+			if !ok {
+				logger.Panicf("The peer client can't subscribe to chaincode events, please use the '%s' relay source", RelaySourcePoll)
+			}
+			source = &eventSource{peer: peer, subscriber: subscriber, eventName: conf.RelayEventName}
+		default:
+			logger.Panicf("Unsupported relay source (%s). Available sources: '%s', '%s'", conf.RelaySource, RelaySourcePoll, RelaySourceEvents)
+		}
+		relay := &learnupletRelay{
+			source:  source,
+			store:   relayLedger,
+			push:    api.pushLearnuplet,
+			metrics: metrics,
+		}
+		api.relay = relay
+		go func() {
+			// The relay only stops if its source does: let's start it over
+			for {
+				err := relay.Run(nil)
+				logger.Errorf("Error relaying learnuplets, restarting the relay in %s: %s", conf.RelayPollInterval, err)
+				time.Sleep(conf.RelayPollInterval)
+			}
+		}()
+	}
+
+	app := api.SetIrisApp()
 
 	// Main server loop
 	if conf.TLSOn() {
@@ -143,15 +245,48 @@ func main() {
 }
 
 func (s *apiServer) index(c *iris.Context) {
-	// TODO: check broker connectivity here
-	c.JSON(iris.StatusOK, []string{RootRoute, HealthRoute})
+	c.JSON(iris.StatusOK, []string{RootRoute, HealthRoute, ReadyRoute, MetricsRoute, LearnRoute, PredRoute, ReevaluateRoute, QueryRoute, InvokeRoute, LedgerRoute})
 }
 
+// health is the liveness probe: the API is alive as long as it serves requests (see ready for the
+// readiness probe)
 func (s *apiServer) health(c *iris.Context) {
 	c.JSON(iris.StatusOK, map[string]string{"status": "ok"})
 }
 
-func (s *apiServer) postLearnuplet(learnuplet common.Learnuplet) error {
+func (s *apiServer) postLearnuplet(c *iris.Context) {
+	var learnuplet common.Learnuplet
+	logger := logging.Default().With(logging.FieldComponent, "learn")
+
+	// Unserializing the request body
+	if err := json.NewDecoder(c.Request.Body).Decode(&learnuplet); err != nil {
+		msg := fmt.Sprintf("Error decoding body to JSON: %s", err)
+		logger.Infof("%s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	// Let's check for required arguments presence and validity
+	if err := learnuplet.Check(); err != nil {
+		msg := fmt.Sprintf("Invalid learn-uplet: %s", err)
+		logger.Infof("%s", msg)
+		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
+		return
+	}
+
+	logger = logger.With(logging.FieldTask, learnuplet.Key)
+	if err := s.pushLearnuplet(c.Request.Context(), learnuplet, uuid.NewV4().String()); err != nil {
+		msg := fmt.Sprintf("Failed to push learn-uplet task into broker: %s", err)
+		logger.Errorf("%s", msg)
+		c.JSON(iris.StatusInternalServerError, common.NewAPIError(msg))
+		return
+	}
+
+	c.JSON(iris.StatusAccepted, map[string]string{"message": "Learn-uplet ingested"})
+}
+
+// pushLearnuplet validates a learnuplet and puts it in the train topic of our broker
+func (s *apiServer) pushLearnuplet(ctx context.Context, learnuplet common.Learnuplet, messageID string) error {
 	// Let's check for required arguments presence and validity
 	if err := learnuplet.Check(); err != nil {
 		return fmt.Errorf("[ERROR] Invalid learnuplet: %s", err)
@@ -163,20 +298,49 @@ func (s *apiServer) postLearnuplet(learnuplet common.Learnuplet) error {
 		return fmt.Errorf("[ERROR] Failed to remarshal JSON learnuplet after validation: %s", err)
 	}
 
-	err = s.producer.Push(common.TrainTopic, taskBytes)
+	err = s.pushTask(ctx, common.TrainTopic, learnuplet.Key, messageID, taskBytes)
 	if err != nil {
 		return fmt.Errorf("[ERROR] Failed push learn-uplet into broker: %s", err)
 	}
 	return nil
 }
 
+// pushTask puts a marshaled task in a topic of our broker, in an envelope carrying its key and the
+// ID of the message so that workers can log them, and the context of the push span so that workers
+// can trace them
+func (s *apiServer) pushTask(ctx context.Context, topic, key, messageID string, taskBytes []byte) (err error) {
+	ctx, span := tracing.Start(ctx, "push "+topic, trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		tracing.AttributeTopic.String(topic),
+		tracing.AttributeTask.String(key),
+		tracing.AttributeMessageID.String(messageID),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	message, err := logging.Wrap(key, messageID, tracing.Inject(ctx), taskBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to wrap task %s in an envelope: %s", key, err)
+	}
+	err = s.producer.Push(topic, message)
+	s.metrics.observePush(topic, err)
+	if err != nil {
+		return err
+	}
+	logging.Default().WithFields(logging.Fields{
+		logging.FieldComponent: "broker",
+		logging.FieldTask:      key,
+		logging.FieldMessageID: messageID,
+	}).Debugf("Task pushed to topic %s", topic)
+	return nil
+}
+
 func (s *apiServer) postPreduplet(c *iris.Context) {
 	var predUplet common.Preduplet
+	logger := logging.Default().With(logging.FieldComponent, "pred")
 
 	// Unserializing the request body
 	if err := json.NewDecoder(c.Request.Body).Decode(&predUplet); err != nil {
 		msg := fmt.Sprintf("Error decoding body to JSON: %s", err)
-		log.Printf("[INFO] %s", msg)
+		logger.Infof("%s", msg)
 		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
 		return
 	}
@@ -184,22 +348,24 @@ func (s *apiServer) postPreduplet(c *iris.Context) {
 	// Let's check for required arguments presence and validity
 	if err := predUplet.Check(); err != nil {
 		msg := fmt.Sprintf("Invalid pred-uplet: %s", err)
-		log.Printf("[INFO] %s", msg)
+		logger.Infof("%s", msg)
 		c.JSON(iris.StatusBadRequest, common.NewAPIError(msg))
 		return
 	}
 
+	logger = logger.With(logging.FieldTask, predUplet.Key)
+
 	taskBytes, err := json.Marshal(predUplet)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to remarshal preduplet to JSON: %s", err)
-		log.Printf("[ERROR] %s", msg)
+		logger.Errorf("%s", msg)
 		c.JSON(iris.StatusInternalServerError, common.NewAPIError(msg))
 		return
 	}
-	err = s.producer.Push(common.PredictTopic, taskBytes)
+	err = s.pushTask(c.Request.Context(), common.PredictTopic, predUplet.Key, uuid.NewV4().String(), taskBytes)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to push preduplet task into broker: %s", err)
-		log.Printf("[ERROR] %s", msg)
+		logger.Errorf("%s", msg)
 		c.JSON(iris.StatusInternalServerError, common.NewAPIError(msg))
 		return
 	}
@@ -211,100 +377,6 @@ func (s *apiServer) postPreduplet(c *iris.Context) {
 	c.JSON(iris.StatusAccepted, map[string]string{"message": "Pred-uplet ingested"})
 }
 
-// ================================================================================
-// Go routine that pings the blockchain
-// ================================================================================
-// Note that this might be changed after a while if a successfull event listenner
-// can be easily plugged to the blockchain.
-// The code is not clean
-
-func (s *apiServer) relayNewLearnuplet() {
-	// brokerLearnQueue represents the learnuplet(s) that have been posted to the
-	// broker, but are still with a status "todo".
-	// Without this poor little slice of string, each learnuplet in the broker queue
-	// with a status "todo" would be posted again every 5s... TOFIX this logic
-	var brokerLearnQueue []string
-
-	for {
-		time.Sleep(5 * time.Second)
-
-		// Retrieve Learnuplets with status "todo" from peer
-		learnupletsBytes, err := s.peer.QueryStatusLearnuplet("todo")
-		if err != nil {
-			log.Printf("[ERROR] Failed to queryStatusLearnuplet: %s", err)
-			continue
-		}
-
-		// Unmarshal Learnuplets
-		var learnupletsChaincode []common.LearnupletChaincode
-		err = json.Unmarshal(learnupletsBytes, &learnupletsChaincode)
-		if err != nil {
-			log.Printf("[ERROR] Failed to Unmarshal learnuplets: %s", err)
-			continue
-		}
-		log.Printf("[INFO] %d learnuplet(s) with status \"todo\" received from peer", len(learnupletsChaincode))
-		if len(learnupletsChaincode) == 0 {
-			continue
-		}
-
-		// Convert them in the Compute format (TEMPORARY)
-		var learnuplets []common.Learnuplet
-		for _, learnupletChaincode := range learnupletsChaincode {
-			learnupletFormat, err := learnupletChaincode.LearnupletFormat()
-			if err != nil {
-				log.Printf("[ERROR] Failed to format chaincode-%s: %s", learnupletChaincode.Key, err)
-				continue
-			}
-			// Check learnuplet is valid and add it to the list
-			err = learnupletFormat.Check()
-			if err != nil {
-				log.Printf("[ERROR] Invalid %s: %s", learnupletChaincode.Key, err)
-				continue
-			}
-			learnuplets = append(learnuplets, learnupletFormat)
-		}
-		if len(learnuplets) == 0 {
-			continue
-		}
-
-		// post the learnuplets if not already done
-		var learnupletTodoList []string
-		for _, learnuplet := range learnuplets {
-			learnupletTodoList = append(learnupletTodoList, learnuplet.Key)
-			if stringInSlice(learnuplet.Key, brokerLearnQueue) {
-				continue
-			}
-			log.Printf("[DEBUG] Posting %s to broker", learnuplet.Key)
-			err = s.postLearnuplet(learnuplet)
-			if err != nil {
-				log.Printf("[ERROR] Failed to postLearnuplet: %s", err)
-				continue
-			}
-			brokerLearnQueue = append(brokerLearnQueue, learnuplet.Key)
-		}
-
-		// Clean brokerLearnQueue
-		log.Printf("[INFO] %d learnuplet(s) already in the broker queue", len(brokerLearnQueue))
-		for len(brokerLearnQueue) > 0 {
-			if !stringInSlice(brokerLearnQueue[0], learnupletTodoList) {
-				brokerLearnQueue = brokerLearnQueue[1:]
-				log.Printf("[INFO] %d learnuplet(s) already in the broker queue", len(brokerLearnQueue))
-			} else {
-				break
-			}
-		}
-	}
-}
-
-func stringInSlice(a string, list []string) bool {
-	for _, b := range list {
-		if b == a {
-			return true
-		}
-	}
-	return false
-}
-
 // ================================================================================
 // For test purposes only
 // ================================================================================
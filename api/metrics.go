@@ -0,0 +1,250 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// apiMetrics holds the Prometheus metrics of the API. A nil *apiMetrics records nothing.
+type apiMetrics struct {
+	registry *prometheus.Registry
+
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	pushes            *prometheus.CounterVec
+	relayCycles       *prometheus.CounterVec
+	relayLastSuccess  prometheus.Gauge
+	peerQueries       *prometheus.CounterVec
+	peerQueryFailures *prometheus.CounterVec
+}
+
+func newAPIMetrics() *apiMetrics {
+	m := &apiMetrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "api",
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests served, by route, method and status code",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "morpheo",
+			Subsystem: "api",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of HTTP requests, by route and method",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		pushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "api",
+			Name:      "pushes_total",
+			Help:      "Number of tasks pushed to the broker, by topic and outcome (ok or error)",
+		}, []string{"topic", "outcome"}),
+		relayCycles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "api",
+			Name:      "relay_cycles_total",
+			Help:      "Number of learnuplet batches relayed, by outcome (ok or error)",
+		}, []string{"outcome"}),
+		relayLastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "morpheo",
+			Subsystem: "api",
+			Name:      "relay_last_success_timestamp_seconds",
+			Help:      "Time of the last batch of learnuplets relayed without error",
+		}),
+		peerQueries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "api",
+			Name:      "peer_queries_total",
+			Help:      "Number of requests sent to the peer, by peer client method",
+		}, []string{"method"}),
+		peerQueryFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "api",
+			Name:      "peer_query_errors_total",
+			Help:      "Number of requests to the peer that failed, by peer client method",
+		}, []string{"method"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.pushes, m.relayCycles, m.relayLastSuccess, m.peerQueries,
+		m.peerQueryFailures,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler returns an HTTP handler exposing the metrics in the Prometheus text format
+func (m *apiMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func (m *apiMetrics) observeRequest(route, method string, code int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	m.requestDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+func (m *apiMetrics) observePush(topic string, err error) {
+	if m == nil {
+		return
+	}
+	m.pushes.WithLabelValues(topic, outcome(err)).Inc()
+}
+
+func (m *apiMetrics) observeRelayCycle(at time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.relayCycles.WithLabelValues(outcome(err)).Inc()
+	if err == nil {
+		m.relayLastSuccess.Set(float64(at.UnixNano()) / 1e9)
+	}
+}
+
+func (m *apiMetrics) observePeerQuery(method string, err error) {
+	if m == nil {
+		return
+	}
+	m.peerQueries.WithLabelValues(method).Inc()
+	if err != nil {
+		m.peerQueryFailures.WithLabelValues(method).Inc()
+	}
+}
+
+// instrument wraps the handler of a route so that its requests are counted, timed and traced.
+// Requests are labeled with the route rather than their path, so that route parameters don't blow
+// up the number of series. Their span continues the trace of the caller, if it sent one.
+func (s *apiServer) instrument(route string, handler iris.HandlerFunc) iris.HandlerFunc {
+	return func(c *iris.Context) {
+		start := time.Now()
+		ctx := tracing.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracing.Start(ctx, c.Request.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			tracing.AttributeRoute.String(route),
+		))
+		c.Request = c.Request.WithContext(ctx)
+
+		handler(c)
+
+		code := c.StatusCode()
+		span.SetAttributes(tracing.AttributeStatus.Int(code))
+		if code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+		span.End()
+		s.metrics.observeRequest(route, c.Request.Method, code, time.Since(start))
+	}
+}
+
+// metricsHandler exposes our metrics on an iris route
+func (s *apiServer) metricsHandler(c *iris.Context) {
+	s.metrics.Handler().ServeHTTP(c.ResponseWriter, c.Request)
+}
+
+// meteredPeer counts the requests sent to the peer, and those that failed. It also remembers the
+// outcome of the last one, so that readiness checks don't have to query the peer again.
+type meteredPeer struct {
+	client.Peer
+	metrics *apiMetrics
+
+	lock     sync.Mutex
+	lastCall time.Time
+	lastErr  error
+}
+
+func (p *meteredPeer) Query(queryFcn string, queryArgs []string) ([]byte, error) {
+	data, err := p.Peer.Query(queryFcn, queryArgs)
+	p.observe("Query", err)
+	return data, err
+}
+
+func (p *meteredPeer) Invoke(fcn string, args []string) (string, []byte, error) {
+	id, nonce, err := p.Peer.Invoke(fcn, args)
+	p.observe("Invoke", err)
+	return id, nonce, err
+}
+
+func (p *meteredPeer) QueryStatusLearnuplet(status string) ([]byte, error) {
+	data, err := p.Peer.QueryStatusLearnuplet(status)
+	p.observe("QueryStatusLearnuplet", err)
+	return data, err
+}
+
+func (p *meteredPeer) observe(method string, err error) {
+	p.metrics.observePeerQuery(method, err)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.lastCall = time.Now()
+	p.lastErr = err
+}
+
+// lastOutcome returns the error of the last request sent to the peer, if it was sent less than
+// maxAge ago
+func (p *meteredPeer) lastOutcome(maxAge time.Duration) (recent bool, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.lastCall.IsZero() || time.Since(p.lastCall) > maxAge {
+		return false, nil
+	}
+	return true, p.lastErr
+}
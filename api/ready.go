@@ -0,0 +1,149 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.in/kataras/iris.v6"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+const (
+	// ReadinessTimeout is the delay after which a readiness check is considered failed
+	ReadinessTimeout = 5 * time.Second
+	// PeerCheckMaxAge is how long the outcome of a request to the peer tells whether it can be
+	// reached. Readiness checks only query the peer when it hasn't been requested for that long.
+	PeerCheckMaxAge = 30 * time.Second
+)
+
+// readinessReport describes the outcome of the readiness checks: the error of each failed check
+// ("ok" for the others) and the time of the last batch of learnuplets relayed without error
+type readinessReport struct {
+	Status           string            `json:"status"`
+	Checks           map[string]string `json:"checks"`
+	RelayLastSuccess *time.Time        `json:"relay_last_success"`
+}
+
+// readiness checks that the broker and the peer can be reached. Checks run in parallel, and fail
+// after ReadinessTimeout.
+func (s *apiServer) readiness() (ready bool, report readinessReport) {
+	checks := map[string]func() error{
+		"broker": s.pingBroker,
+		"peer":   s.pingPeer,
+	}
+
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	ready = true
+	report = readinessReport{Status: "ready", Checks: make(map[string]string, len(checks))}
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() error) {
+			defer wg.Done()
+
+			result := make(chan error, 1)
+			go func() { result <- check() }()
+			var err error
+			select {
+			case err = <-result:
+			case <-time.After(ReadinessTimeout):
+				err = fmt.Errorf("timed out after %s", ReadinessTimeout)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				ready = false
+				report.Status = "not ready"
+				report.Checks[name] = err.Error()
+				return
+			}
+			report.Checks[name] = "ok"
+		}(name, check)
+	}
+	wg.Wait()
+
+	if s.relay != nil {
+		if lastSuccess := s.relay.LastSuccess(); !lastSuccess.IsZero() {
+			report.RelayLastSuccess = &lastSuccess
+		}
+	}
+	return ready, report
+}
+
+// pingBroker checks the connection to the broker by connecting to its address (NSQ only)
+func (s *apiServer) pingBroker() error {
+	if s.conf == nil || s.conf.Broker != common.BrokerNSQ {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", s.conf.BrokerHost, s.conf.BrokerPort), ReadinessTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// pingPeer checks the connection to the peer. The peer client has no health check: the outcome of
+// the last request sent to the peer (e.g. by the relay, which polls it) is used when it's recent
+// enough, and the query the relay makes is sent otherwise. It's sent at most once per
+// PeerCheckMaxAge, as it goes through the metered peer too.
+func (s *apiServer) pingPeer() error {
+	if peer, ok := s.peer.(*meteredPeer); ok {
+		if recent, err := peer.lastOutcome(PeerCheckMaxAge); recent {
+			return err
+		}
+	}
+	_, err := s.peer.QueryStatusLearnuplet(common.TaskStatusTodo)
+	return err
+}
+
+// ready is the readiness probe: it fails with a 503 status when the broker or the peer can't be
+// reached
+func (s *apiServer) ready(c *iris.Context) {
+	ready, report := s.readiness()
+	if !ready {
+		c.JSON(iris.StatusServiceUnavailable, report)
+		return
+	}
+	c.JSON(iris.StatusOK, report)
+}
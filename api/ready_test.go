@@ -0,0 +1,186 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingProducer is a producer whose broker connection can be down
+type failingProducer struct {
+	common.ProducerMOCK
+	down bool
+}
+
+func (p *failingProducer) Push(topic string, body []byte) error {
+	if p.down {
+		return fmt.Errorf("broker unreachable")
+	}
+	return nil
+}
+
+// failingPeer is a peer whose queries fail until it's brought back up
+type failingPeer struct {
+	client.Peer
+	up      bool
+	queries int
+}
+
+func (p *failingPeer) QueryStatusLearnuplet(status string) ([]byte, error) {
+	p.queries++
+	if !p.up {
+		return nil, fmt.Errorf("peer unreachable")
+	}
+	return p.Peer.QueryStatusLearnuplet(status)
+}
+
+func TestReadiness(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "morpheo_ready")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// A broker that's gone
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	brokerPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	conf := &ProducerConfig{Broker: common.BrokerNSQ, BrokerHost: "127.0.0.1", BrokerPort: brokerPort}
+	s := &apiServer{conf: conf, producer: &common.ProducerMOCK{}, peer: &client.PeerMock{}}
+	s.relay = &learnupletRelay{
+		store: newTestLedger(t, filepath.Join(tmpDir, "relay.db")),
+		push:  s.pushLearnuplet,
+	}
+
+	// The API isn't ready while the broker can't be reached
+	ready, report := s.readiness()
+	assert.False(t, ready)
+	assert.Equal(t, "not ready", report.Status)
+	assert.Equal(t, "ok", report.Checks["peer"])
+	assert.NotEqual(t, "ok", report.Checks["broker"])
+	assert.Nil(t, report.RelayLastSuccess)
+
+	// Nor while the peer can't
+	listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", brokerPort))
+	assert.Nil(t, err)
+	defer listener.Close()
+	peer := &failingPeer{Peer: &client.PeerMock{}}
+	s.peer = &meteredPeer{Peer: peer}
+	ready, report = s.readiness()
+	assert.False(t, ready)
+	assert.Equal(t, map[string]string{"broker": "ok", "peer": "peer unreachable"}, report.Checks)
+	assert.Equal(t, 1, peer.queries)
+
+	// The outcome of the last request to the peer is reused: it isn't queried again until it's
+	// requested by someone else
+	peer.up = true
+	ready, report = s.readiness()
+	assert.False(t, ready)
+	assert.Equal(t, "peer unreachable", report.Checks["peer"])
+	assert.Equal(t, 1, peer.queries)
+
+	_, err = s.peer.QueryStatusLearnuplet(common.TaskStatusTodo)
+	assert.Nil(t, err)
+	ready, report = s.readiness()
+	assert.True(t, ready)
+	assert.Equal(t, 2, peer.queries)
+
+	// Relay cycles are reported, whether they succeeded or not
+	s.relay.relay(newBatch(true))
+	ready, report = s.readiness()
+	assert.True(t, ready)
+	assert.Equal(t, "ready", report.Status)
+	if assert.NotNil(t, report.RelayLastSuccess) {
+		assert.Equal(t, s.relay.LastSuccess(), *report.RelayLastSuccess)
+	}
+}
+
+func TestAPIMetrics(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "morpheo_metrics")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	metrics := newAPIMetrics()
+	producer := &failingProducer{}
+	s := &apiServer{
+		producer: producer,
+		peer:     &meteredPeer{Peer: &failingPeer{Peer: &client.PeerMock{}}, metrics: metrics},
+		metrics:  metrics,
+	}
+	relay := &learnupletRelay{
+		store: newTestLedger(t, filepath.Join(tmpDir, "relay.db")),
+		push: func(ctx context.Context, learnuplet common.Learnuplet, messageID string) error {
+			return s.pushTask(ctx, common.TrainTopic, learnuplet.Key, messageID, []byte("{}"))
+		},
+		metrics: metrics,
+	}
+
+	// A successful relay cycle, then a failing one
+	relay.relay(newBatch(false, "l1"))
+	producer.down = true
+	relay.relay(newBatch(false, "l2"))
+	assert.NotNil(t, s.pingPeer())
+	metrics.observeRequest(ReevaluateRoute, "POST", 202, time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", MetricsRoute, nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`morpheo_api_pushes_total{outcome="ok",topic="train"} 1`,
+		`morpheo_api_pushes_total{outcome="error",topic="train"} 1`,
+		`morpheo_api_relay_cycles_total{outcome="ok"} 1`,
+		`morpheo_api_relay_cycles_total{outcome="error"} 1`,
+		`morpheo_api_peer_queries_total{method="QueryStatusLearnuplet"} 1`,
+		`morpheo_api_peer_query_errors_total{method="QueryStatusLearnuplet"} 1`,
+		`morpheo_api_requests_total{code="202",method="POST",route="/problem/:problem/reevaluate"} 1`,
+		`morpheo_api_request_duration_seconds_count{method="POST",route="/problem/:problem/reevaluate"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+	assert.Regexp(t, `morpheo_api_relay_last_success_timestamp_seconds [1-9]`, body)
+}
@@ -0,0 +1,345 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// Available relay sources
+const (
+	RelaySourcePoll   = "poll"
+	RelaySourceEvents = "events"
+)
+
+// errRelaySourceClosed is returned by the relay when its source stops sending batches
+var errRelaySourceClosed = errors.New("Learnuplet source closed")
+
+// LearnupletBatch is a set of learnuplets with status "todo" on the peer
+type LearnupletBatch struct {
+	Learnuplets []common.Learnuplet
+	// Complete is true when the batch holds every learnuplet with status "todo" on the peer (as
+	// opposed to the new ones only)
+	Complete bool
+}
+
+// LearnupletSource feeds the relay with the learnuplets that are ready to be computed. Batches are
+// sent on the returned channel until done is closed.
+type LearnupletSource interface {
+	Batches(done <-chan struct{}) (<-chan LearnupletBatch, error)
+}
+
+// ChaincodeEventSubscriber is implemented by peer clients that are able to stream the payloads of
+// a given chaincode event
+type ChaincodeEventSubscriber interface {
+	SubscribeChaincodeEvent(eventName string) (payloads <-chan []byte, unsubscribe func(), err error)
+}
+
+// learnupletRelay pushes learnuplets with status "todo" on the peer to the broker. It keeps track
+// of what has already been pushed in a RelayStore so that learnuplets are pushed only once, even
+// if the API restarts or several API replicas relay the same learnuplets.
+type learnupletRelay struct {
+	source  LearnupletSource
+	store   RelayStore
+	push    func(ctx context.Context, learnuplet common.Learnuplet, messageID string) error
+	metrics *apiMetrics
+
+	// Time of the last batch relayed without error
+	lock        sync.Mutex
+	lastSuccess time.Time
+}
+
+// relayLogger returns the logger of the learnuplet relay
+func relayLogger() *logging.Logger {
+	return logging.Default().With(logging.FieldComponent, "relay")
+}
+
+// Run relays learnuplets until done is closed (or forever if done is nil). If the source stops
+// sending batches before done is closed, errRelaySourceClosed is returned.
+func (r *learnupletRelay) Run(done <-chan struct{}) error {
+	batches, err := r.source.Batches(done)
+	if err != nil {
+		return fmt.Errorf("Error listening to learnuplet source: %s", err)
+	}
+	for batch := range batches {
+		r.relay(batch)
+	}
+	select {
+	case <-done:
+		return nil
+	default:
+		return errRelaySourceClosed
+	}
+}
+
+// LastSuccess returns the time of the last batch relayed without error (zero if there's none)
+func (r *learnupletRelay) LastSuccess() time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastSuccess
+}
+
+// relayLearnuplet pushes a learnuplet to the broker unless it has already been claimed. Each
+// learnuplet is the root of its own trace, followed up to the worker that computes it.
+func (r *learnupletRelay) relayLearnuplet(learnuplet common.Learnuplet) (err error) {
+	ctx, span := tracing.Start(context.Background(), "relay", trace.WithAttributes(tracing.AttributeTask.String(learnuplet.Key)))
+	defer func() { tracing.End(span, err) }()
+	logger := relayLogger().With(logging.FieldTask, learnuplet.Key)
+
+	claimed, err := r.store.Claim(learnuplet.Key)
+	if err != nil {
+		logger.Errorf("Failed to claim %s in the relay store: %s", learnuplet.Key, err)
+		return err
+	}
+	if !claimed {
+		return nil
+	}
+
+	// The broker doesn't give us the ID of the messages we push: let's give our own to each push
+	messageID := uuid.NewV4().String()
+	logger = logger.With(logging.FieldMessageID, messageID)
+	logger.Debugf("Posting %s to broker", learnuplet.Key)
+	if err := r.push(ctx, learnuplet, messageID); err != nil {
+		logger.Errorf("Failed to pushLearnuplet: %s", err)
+		if err := r.store.Release(learnuplet.Key); err != nil {
+			logger.Errorf("Failed to release %s in the relay store: %s", learnuplet.Key, err)
+		}
+		return err
+	}
+	if err := r.store.Confirm(learnuplet.Key, messageID); err != nil {
+		logger.Errorf("Failed to record %s in the relay store: %s", learnuplet.Key, err)
+		return err
+	}
+	return nil
+}
+
+func (r *learnupletRelay) relay(batch LearnupletBatch) {
+	// Let's keep track of the first error of the cycle, if any
+	var cycleErr error
+	fail := func(err error) {
+		if cycleErr == nil {
+			cycleErr = err
+		}
+	}
+	defer func() {
+		now := time.Now()
+		r.metrics.observeRelayCycle(now, cycleErr)
+		if cycleErr == nil {
+			r.lock.Lock()
+			r.lastSuccess = now
+			r.lock.Unlock()
+		}
+	}()
+
+	var todoList []string
+	for _, learnuplet := range batch.Learnuplets {
+		todoList = append(todoList, learnuplet.Key)
+		if err := r.relayLearnuplet(learnuplet); err != nil {
+			fail(err)
+		}
+	}
+
+	// Learnuplets that aren't "todo" anymore will never be relayed again: let's forget them
+	if batch.Complete {
+		if err := r.store.Retain(todoList); err != nil {
+			relayLogger().Errorf("Failed to clean the relay store up: %s", err)
+			fail(err)
+		}
+	}
+
+	n, err := r.store.Evict()
+	if err != nil {
+		relayLogger().Errorf("Failed to evict expired learnuplets from the relay store: %s", err)
+		fail(err)
+	} else if n > 0 {
+		relayLogger().Infof("%d expired learnuplet(s) evicted from the relay store", n)
+	}
+}
+
+// pollingSource queries the peer for learnuplets with status "todo" at a regular interval
+type pollingSource struct {
+	peer     client.Peer
+	interval time.Duration
+}
+
+func (s *pollingSource) Batches(done <-chan struct{}) (<-chan LearnupletBatch, error) {
+	batches := make(chan LearnupletBatch)
+	go func() {
+		defer close(batches)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			learnuplets, err := queryTodoLearnuplets(s.peer)
+			if err != nil {
+				relayLogger().Errorf("%s", err)
+				continue
+			}
+
+			select {
+			case <-done:
+				return
+			case batches <- LearnupletBatch{Learnuplets: learnuplets, Complete: true}:
+			}
+		}
+	}()
+	return batches, nil
+}
+
+// eventSource listens to the chaincode events emitted when learnuplets are created. It queries the
+// peer once when it starts to catch up with the learnuplets created while it wasn't listening. It
+// stops when the event stream is closed.
+type eventSource struct {
+	peer       client.Peer
+	subscriber ChaincodeEventSubscriber
+	eventName  string
+}
+
+func (s *eventSource) Batches(done <-chan struct{}) (<-chan LearnupletBatch, error) {
+	payloads, unsubscribe, err := s.subscriber.SubscribeChaincodeEvent(s.eventName)
+	if err != nil {
+		return nil, fmt.Errorf("Error subscribing to chaincode event %s: %s", s.eventName, err)
+	}
+
+	batches := make(chan LearnupletBatch)
+	go func() {
+		defer close(batches)
+		defer unsubscribe()
+
+		learnuplets, err := queryTodoLearnuplets(s.peer)
+		if err != nil {
+			relayLogger().Errorf("%s", err)
+		} else {
+			select {
+			case <-done:
+				return
+			case batches <- LearnupletBatch{Learnuplets: learnuplets, Complete: true}:
+			}
+		}
+
+		for {
+			var payload []byte
+			var ok bool
+			select {
+			case <-done:
+				return
+			case payload, ok = <-payloads:
+				if !ok {
+					relayLogger().Errorf("Chaincode event stream %s closed", s.eventName)
+					return
+				}
+			}
+
+			learnuplets, err := parseLearnuplets(payload)
+			if err != nil {
+				relayLogger().Errorf("Failed to parse %s event payload: %s", s.eventName, err)
+				continue
+			}
+
+			select {
+			case <-done:
+				return
+			case batches <- LearnupletBatch{Learnuplets: learnuplets}:
+			}
+		}
+	}()
+	return batches, nil
+}
+
+// queryTodoLearnuplets retrieves the learnuplets with status "todo" from the peer
+func queryTodoLearnuplets(peer client.Peer) ([]common.Learnuplet, error) {
+	learnupletsBytes, err := peer.QueryStatusLearnuplet(common.TaskStatusTodo)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to queryStatusLearnuplet: %s", err)
+	}
+
+	learnuplets, err := parseLearnuplets(learnupletsBytes)
+	if err != nil {
+		return nil, err
+	}
+	relayLogger().Infof("%d learnuplet(s) with status \"todo\" received from peer", len(learnuplets))
+	return learnuplets, nil
+}
+
+// parseLearnuplets converts one or several learnuplets in their chaincode format (TEMPORARY) to
+// valid learnuplets. Invalid learnuplets are logged and skipped.
+func parseLearnuplets(data []byte) ([]common.Learnuplet, error) {
+	var learnupletsChaincode []common.LearnupletChaincode
+	if err := json.Unmarshal(data, &learnupletsChaincode); err != nil {
+		var learnupletChaincode common.LearnupletChaincode
+		if err2 := json.Unmarshal(data, &learnupletChaincode); err2 != nil {
+			return nil, fmt.Errorf("Failed to Unmarshal learnuplets: %s", err)
+		}
+		learnupletsChaincode = append(learnupletsChaincode, learnupletChaincode)
+	}
+
+	var learnuplets []common.Learnuplet
+	for _, learnupletChaincode := range learnupletsChaincode {
+		learnupletFormat, err := learnupletChaincode.LearnupletFormat()
+		if err != nil {
+			relayLogger().With(logging.FieldTask, learnupletChaincode.Key).Errorf("Failed to format chaincode-%s: %s", learnupletChaincode.Key, err)
+			continue
+		}
+		// Check learnuplet is valid and add it to the list
+		err = learnupletFormat.Check()
+		if err != nil {
+			relayLogger().With(logging.FieldTask, learnupletChaincode.Key).Errorf("Invalid %s: %s", learnupletChaincode.Key, err)
+			continue
+		}
+		learnuplets = append(learnuplets, learnupletFormat)
+	}
+	return learnuplets, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSource streams a fixed set of batches, then stops
+type fakeSource struct {
+	batches []LearnupletBatch
+}
+
+func (s *fakeSource) Batches(done <-chan struct{}) (<-chan LearnupletBatch, error) {
+	batches := make(chan LearnupletBatch)
+	go func() {
+		defer close(batches)
+		for _, batch := range s.batches {
+			select {
+			case <-done:
+				return
+			case batches <- batch:
+			}
+		}
+	}()
+	return batches, nil
+}
+
+func newBatch(complete bool, keys ...string) LearnupletBatch {
+	batch := LearnupletBatch{Complete: complete}
+	for _, key := range keys {
+		batch.Learnuplets = append(batch.Learnuplets, common.Learnuplet{Key: key})
+	}
+	return batch
+}
+
+func newTestLedger(t *testing.T, path string) *boltLedger {
+	ledger, err := newBoltLedger(path, uuid.NewV4().String(), time.Hour, time.Minute)
+	assert.Nil(t, err)
+	return ledger
+}
+
+func TestRelay(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "morpheo_relay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	ledgerPath := filepath.Join(tmpDir, "relay.db")
+
+	var pushed []string
+	push := func(ctx context.Context, learnuplet common.Learnuplet, messageID string) error {
+		pushed = append(pushed, learnuplet.Key)
+		return nil
+	}
+
+	// Learnuplets are pushed once, even if they are received several times
+	ledger := newTestLedger(t, ledgerPath)
+	relay := &learnupletRelay{
+		source: &fakeSource{[]LearnupletBatch{
+			newBatch(true, "l1", "l2"),
+			newBatch(false, "l2", "l3"),
+		}},
+		store: ledger,
+		push:  push,
+	}
+	assert.Equal(t, errRelaySourceClosed, relay.Run(nil))
+	assert.Equal(t, []string{"l1", "l2", "l3"}, pushed)
+
+	// Restarting the relay mustn't re-push anything. A complete batch evicts learnuplets that
+	// aren't "todo" anymore, so that l1 gets pushed again once it's back in the "todo" list.
+	pushed = nil
+	assert.Nil(t, ledger.Close())
+	ledger = newTestLedger(t, ledgerPath)
+	defer ledger.Close()
+	relay = &learnupletRelay{
+		source: &fakeSource{[]LearnupletBatch{
+			newBatch(true, "l2", "l3"),
+			newBatch(false, "l1", "l4"),
+		}},
+		store: ledger,
+		push:  push,
+	}
+	assert.NotNil(t, relay.Run(nil))
+	assert.Equal(t, []string{"l1", "l4"}, pushed)
+
+	// Failed pushes are released and retried with the next batch
+	pushed = nil
+	failing := true
+	relay = &learnupletRelay{
+		source: &fakeSource{[]LearnupletBatch{
+			newBatch(false, "l5"),
+			newBatch(false, "l5"),
+		}},
+		store: ledger,
+		push: func(ctx context.Context, learnuplet common.Learnuplet, messageID string) error {
+			if failing {
+				failing = false
+				return fmt.Errorf("broker unavailable")
+			}
+			return push(ctx, learnuplet, messageID)
+		},
+	}
+	assert.NotNil(t, relay.Run(nil))
+	assert.Equal(t, []string{"l5"}, pushed)
+
+	// Relays stopped on purpose return no error
+	done := make(chan struct{})
+	close(done)
+	assert.Nil(t, relay.Run(done))
+}
+
+// fakeSubscriber streams the chaincode event payloads it's fed with
+type fakeSubscriber struct {
+	payloads     chan []byte
+	eventName    string
+	unsubscribed bool
+}
+
+func (s *fakeSubscriber) SubscribeChaincodeEvent(eventName string) (<-chan []byte, func(), error) {
+	s.eventName = eventName
+	return s.payloads, func() { s.unsubscribed = true }, nil
+}
+
+func TestEventSource(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "morpheo_relay")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	ledger := newTestLedger(t, filepath.Join(tmpDir, "relay.db"))
+	defer ledger.Close()
+
+	learnuplet := func(key string) map[string]interface{} {
+		return map[string]interface{}{
+			"key":       key,
+			"problem":   uuid.NewV4(),
+			"algo":      uuid.NewV4(),
+			"model_end": uuid.NewV4(),
+			"test_data": []uuid.UUID{uuid.NewV4()},
+		}
+	}
+	peer := &statusPeer{
+		Peer:        &client.PeerMock{},
+		learnuplets: map[string][]map[string]interface{}{common.TaskStatusTodo: {learnuplet("l1")}},
+	}
+	subscriber := &fakeSubscriber{payloads: make(chan []byte)}
+
+	var pushed []string
+	relay := &learnupletRelay{
+		source: &eventSource{peer: peer, subscriber: subscriber, eventName: "learnuplet"},
+		store:  ledger,
+		push: func(ctx context.Context, learnuplet common.Learnuplet, messageID string) error {
+			pushed = append(pushed, learnuplet.Key)
+			return nil
+		},
+	}
+	result := make(chan error)
+	go func() { result <- relay.Run(nil) }()
+
+	// The source catches up with the "todo" learnuplets, then relays the ones carried by events
+	// (one or several per event). Payloads that can't be parsed are skipped.
+	l2, err := json.Marshal(learnuplet("l2"))
+	assert.Nil(t, err)
+	l2l3, err := json.Marshal([]map[string]interface{}{learnuplet("l2"), learnuplet("l3")})
+	assert.Nil(t, err)
+	for _, payload := range [][]byte{l2, []byte("garbage"), l2l3} {
+		subscriber.payloads <- payload
+	}
+
+	// The relay stops, and unsubscribes, once the event stream is closed
+	close(subscriber.payloads)
+	assert.Equal(t, errRelaySourceClosed, <-result)
+	assert.Equal(t, []string{"l1", "l2", "l3"}, pushed)
+	assert.Equal(t, "learnuplet", subscriber.eventName)
+	assert.True(t, subscriber.unsubscribed)
+}
+
+func TestBoltLedger(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "morpheo_ledger")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	ledgerPath := filepath.Join(tmpDir, "relay.db")
+
+	// Learnuplets can only be claimed once
+	ledger := newTestLedger(t, ledgerPath)
+	claimed, err := ledger.Claim("l1")
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	claimed, err = ledger.Claim("l1")
+	assert.Nil(t, err)
+	assert.False(t, claimed)
+	assert.Nil(t, ledger.Confirm("l1", "m1"))
+
+	// Claims survive restarts, but confirming the claim of a previous run fails
+	claimed, err = ledger.Claim("l2")
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	assert.Nil(t, ledger.Close())
+	ledger = newTestLedger(t, ledgerPath)
+	defer ledger.Close()
+	assert.NotNil(t, ledger.Confirm("l2", "m2"))
+
+	// Claims expire after claimTTL, pushed learnuplets after ttl
+	now := time.Now()
+	ledger.now = func() time.Time { return now.Add(2 * time.Minute) }
+	claimed, err = ledger.Claim("l1")
+	assert.Nil(t, err)
+	assert.False(t, claimed)
+	claimed, err = ledger.Claim("l2")
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+
+	ledger.now = func() time.Time { return now.Add(2 * time.Hour) }
+	n, err := ledger.Evict()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	claimed, err = ledger.Claim("l1")
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+}
+
+func TestSharedLedger(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "morpheo_ledger")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	ledger := newTestLedger(t, filepath.Join(tmpDir, "relay.db"))
+	defer ledger.Close()
+
+	// One replica holds the ledger and serves it to the others
+	holder := &apiServer{
+		conf:    &ProducerConfig{LedgerToken: "secret"},
+		ledgers: map[string]*boltLedger{LedgerRelay: ledger},
+	}
+	app := holder.SetIrisApp()
+	app.Boot()
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	replica1 := newRemoteLedger(server.URL, "secret", LedgerRelay, "replica1")
+	replica2 := newRemoteLedger(server.URL, "secret", LedgerRelay, "replica2")
+
+	// Replicas can't claim the same learnuplet, nor confirm someone else's claim
+	claimed, err := replica1.Claim("l1")
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	for _, store := range []RelayStore{replica2, ledger} {
+		claimed, err = store.Claim("l1")
+		assert.Nil(t, err)
+		assert.False(t, claimed)
+	}
+	assert.NotNil(t, replica2.Confirm("l1", "m1"))
+	assert.Nil(t, replica2.Release("l1"))
+	assert.Nil(t, replica1.Confirm("l1", "m1"))
+
+	// Relays running on several replicas push each learnuplet once
+	var pushed []string
+	push := func(ctx context.Context, learnuplet common.Learnuplet, messageID string) error {
+		pushed = append(pushed, learnuplet.Key)
+		return nil
+	}
+	for _, store := range []RelayStore{replica1, replica2, ledger} {
+		relay := &learnupletRelay{
+			source: &fakeSource{[]LearnupletBatch{newBatch(true, "l1", "l2", "l3")}},
+			store:  store,
+			push:   push,
+		}
+		assert.Equal(t, errRelaySourceClosed, relay.Run(nil))
+	}
+	assert.Equal(t, []string{"l2", "l3"}, pushed)
+	n, err := replica2.Evict()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// The ledger is only served to replicas that know the secret, and only the ledgers held
+	_, err = newRemoteLedger(server.URL, "guess", LedgerRelay, "replica3").Claim("l4")
+	assert.Contains(t, fmt.Sprint(err), "401")
+	_, err = newRemoteLedger(server.URL, "secret", LedgerEvaluate, "replica3").Claim("l4")
+	assert.Contains(t, fmt.Sprint(err), "404")
+	claimed, err = ledger.Claim("l4")
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+}
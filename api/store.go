@@ -0,0 +1,271 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// RelayStore keeps track of the learnuplets that have been pushed to the broker. Several relays
+// (one per API replica) may share a store: a learnuplet has to be claimed before being pushed and
+// only one relay at a time can hold a claim on a given learnuplet. The API also keeps track of the evaluplets it pushes in a RelayStore of their own.
+type RelayStore interface {
+	// Claim reserves a learnuplet for the calling relay. It returns false if the learnuplet has
+	// already been pushed or is being pushed by another relay.
+	Claim(key string) (bool, error)
+	// Confirm records that a claimed learnuplet has been pushed to the broker
+	Confirm(key, messageID string) error
+	// Release gives a claim up, typically when pushing the learnuplet failed
+	Release(key string) error
+	// Retain forgets every pushed learnuplet but the given ones
+	Retain(keys []string) error
+	// Evict forgets the learnuplets pushed more than a TTL ago and the expired claims. It returns
+	// the number of evicted learnuplets.
+	Evict() (int, error)
+}
+
+// ledgerBucket is the name of the bolt bucket holding our ledger entries
+var ledgerBucket = []byte("learnuplets")
+
+// ledgerEntry describes a learnuplet in the ledger. A claimed learnuplet that hasn't been pushed
+// yet has no PushedAt nor MessageID.
+type ledgerEntry struct {
+	Owner     string    `json:"owner"`
+	ClaimedAt time.Time `json:"claimed_at"`
+	PushedAt  time.Time `json:"pushed_at"`
+	MessageID string    `json:"message_id"`
+}
+
+func (e *ledgerEntry) pushed() bool {
+	return e.MessageID != ""
+}
+
+// boltLedger is a RelayStore persisted in a bolt key/value file. Bolt transactions are atomic and
+// durable, so that a crash never leaves us with a corrupted ledger.
+//
+// The file is kept open, and locked, as long as the ledger is: it belongs to a single API replica
+// and mustn't be put on a shared volume (file locks over network filesystems can't be trusted).
+// Other replicas share it through that replica's API (see remoteLedger).
+type boltLedger struct {
+	db    *bolt.DB
+	path  string
+	owner string
+	// Pushed learnuplets are forgotten after ttl (and pushed again if they're still "todo")
+	ttl time.Duration
+	// Claims that haven't been confirmed expire after claimTTL (e.g. if a relay crashed while
+	// pushing a learnuplet)
+	claimTTL time.Duration
+
+	now func() time.Time
+}
+
+// ledgerLockTimeout is how long we wait for another process to release the ledger file
+const ledgerLockTimeout = 10 * time.Second
+
+// newBoltLedger opens (or creates) a ledger file on behalf of the relay identified by owner
+func newBoltLedger(path, owner string, ttl, claimTTL time.Duration) (*boltLedger, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: ledgerLockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening ledger %s (is it used by another process?): %s", path, err)
+	}
+	l := &boltLedger{
+		db:       db,
+		path:     path,
+		owner:    owner,
+		ttl:      ttl,
+		claimTTL: claimTTL,
+		now:      time.Now,
+	}
+	if err := l.update(func(b *bolt.Bucket) error { return nil }); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// forOwner returns the same ledger, on behalf of another relay
+func (l *boltLedger) forOwner(owner string) *boltLedger {
+	ledger := *l
+	ledger.owner = owner
+	return &ledger
+}
+
+// Close closes the ledger file, releasing its lock
+func (l *boltLedger) Close() error {
+	return l.db.Close()
+}
+
+// update runs fn in a read-write transaction on the ledger bucket
+func (l *boltLedger) update(fn func(b *bolt.Bucket) error) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(ledgerBucket)
+		if err != nil {
+			return fmt.Errorf("Error creating ledger bucket: %s", err)
+		}
+		return fn(b)
+	})
+}
+
+// expired tells if an entry can be forgotten
+func (l *boltLedger) expired(entry *ledgerEntry, now time.Time) bool {
+	if entry.pushed() {
+		return now.Sub(entry.PushedAt) > l.ttl
+	}
+	return now.Sub(entry.ClaimedAt) > l.claimTTL
+}
+
+func getEntry(b *bolt.Bucket, key string) (*ledgerEntry, error) {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return nil, nil
+	}
+	var entry ledgerEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("Error un-marshaling ledger entry %s: %s", key, err)
+	}
+	return &entry, nil
+}
+
+func putEntry(b *bolt.Bucket, key string, entry *ledgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Error marshaling ledger entry %s: %s", key, err)
+	}
+	return b.Put([]byte(key), data)
+}
+
+func (l *boltLedger) Claim(key string) (claimed bool, err error) {
+	err = l.update(func(b *bolt.Bucket) error {
+		now := l.now()
+		entry, err := getEntry(b, key)
+		if err != nil {
+			return err
+		}
+		if entry != nil && !l.expired(entry, now) {
+			return nil
+		}
+
+		claimed = true
+		return putEntry(b, key, &ledgerEntry{Owner: l.owner, ClaimedAt: now})
+	})
+	return claimed, err
+}
+
+func (l *boltLedger) Confirm(key, messageID string) error {
+	return l.update(func(b *bolt.Bucket) error {
+		entry, err := getEntry(b, key)
+		if err != nil {
+			return err
+		}
+		if entry == nil || entry.Owner != l.owner {
+			return fmt.Errorf("Error confirming %s: claim lost", key)
+		}
+
+		entry.PushedAt = l.now()
+		entry.MessageID = messageID
+		return putEntry(b, key, entry)
+	})
+}
+
+func (l *boltLedger) Release(key string) error {
+	return l.update(func(b *bolt.Bucket) error {
+		entry, err := getEntry(b, key)
+		if err != nil {
+			return err
+		}
+		if entry == nil || entry.Owner != l.owner || entry.pushed() {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (l *boltLedger) Retain(keys []string) error {
+	retained := make(map[string]bool)
+	for _, key := range keys {
+		retained[key] = true
+	}
+
+	return l.update(func(b *bolt.Bucket) error {
+		return l.deleteWhere(b, func(key string, entry *ledgerEntry) bool {
+			return entry.pushed() && !retained[key]
+		})
+	})
+}
+
+func (l *boltLedger) Evict() (n int, err error) {
+	err = l.update(func(b *bolt.Bucket) error {
+		now := l.now()
+		return l.deleteWhere(b, func(key string, entry *ledgerEntry) bool {
+			if l.expired(entry, now) {
+				n++
+				return true
+			}
+			return false
+		})
+	})
+	return n, err
+}
+
+// deleteWhere deletes the entries matching a given predicate
+func (l *boltLedger) deleteWhere(b *bolt.Bucket, match func(key string, entry *ledgerEntry) bool) error {
+	var toDelete [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var entry ledgerEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return fmt.Errorf("Error un-marshaling ledger entry %s: %s", k, err)
+		}
+		if match(string(k), &entry) {
+			toDelete = append(toDelete, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Bolt doesn't support deleting keys while iterating over a bucket
+	for _, k := range toDelete {
+		if err := b.Delete(k); err != nil {
+			return fmt.Errorf("Error deleting ledger entry %s: %s", k, err)
+		}
+	}
+	return nil
+}
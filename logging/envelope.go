@@ -0,0 +1,65 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package logging
+
+import (
+	"encoding/json"
+)
+
+// Envelope wraps the tasks pushed to the broker with the task key and the ID of the message, so
+// that the logs of the API and workers can be joined, and with the trace context of the span that
+// pushed them (W3C Trace Context headers, if any)
+type Envelope struct {
+	Key       string            `json:"key"`
+	MessageID string            `json:"message_id"`
+	Trace     map[string]string `json:"trace,omitempty"`
+	Task      json.RawMessage   `json:"task"`
+}
+
+// Wrap puts a marshaled task in an envelope
+func Wrap(key, messageID string, trace map[string]string, task []byte) ([]byte, error) {
+	return json.Marshal(Envelope{Key: key, MessageID: messageID, Trace: trace, Task: task})
+}
+
+// Unwrap returns the envelope of a message. Messages that weren't wrapped (pushed by older
+// services) are returned as the envelope's task, without key nor message ID.
+func Unwrap(message []byte) Envelope {
+	var envelope Envelope
+	if err := json.Unmarshal(message, &envelope); err != nil || len(envelope.Task) == 0 || envelope.Task[0] != '{' {
+		return Envelope{Task: message}
+	}
+	return envelope
+}
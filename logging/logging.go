@@ -0,0 +1,260 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package logging provides the structured, leveled logger shared by the compute API and workers.
+// Every line is a JSON object holding a timestamp, a level, a message and the logger's fields
+// (task key, worker ID, step...), so that the logs of a task can be followed across services.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int
+
+// Log levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+	LevelFatal
+)
+
+var levelNames = []string{"debug", "info", "warning", "error", "fatal"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelFatal {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelDebug, fmt.Errorf("Unknown log level %s (available levels: %s)", name, strings.Join(levelNames, ", "))
+}
+
+// Standard field names
+const (
+	FieldComponent = "component"
+	FieldTask      = "task"
+	FieldMessageID = "message_id"
+	FieldWorker    = "worker"
+	FieldStep      = "step"
+	FieldDuration  = "duration"
+	FieldError     = "error"
+)
+
+// Fields are the key/value pairs attached to log lines
+type Fields map[string]interface{}
+
+// output serializes the lines written by loggers sharing a writer
+type output struct {
+	lock  sync.Mutex
+	w     io.Writer
+	level Level
+}
+
+// Logger writes JSON log lines with a set of fields. Loggers are immutable: With and Start return
+// new loggers sharing the same output.
+type Logger struct {
+	out    *output
+	fields Fields
+	// Lines carry the duration since start, if set
+	start time.Time
+	now   func() time.Time
+}
+
+// New creates a logger writing lines of the given level and above to w
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{out: &output{w: w, level: level}, now: time.Now}
+}
+
+var (
+	defaultLogger     = New(os.Stdout, LevelDebug)
+	defaultLoggerLock sync.RWMutex
+)
+
+// Default returns the logger used when there's no other at hand
+func Default() *Logger {
+	defaultLoggerLock.RLock()
+	defer defaultLoggerLock.RUnlock()
+	return defaultLogger
+}
+
+// SetDefault replaces the default logger
+func SetDefault(l *Logger) {
+	defaultLoggerLock.Lock()
+	defer defaultLoggerLock.Unlock()
+	defaultLogger = l
+}
+
+// With returns a logger adding a field to its lines
+func (l *Logger) With(key string, value interface{}) *Logger {
+	return l.WithFields(Fields{key: value})
+}
+
+// WithFields returns a logger adding a set of fields to its lines
+func (l *Logger) WithFields(fields Fields) *Logger {
+	child := *l
+	child.fields = make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		child.fields[k] = v
+	}
+	for k, v := range fields {
+		child.fields[k] = v
+	}
+	return &child
+}
+
+// Start returns a logger for a step of a task: its lines carry the step name and the time elapsed
+// since the step started (in seconds)
+func (l *Logger) Start(step string) *Logger {
+	child := l.With(FieldStep, step)
+	child.start = l.now()
+	return child
+}
+
+// Elapsed returns the time elapsed since the logger's step started
+func (l *Logger) Elapsed() time.Duration {
+	if l.start.IsZero() {
+		return 0
+	}
+	return l.now().Sub(l.start)
+}
+
+// Enabled tells if lines of a given level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+// Log writes a line of a given level
+func (l *Logger) Log(level Level, format string, a ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	line := make(map[string]interface{}, len(l.fields)+4)
+	for k, v := range l.fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		line[k] = v
+	}
+	if !l.start.IsZero() {
+		line[FieldDuration] = l.Elapsed().Seconds()
+	}
+	line["time"] = l.now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = fmt.Sprintf(format, a...)
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"time":  line["time"],
+			"level": line["level"],
+			"msg":   line["msg"],
+			"error": fmt.Sprintf("Error marshaling log fields: %s", err),
+		})
+	}
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.w.Write(append(data, '\n'))
+}
+
+// Debugf writes a debug line
+func (l *Logger) Debugf(format string, a ...interface{}) { l.Log(LevelDebug, format, a...) }
+
+// Infof writes an info line
+func (l *Logger) Infof(format string, a ...interface{}) { l.Log(LevelInfo, format, a...) }
+
+// Warningf writes a warning line
+func (l *Logger) Warningf(format string, a ...interface{}) { l.Log(LevelWarning, format, a...) }
+
+// Errorf writes an error line
+func (l *Logger) Errorf(format string, a ...interface{}) { l.Log(LevelError, format, a...) }
+
+// Panicf writes a fatal line and panics with its message
+func (l *Logger) Panicf(format string, a ...interface{}) {
+	l.Log(LevelFatal, format, a...)
+	panic(fmt.Sprintf(format, a...))
+}
+
+// Writer returns an io.Writer turning each line written to it into a log line of a given level,
+// for libraries that log through a *log.Logger
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: l, level: level}
+}
+
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.Log(w.level, "%s", line)
+	}
+	return len(p), nil
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying a logger
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) (lines []map[string]interface{}) {
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if raw == "" {
+			continue
+		}
+		var line map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(raw), &line), raw)
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Date(2017, 11, 2, 10, 0, 0, 0, time.UTC)
+	l := New(&buf, LevelInfo)
+	l.now = func() time.Time { return now }
+
+	// Lines below the logger's level are dropped
+	l.Debugf("not written")
+	assert.Equal(t, "", buf.String())
+
+	// Lines carry the logger's fields, and the duration of its step if any
+	task := l.WithFields(Fields{FieldTask: "learnuplet1", FieldWorker: "w1"})
+	step := task.Start("train")
+	now = now.Add(1500 * time.Millisecond)
+	step.With(FieldError, assert.AnError).Warningf("Training %s", "done")
+	task.Infof("no step")
+
+	lines := decodeLines(t, &buf)
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, map[string]interface{}{
+		"time":        "2017-11-02T10:00:01.5Z",
+		"level":       "warning",
+		"msg":         "Training done",
+		FieldTask:     "learnuplet1",
+		FieldWorker:   "w1",
+		FieldStep:     "train",
+		FieldDuration: 1.5,
+		FieldError:    assert.AnError.Error(),
+	}, lines[0])
+	assert.NotContains(t, lines[1], FieldStep)
+	assert.NotContains(t, lines[1], FieldDuration)
+
+	// Each line written to a logger's writer is a log line
+	buf.Reset()
+	l.Writer(LevelError).Write([]byte("first\nsecond\n"))
+	lines = decodeLines(t, &buf)
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "second", lines[1]["msg"])
+	assert.Equal(t, "error", lines[1]["level"])
+
+	// Loggers travel along contexts
+	assert.Equal(t, Default(), FromContext(context.Background()))
+	assert.Equal(t, task, FromContext(WithLogger(context.Background(), task)))
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARNING")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelWarning, level)
+
+	_, err = ParseLevel("verbose")
+	assert.NotNil(t, err)
+}
+
+func TestEnvelope(t *testing.T) {
+	task := []byte(`{"key":"learnuplet1"}`)
+	trace := map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	message, err := Wrap("learnuplet1", "message1", trace, task)
+	assert.Nil(t, err)
+	envelope := Unwrap(message)
+	assert.Equal(t, "learnuplet1", envelope.Key)
+	assert.Equal(t, "message1", envelope.MessageID)
+	assert.Equal(t, trace, envelope.Trace)
+	assert.JSONEq(t, string(task), string(envelope.Task))
+
+	// Messages pushed without envelope are returned as is
+	envelope = Unwrap(task)
+	assert.Equal(t, "", envelope.Key)
+	assert.Equal(t, string(task), string(envelope.Task))
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Package tracing provides the distributed tracing shared by the compute API and workers. Spans are
+// exported with OpenTelemetry over OTLP/HTTP, and their context travels from the API to workers in
+// the envelope of broker messages.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer our spans are created with
+const TracerName = "github.com/MorpheoOrg/morpheo-compute"
+
+// Standard attribute keys
+const (
+	AttributeService   = attribute.Key("service.name")
+	AttributeTask      = attribute.Key("morpheo.task")
+	AttributeMessageID = attribute.Key("morpheo.message_id")
+	AttributeWorker    = attribute.Key("morpheo.worker")
+	AttributeStep      = attribute.Key("morpheo.step")
+	AttributeBlobKind  = attribute.Key("morpheo.blob.kind")
+	AttributeBlobID    = attribute.Key("morpheo.blob.id")
+	AttributeTopic     = attribute.Key("messaging.destination.name")
+	AttributeRoute     = attribute.Key("http.route")
+	AttributeStatus    = attribute.Key("http.response.status_code")
+)
+
+// propagator serializes span contexts in the W3C Trace Context format
+var propagator = propagation.TraceContext{}
+
+// Setup makes the spans of a service exported to an OTLP/HTTP collector (e.g.
+// http://otel-collector:4318). Spans are dropped if endpoint is empty. The returned function
+// flushes the pending spans and stops exporting them.
+func Setup(service, endpoint string) (shutdown func(context.Context) error, err error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	return install(service, sdktrace.WithBatcher(exporter)), nil
+}
+
+// SetExporter makes the spans of a service exported synchronously to an exporter (typically a
+// tracetest.InMemoryExporter in tests). The returned function stops exporting them.
+func SetExporter(service string, exporter sdktrace.SpanExporter) (shutdown func(context.Context) error) {
+	return install(service, sdktrace.WithSyncer(exporter))
+}
+
+func install(service string, exporter sdktrace.TracerProviderOption) func(context.Context) error {
+	provider := sdktrace.NewTracerProvider(
+		exporter,
+		sdktrace.WithResource(resource.NewSchemaless(AttributeService.String(service))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+// Start starts a span, child of the span of ctx if any
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, opts...)
+}
+
+// RecordError marks a span as failed with err, unless err is nil
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends a span, failed with err unless err is nil
+func End(span trace.Span, err error) {
+	RecordError(span, err)
+	span.End()
+}
+
+// ContextWithSpan returns a copy of ctx carrying the span of from
+func ContextWithSpan(ctx, from context.Context) context.Context {
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(from))
+}
+
+// Inject returns the context of the span of ctx, to be carried in a broker message (nil if there's
+// no span to carry)
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns a copy of ctx carrying the span context found in a carrier (a broker message
+// trace context, HTTP headers...), so that the spans started with it are its children
+func Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return propagator.Extract(ctx, carrier)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPropagation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	defer SetExporter("test", exporter)(context.Background())
+
+	// Without a span, there's nothing to carry
+	assert.Nil(t, Inject(context.Background()))
+
+	ctx, parent := Start(context.Background(), "parent")
+	carrier := Inject(ctx)
+	assert.Contains(t, carrier, "traceparent")
+
+	// Spans started from the extracted context are children of the injected span, be it carried in
+	// a broker message or in HTTP headers
+	_, child := Start(Extract(context.Background(), propagation.MapCarrier(carrier)), "child")
+	child.End()
+	header := http.Header{}
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+	_, request := Start(Extract(context.Background(), propagation.HeaderCarrier(header)), "request")
+	request.End()
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	for _, span := range spans[:2] {
+		assert.Equal(t, parent.SpanContext().TraceID(), span.SpanContext.TraceID(), span.Name)
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID(), span.Name)
+	}
+	assert.Contains(t, spans[2].Resource.Attributes(), AttributeService.String("test"))
+}
+
+func TestEnd(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	defer SetExporter("test", exporter)(context.Background())
+
+	_, ok := Start(context.Background(), "ok")
+	End(ok, nil)
+	_, failed := Start(context.Background(), "failed")
+	End(failed, fmt.Errorf("broker unavailable"))
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+	assert.Equal(t, "broker unavailable", spans[1].Status.Description)
+	assert.Len(t, spans[1].Events, 1)
+}
@@ -0,0 +1,347 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ArchiveLimits bounds what an archive pulled from storage may unpack to on the worker's disk
+type ArchiveLimits struct {
+	// Maximum total size of the files in the archive, in bytes
+	MaxSize int64
+	// Maximum number of entries in the archive
+	MaxFiles int
+	// Maximum ratio between the uncompressed and compressed sizes of the archive (only checked
+	// once more than ratioCheckThreshold bytes have been uncompressed, small archives compress
+	// their tar padding very well)
+	MaxRatio float64
+}
+
+// DefaultArchiveLimits are the archive limits of workers created with NewWorker
+var DefaultArchiveLimits = ArchiveLimits{
+	MaxSize:  10 << 30,
+	MaxFiles: 100000,
+	MaxRatio: 200,
+}
+
+const ratioCheckThreshold = 1 << 20
+
+// SetArchiveLimits sets the limits that archives are unpacked within
+func (w *Worker) SetArchiveLimits(limits ArchiveLimits) {
+	w.archiveLimits = limits
+}
+
+func (w *Worker) limits() ArchiveLimits {
+	if w.archiveLimits == (ArchiveLimits{}) {
+		return DefaultArchiveLimits
+	}
+	return w.archiveLimits
+}
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ratioReader fails when the data read from it gets too big compared to the compressed data it was
+// uncompressed from
+type ratioReader struct {
+	r          io.Reader
+	compressed *countingReader
+	n          int64
+	maxRatio   float64
+}
+
+func (r *ratioReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.n > ratioCheckThreshold && float64(r.n) > r.maxRatio*float64(r.compressed.n) {
+		return n, fmt.Errorf("compression ratio is over %.0f (%d bytes uncompressed from %d bytes)", r.maxRatio, r.n, r.compressed.n)
+	}
+	return n, err
+}
+
+// archivePath returns the path an archive entry unpacks to in folder, making sure it doesn't
+// escape it, along with the entry's clean relative path
+func archivePath(folder, name string) (path, rel string, err error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", "", fmt.Errorf("absolute path %s", name)
+	}
+	rel = filepath.Clean(name)
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("path %s escapes the destination folder", name)
+	}
+
+	// Symlinks are only checked against their own location: entries can't go through them
+	parent := folder
+	components := strings.Split(rel, string(filepath.Separator))
+	for i, component := range components {
+		parent = filepath.Join(parent, component)
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if i == len(components)-1 {
+				return "", "", fmt.Errorf("path %s overwrites a symlink", name)
+			}
+			return "", "", fmt.Errorf("path %s goes through a symlink", name)
+		}
+	}
+	return filepath.Join(folder, rel), rel, nil
+}
+
+// checkSymlink makes sure that a symlink located at rel (relative to the archive's root) points to
+// a path inside the archive. Targets have to be clean relative paths: their ".." components all
+// come first and can't climb higher than the archive's root.
+func checkSymlink(rel, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("symlink %s points to absolute path %s", rel, target)
+	}
+	if target != filepath.Clean(target) {
+		return fmt.Errorf("symlink %s points to %s, which isn't a clean path", rel, target)
+	}
+
+	depth := 0
+	if dir := filepath.Dir(rel); dir != "." {
+		depth = len(strings.Split(dir, string(filepath.Separator)))
+	}
+	for _, component := range strings.Split(target, string(filepath.Separator)) {
+		if component != ".." {
+			break
+		}
+		depth--
+		if depth < 0 {
+			return fmt.Errorf("symlink %s points to %s, which escapes the archive", rel, target)
+		}
+	}
+	return nil
+}
+
+// archiveMode strips the permissions that archived or extracted files mustn't have (setuid,
+// setgid, sticky bits and group/world write permissions)
+func archiveMode(mode os.FileMode) os.FileMode {
+	return mode.Perm() &^ 0022
+}
+
+// untarInFolder safely unpacks a tar archive in a folder: entries can't escape the folder,
+// symlinks must point inside it, hardlinks and special files are rejected and the archive has to
+// fit in the worker's archive limits. compressed counts the bytes of the archive before
+// decompression (for compression ratio checks).
+func (w *Worker) untarInFolder(folder string, tarStream io.Reader, compressed *countingReader) error {
+	limits := w.limits()
+	tarReader := tar.NewReader(&ratioReader{r: tarStream, compressed: compressed, maxRatio: limits.MaxRatio})
+
+	var (
+		files int
+		size  int64
+	)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Error reading tar archive: %s", err)
+		}
+
+		files++
+		if files > limits.MaxFiles {
+			return fmt.Errorf("Error unflattening tar archive: more than %d entries", limits.MaxFiles)
+		}
+
+		path, rel, err := archivePath(folder, header.Name)
+		if err != nil {
+			return fmt.Errorf("Error unflattening tar archive: %s", err)
+		}
+		mode := archiveMode(header.FileInfo().Mode())
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			// Let's make sure we can unpack the directory's content
+			mode |= 0700
+			if err := os.MkdirAll(path, mode); err != nil {
+				return fmt.Errorf("Error unflattening tar archive: error creating directory %s: %s", path, err)
+			}
+			if err := os.Chmod(path, mode); err != nil {
+				return fmt.Errorf("Error unflattening tar archive: error setting mode of directory %s: %s", path, err)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if header.Size > limits.MaxSize-size {
+				return fmt.Errorf("Error unflattening tar archive: archive is bigger than %d bytes", limits.MaxSize)
+			}
+			n, err := extractFile(path, mode, tarReader, limits.MaxSize-size)
+			size += n
+			if err != nil {
+				return fmt.Errorf("Error unflattening tar archive: %s", err)
+			}
+		case tar.TypeSymlink:
+			if err := checkSymlink(rel, header.Linkname); err != nil {
+				return fmt.Errorf("Error unflattening tar archive: %s", err)
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return fmt.Errorf("Error unflattening tar archive: error creating directory %s: %s", filepath.Dir(path), err)
+			}
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return fmt.Errorf("Error unflattening tar archive: error creating symlink %s: %s", path, err)
+			}
+		case tar.TypeXGlobalHeader:
+			// PAX global headers hold no file
+		default:
+			return fmt.Errorf("Error unflattening tar archive: %s has unsupported type %q (hardlinks and special files aren't allowed)", header.Name, header.Typeflag)
+		}
+	}
+}
+
+// extractFile writes at most maxSize bytes to a file, closing it right away
+func extractFile(path string, mode os.FileMode, content io.Reader, maxSize int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, fmt.Errorf("error creating directory %s: %s", filepath.Dir(path), err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return 0, fmt.Errorf("error creating file %s: %s", path, err)
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, io.LimitReader(content, maxSize+1))
+	if err != nil {
+		return n, fmt.Errorf("error writing to file %s: %s", path, err)
+	}
+	if n > maxSize {
+		return n, fmt.Errorf("archive is bigger than %d bytes", maxSize)
+	}
+	// The mode of created files is subject to the umask
+	if err = file.Chmod(mode); err != nil {
+		return n, fmt.Errorf("error setting mode of file %s: %s", path, err)
+	}
+	return n, file.Close()
+}
+
+// ArchiveFolder tars a folder, compresses it in the worker's archive format and forwards it to an
+// io.Writer. Directories, file modes (within archiveMode's mask) and symlinks pointing inside the
+// folder are kept, other symlinks and special files are left out.
+func (w *Worker) ArchiveFolder(folder string, dest io.Writer) error {
+	// Let's wire our writer together
+	codec := w.codec()
+	compressedWriter, err := codec.NewWriter(dest)
+	if err != nil {
+		return fmt.Errorf("Error creating %s writer: %s", codec.Format(), err)
+	}
+	tarWriter := tar.NewWriter(compressedWriter)
+
+	// Let's walk the target folder recursively and add each entry to the tar archive
+	err = filepath.Walk(folder, func(path string, info os.FileInfo, walkerr error) error {
+		if walkerr != nil {
+			return fmt.Errorf("Error walking %s: %s", folder, walkerr)
+		}
+
+		filename, err := filepath.Rel(folder, path)
+		if err != nil {
+			return fmt.Errorf("Error removing %s component from path %s: %s", folder, path, err)
+		}
+		if filename == "." {
+			return nil
+		}
+
+		header := &tar.Header{
+			Name:    filepath.ToSlash(filename),
+			Mode:    int64(archiveMode(info.Mode())),
+			ModTime: info.ModTime(),
+		}
+		switch {
+		case info.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+		case info.Mode().IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Size = info.Size()
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("Error reading symlink %s: %s", path, err)
+			}
+			if err = checkSymlink(filename, target); err != nil {
+				w.logger().Warningf("Leaving %s out of tar archive: %s", path, err)
+				return nil
+			}
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = target
+		default:
+			w.logger().Warningf("Leaving %s out of tar archive: special files aren't supported", path)
+			return nil
+		}
+
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("Error writing tar header for file %s: %s", path, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Error opening file from path %s: %s", path, err)
+		}
+		defer file.Close()
+		if _, err := io.Copy(tarWriter, file); err != nil {
+			return fmt.Errorf("Error writing file %s to tar archive: %s", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = tarWriter.Close(); err != nil {
+		return fmt.Errorf("Error closing tar archive: %s", err)
+	}
+	return compressedWriter.Close()
+}
@@ -0,0 +1,326 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+)
+
+const cacheTmpPrefix = ".pull-"
+
+// CacheStats holds usage metrics of a BlobCache
+type CacheStats struct {
+	Hits         int64
+	Misses       int64
+	Evictions    int64
+	EvictedBytes int64
+	Entries      int
+	Size         int64
+}
+
+// BlobCache is an on-disk LRU cache of storage blobs (problem workflows, algos, datasets...). Blobs
+// are content-addressed: they're keyed by kind, UUID and checksum (if one is known). Least
+// recently used blobs are evicted once the cache grows over its size limit, unless they're being
+// read or copied at the time.
+//
+// Cached files are read-only and are copied into task folders rather than hardlinked: task folders
+// are mounted into untrusted containers, which must not share inodes with the cache.
+type BlobCache struct {
+	dir     string
+	maxSize int64
+
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	lru     *list.List // Most recently used entries first
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	key   string
+	size  int64
+	pins  int           // Number of pending reads or copies of the blob
+	ready chan struct{} // Closed once the blob has been pulled (or failed to be pulled)
+	err   error
+	elem  *list.Element
+}
+
+// CacheKey returns the key of a blob in the cache
+func CacheKey(kind string, id uuid.UUID, checksum string) string {
+	if checksum == "" {
+		return fmt.Sprintf("%s-%s", kind, id)
+	}
+	return fmt.Sprintf("%s-%s-%s", kind, id, checksum)
+}
+
+// NewBlobCache creates a blob cache in dir, indexing the blobs that may have been cached there
+// already
+func NewBlobCache(dir string, maxSize int64) (*BlobCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating cache folder %s: %s", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing cache folder %s: %s", dir, err)
+	}
+
+	c := &BlobCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*cacheEntry),
+		lru:     list.New(),
+	}
+
+	// Least recently modified blobs are the first to go
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(f.Name(), cacheTmpPrefix) {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		e := &cacheEntry{key: f.Name(), size: f.Size(), ready: make(chan struct{})}
+		close(e.ready)
+		e.elem = c.lru.PushBack(e)
+		c.entries[e.key] = e
+		c.stats.Size += e.size
+	}
+
+	c.lock.Lock()
+	c.evict()
+	c.lock.Unlock()
+	return c, nil
+}
+
+// Stats returns the cache usage metrics
+func (c *BlobCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// Open returns a cached blob, pulling it first if needed
+func (c *BlobCache) Open(ctx context.Context, key string, pull func() (io.ReadCloser, error)) (blob *os.File, err error) {
+	err = c.use(ctx, key, pull, func(path string) error {
+		blob, err = os.Open(path)
+		return err
+	})
+	return blob, err
+}
+
+// CopyTo copies a cached blob to dst, pulling it first if needed. It returns the size of the blob.
+func (c *BlobCache) CopyTo(ctx context.Context, key string, pull func() (io.ReadCloser, error), dst string) (size int64, err error) {
+	err = c.use(ctx, key, pull, func(path string) error {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		size = info.Size()
+		return copyFile(path, dst)
+	})
+	return size, err
+}
+
+// use makes sure that a blob is cached and prevents it from being evicted while it's being used
+func (c *BlobCache) use(ctx context.Context, key string, pull func() (io.ReadCloser, error), use func(path string) error) error {
+	c.lock.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(e.elem)
+	} else {
+		c.stats.Misses++
+		e = &cacheEntry{key: key, ready: make(chan struct{})}
+		e.elem = c.lru.PushFront(e)
+		c.entries[key] = e
+	}
+	e.pins++
+	c.lock.Unlock()
+	defer c.unpin(e)
+
+	if !ok {
+		c.pull(e, pull)
+	}
+
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if e.err != nil {
+		return e.err
+	}
+	return use(c.path(key))
+}
+
+// pull downloads a blob to the cache. Concurrent users of the blob wait for it to be ready.
+func (c *BlobCache) pull(e *cacheEntry, pull func() (io.ReadCloser, error)) {
+	size, err := c.download(e.key, pull)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil {
+		c.lru.Remove(e.elem)
+		delete(c.entries, e.key)
+		e.err = err
+	} else {
+		e.size = size
+		c.stats.Size += size
+	}
+	close(e.ready)
+}
+
+func (c *BlobCache) download(key string, pull func() (io.ReadCloser, error)) (int64, error) {
+	blob, err := pull()
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+
+	tmpFile, err := ioutil.TempFile(c.dir, cacheTmpPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("Error creating file in cache folder: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	n, err := io.Copy(tmpFile, blob)
+	tmpFile.Close()
+	if err != nil {
+		return n, fmt.Errorf("Error copying %s to cache (%d bytes written): %s", key, n, err)
+	}
+	if err = os.Chmod(tmpFile.Name(), 0444); err != nil {
+		return n, fmt.Errorf("Error making cached %s read-only: %s", key, err)
+	}
+	if err = os.Rename(tmpFile.Name(), c.path(key)); err != nil {
+		return n, fmt.Errorf("Error moving %s to cache: %s", key, err)
+	}
+	return n, nil
+}
+
+func (c *BlobCache) unpin(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e.pins--
+	c.evict()
+}
+
+// evict removes least recently used blobs until the cache fits in its size limit. c.lock must be
+// held.
+func (c *BlobCache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.stats.Size > c.maxSize; {
+		e := elem.Value.(*cacheEntry)
+		elem = elem.Prev()
+		if e.pins > 0 {
+			continue
+		}
+		if err := os.Remove(c.path(e.key)); err != nil && !os.IsNotExist(err) {
+			logging.Default().With(logging.FieldComponent, "cache").Warningf("Error evicting %s: %s", e.key, err)
+			continue
+		}
+		c.lru.Remove(e.elem)
+		delete(c.entries, e.key)
+		c.stats.Size -= e.size
+		c.stats.Evictions++
+		c.stats.EvictedBytes += e.size
+		logging.Default().With(logging.FieldComponent, "cache").Debugf("Evicted %s (%d bytes), cache size is now %d bytes", e.key, e.size, c.stats.Size)
+	}
+}
+
+func (c *BlobCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// SetCache makes the worker pull blobs through a cache (nil disables caching)
+func (w *Worker) SetCache(cache *BlobCache) {
+	w.cache = cache
+}
+
+// openBlob pulls a blob from storage, through the worker's cache if it has one. Reading the blob
+// fails as soon as ctx is done, or when reaching its end if it doesn't match its checksum (with a
+// storage TaskError).
+func (w *Worker) openBlob(ctx context.Context, kind blobKind, id uuid.UUID) (*ChecksumReader, error) {
+	pull, checksum, err := w.pullBlob(ctx, kind, id)
+	if err != nil {
+		return nil, err
+	}
+	if w.cache == nil || !kind.cached {
+		return pull()
+	}
+
+	blob, err := w.cache.Open(ctx, CacheKey(kind.name, id, checksum), func() (io.ReadCloser, error) {
+		return pull()
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Cached blobs have been checked when they were pulled
+	return NewChecksumReader(newContextReader(ctx, blob), kind.name, id, ""), nil
+}
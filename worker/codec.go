@@ -0,0 +1,173 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveFormat is the (compression) format of a tar archive
+type ArchiveFormat string
+
+// Archive formats
+const (
+	ArchiveFormatGzip ArchiveFormat = "gzip"
+	ArchiveFormatZstd ArchiveFormat = "zstd"
+	ArchiveFormatTar  ArchiveFormat = "tar"
+)
+
+// Codec compresses and decompresses tar archives in a given format
+type Codec interface {
+	Format() ArchiveFormat
+	// Detect tells whether an archive is in the codec's format, given its first bytes
+	Detect(header []byte) bool
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// Codecs are the supported archive codecs
+var Codecs = []Codec{gzipCodec{}, zstdCodec{}, tarCodec{}}
+
+// detectHeaderSize is the number of bytes needed to detect the format of an archive (the tar magic
+// ends at offset 262)
+const detectHeaderSize = 262
+
+// CodecFor returns the codec of an archive format
+func CodecFor(format ArchiveFormat) (Codec, error) {
+	for _, codec := range Codecs {
+		if codec.Format() == format {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("Unsupported archive format %q (supported formats: gzip, zstd, tar)", format)
+}
+
+// OpenArchive detects the format of an archive from its magic bytes and returns the uncompressed
+// tar stream
+func OpenArchive(archive io.Reader) (io.ReadCloser, ArchiveFormat, error) {
+	buffered := bufio.NewReaderSize(archive, detectHeaderSize)
+	header, err := buffered.Peek(detectHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("Error reading archive header: %s", err)
+	}
+	for _, codec := range Codecs {
+		if codec.Detect(header) {
+			reader, err := codec.NewReader(buffered)
+			if err != nil {
+				return nil, "", fmt.Errorf("Error opening %s archive: %s", codec.Format(), err)
+			}
+			return reader, codec.Format(), nil
+		}
+	}
+	return nil, "", fmt.Errorf("Unknown archive format")
+}
+
+// SetArchiveFormat sets the format of the archives created by the worker (gzip by default)
+func (w *Worker) SetArchiveFormat(codec Codec) {
+	w.archiveCodec = codec
+}
+
+func (w *Worker) codec() Codec {
+	if w.archiveCodec == nil {
+		return gzipCodec{}
+	}
+	return w.archiveCodec
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Format() ArchiveFormat { return ArchiveFormatGzip }
+
+func (gzipCodec) Detect(header []byte) bool {
+	return bytes.HasPrefix(header, []byte{0x1f, 0x8b})
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Format() ArchiveFormat { return ArchiveFormatZstd }
+
+func (zstdCodec) Detect(header []byte) bool {
+	return bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd})
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+type tarCodec struct{}
+
+func (tarCodec) Format() ArchiveFormat { return ArchiveFormatTar }
+
+func (tarCodec) Detect(header []byte) bool {
+	return len(header) >= detectHeaderSize && bytes.Equal(header[257:262], []byte("ustar"))
+}
+
+func (tarCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func (tarCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -39,16 +39,19 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	// "io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/satori/go.uuid"
 
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
 	"github.com/MorpheoOrg/morpheo-go-packages/client"
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
 )
@@ -79,15 +82,61 @@ type Worker struct {
 	// Morpheo API clients
 	storage client.Storage
 	peer    client.Peer
-}
 
-// Perfuplet describes the performance.json file, an output of learning tasks
-type Perfuplet struct {
-	Perf      float64            `json:"perf"`
-	TrainPerf map[string]float64 `json:"train_perf"`
-	TestPerf  map[string]float64 `json:"test_perf"`
+	// Retry policies per error class
+	retryPolicies     map[ErrorClass]RetryPolicy
+	retryPoliciesLock sync.Mutex
+
+	// Tasks running on this worker, and whether we're draining it (drained is closed once
+	// the last task is done), along with the outcomes of the last tasks it ran
+	inFlight     map[string]*runningTask
+	inFlightLock sync.Mutex
+	draining     bool
+	drained      chan struct{}
+	history      *taskHistory
+
+	// Task timeouts (no timeout if zero) and the root context of all tasks, canceled on Stop()
+	learnTimeout    time.Duration
+	predictTimeout  time.Duration
+	evaluateTimeout time.Duration
+	ctx             context.Context
+	cancel          context.CancelFunc
+	lifecycleOnce   sync.Once
+
+	// Maximum number of datasets pulled in parallel for a task
+	downloadParallelism int
+
+	// Local cache of the blobs pulled from storage (optional)
+	cache *BlobCache
+
+	// Images shared across tasks (optional)
+	images *ImageRegistry
+
+	// Whether blobs without a checksum in their storage metadata fail the task
+	requireChecksums bool
+
+	// Limits of the archives we unpack (DefaultArchiveLimits if zero) and codec of the archives we
+	// create (gzip if nil)
+	archiveLimits ArchiveLimits
+	archiveCodec  Codec
+
+	// Size limit of the output kept for each workflow step (needs a LogRuntime), folder where task
+	// logs are kept when storage can't store them (and its size limit) and whether the output of
+	// untrusted containers is kept, redacted, in them
+	stepLogsMaxSize     int64
+	logsFolder          string
+	logsFolderMaxSize   int64
+	logsFolderLock      sync.Mutex
+	redactUntrustedLogs bool
+
+	// Prometheus metrics (optional)
+	metrics *Metrics
 }
 
+// TaskStatusPerfFailed is the status of learnuplets whose model was trained and uploaded to
+// storage, but whose performance couldn't be computed: only the perf step needs to run again.
+const TaskStatusPerfFailed = "perf_failed"
+
 // NewWorker creates a Worker instance
 func NewWorker(dataFolder, trainFolder, testFolder, untargetedTestFolder, predFolder, perfFolder, modelFolder, problemImagePrefix, algoImagePrefix string, containerRuntime common.ContainerRuntime, storage client.Storage, peer client.Peer) *Worker {
 	return &Worker{
@@ -110,79 +159,254 @@ func NewWorker(dataFolder, trainFolder, testFolder, untargetedTestFolder, predFo
 	}
 }
 
-// HandleLearn manages a learning task (peer status updates, etc...)
-func (w *Worker) HandleLearn(message []byte) (err error) {
-	log.Println("[DEBUG][learn] Starting learning task")
+// HandleLearn manages a learning task (peer status updates, etc...). attempts is the number of
+// times the broker has delivered it.
+func (w *Worker) HandleLearn(message []byte, attempts int) (err error) {
+	const kind = "learn"
+	envelope := logging.Unwrap(message)
+	logger := w.taskLogger(kind, envelope)
+	logger.Debugf("Starting learning task")
+
+	traceCtx, span := w.startTaskSpan(kind, envelope)
+	defer func() { tracing.End(span, err) }()
 
-	// Unmarshal the learn-uplet
+	// Unmarshal the learn-uplet (no retry would ever fix a malformed task: we just drop it)
 	var task common.Learnuplet
-	err = json.NewDecoder(bytes.NewReader(message)).Decode(&task)
+	err = json.NewDecoder(bytes.NewReader(envelope.Task)).Decode(&task)
 	if err != nil {
-		return fmt.Errorf("Error un-marshaling learn-uplet: %s -- Body: %s", err, message)
+		logger.Errorf("Dropping task. Error un-marshaling learn-uplet: %s -- Body: %s", err, envelope.Task)
+		return nil
 	}
+	logger = logger.With(logging.FieldTask, task.Key)
+	span.SetAttributes(tracing.AttributeTask.String(task.Key))
+	ctx := logging.WithLogger(traceCtx, logger)
 
 	if err = task.Check(); err != nil {
-		return fmt.Errorf("Error in train task: %s -- Body: %s", err, message)
+		logger.Errorf("Dropping task. Error in train task: %s -- Body: %s", err, envelope.Task)
+		return nil
+	}
+
+	// Let's make sure this isn't a duplicate delivery of a task that's running or done already
+	running, err := w.startTask(kind, task.Key, envelope.MessageID)
+	if err == errTaskRunning {
+		logger.Infof("Skipping %s: %s", task.Key, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Not starting %s: %s", task.Key, err)
+	}
+	defer func() { w.endTask(running, err) }()
+
+	if duplicate, reason := w.duplicateLearn(ctx, task); duplicate {
+		logger.Infof("Skipping %s: %s", task.Key, reason)
+		return nil
+	}
+
+	w.metrics.taskStarted(kind)
+
+	// The output of the task's containers is saved once it's done, whatever its outcome, and
+	// referenced in its failure report
+	logs := w.newTaskLogs(task.Key)
+	reportFailure := func() error {
+		w.saveAndReportLogs(ctx, task.Key, logs)
+		return traceCall(ctx, "peer.ReportLearn", func() error {
+			var m map[string]float64
+			var f float64
+			_, _, err := w.peer.ReportLearn(task.Key, common.TaskStatusFailed, f, m, m)
+			return err
+		}, tracing.AttributeTask.String(task.Key))
 	}
 
 	// Update its status to pending on the peer
-	_, _, err = w.peer.SetUpletWorker(task.Key, w.ID.String())
+	err = traceCall(ctx, "peer.SetUpletWorker", func() error {
+		_, _, err := w.peer.SetUpletWorker(task.Key, w.ID.String())
+		return err
+	}, tracing.AttributeTask.String(task.Key))
 	if err != nil {
-		return fmt.Errorf("Error setting uplet worker: %s", err)
+		err = NewTaskError(ErrorClassPeer, "Error setting uplet worker: %s", err)
+		w.taskEnded(running, err)
+		return w.handleTaskError(ctx, task.Key, attempts, err, reportFailure)
 	}
 
-	err = w.LearnWorkflow(task)
+	taskCtx, cancel := w.taskContext(running, w.learnTimeout)
+	defer cancel()
+
+	workflow := w.LearnWorkflow
+	if w.modelPosted(ctx, task) {
+		logger.Infof("Model %s already exists in storage, only computing the performance of %s", task.ModelEnd, task.Key)
+		workflow = w.ResumeLearnWorkflow
+	}
+	err = workflow(WithTaskLogs(logging.WithLogger(tracing.ContextWithSpan(taskCtx, ctx), logger), logs), task)
+	w.taskEnded(running, err)
 	if err != nil {
-		// TODO: handle fatal and non-fatal errors differently and set learnuplet status to failed only
-		// if the error was fatal
-		var m map[string]float64
-		var f float64
-		_, _, err2 := w.peer.ReportLearn(task.Key, common.TaskStatusFailed, f, m, m)
-		if err2 != nil {
-			return fmt.Errorf("Error in LearnWorkflow: %s. Error setting learnuplet status to failed on the peer: %s", err, err2)
-		}
-		return fmt.Errorf("Error in LearnWorkflow: %s", err)
+		return w.handleTaskError(ctx, task.Key, attempts, err, reportFailure)
+	}
+	w.saveLogs(logs)
+	logger.Infof("Learning task done")
+	return nil
+}
+
+// HandlePred manages a prediction task (peer status updates, etc...). attempts is the number of
+// times the broker has delivered it.
+func (w *Worker) HandlePred(message []byte, attempts int) (err error) {
+	const kind = "predict"
+	envelope := logging.Unwrap(message)
+	logger := w.taskLogger(kind, envelope)
+	logger.Debugf("Starting predicting task")
+
+	traceCtx, span := w.startTaskSpan(kind, envelope)
+	defer func() { tracing.End(span, err) }()
+
+	// Unmarshal the pred-uplet (no retry would ever fix a malformed task: we just drop it)
+	var task common.Preduplet
+	err = json.NewDecoder(bytes.NewReader(envelope.Task)).Decode(&task)
+	if err != nil {
+		logger.Errorf("Dropping task. Error un-marshaling preduplet: %s -- Body: %s", err, envelope.Task)
+		return nil
+	}
+	logger = logger.With(logging.FieldTask, task.Key)
+	span.SetAttributes(tracing.AttributeTask.String(task.Key))
+	ctx := logging.WithLogger(traceCtx, logger)
+
+	if err = task.Check(); err != nil {
+		logger.Errorf("Dropping task. Error in pred task: %s -- Body: %s", err, envelope.Task)
+		return nil
+	}
+
+	running, err := w.startTask(kind, task.Key, envelope.MessageID)
+	if err == errTaskRunning {
+		logger.Infof("Skipping %s: %s", task.Key, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Not starting %s: %s", task.Key, err)
+	}
+	defer func() { w.endTask(running, err) }()
+
+	w.metrics.taskStarted(kind)
+
+	// The output of the task's containers is saved once it's done, whatever its outcome, and
+	// referenced in its failure report
+	logs := w.newTaskLogs(task.Key)
+	reportFailure := func() error {
+		w.saveAndReportLogs(ctx, task.Key, logs)
+		return w.reportPred(ctx, task.Key, common.TaskStatusFailed, uuid.Nil)
+	}
+
+	// Update its status to pending on the peer
+	err = traceCall(ctx, "peer.SetUpletWorker", func() error {
+		_, _, err := w.peer.SetUpletWorker(task.Key, w.ID.String())
+		return err
+	}, tracing.AttributeTask.String(task.Key))
+	if err != nil {
+		err = NewTaskError(ErrorClassPeer, "Error setting uplet worker: %s", err)
+		w.taskEnded(running, err)
+		return w.handleTaskError(ctx, task.Key, attempts, err, reportFailure)
+	}
+
+	taskCtx, cancel := w.taskContext(running, w.predictTimeout)
+	defer cancel()
+
+	err = w.PredWorkflow(WithTaskLogs(logging.WithLogger(tracing.ContextWithSpan(taskCtx, ctx), logger), logs), task)
+	w.taskEnded(running, err)
+	if err != nil {
+		return w.handleTaskError(ctx, task.Key, attempts, err, reportFailure)
 	}
+	w.saveLogs(logs)
+	logger.Infof("Predicting task done")
 	return nil
 }
 
-// HandlePred manages a prediction task (peer status updates, etc...)
-func (w *Worker) HandlePred(message []byte) (err error) {
-	// log.Println("[DEBUG][pred] Starting predicting task")
-
-	// // Unmarshal the learn-uplet
-	// var task common.Preduplet
-	// err = json.NewDecoder(bytes.NewReader(message)).Decode(&task)
-	// if err != nil {
-	// 	return fmt.Errorf("Error un-marshaling preduplet: %s -- Body: %s", err, message)
-	// }
-
-	// if err = task.Check(); err != nil {
-	// 	return fmt.Errorf("Error in pred task: %s -- Body: %s", err, message)
-	// }
-
-	// // Update its status to pending on the peer
-	// err = w.peer.UpdateUpletStatus(common.TypePredUplet, common.TaskStatusPending, task.Key, task.Worker)
-	// if err != nil {
-	// 	return fmt.Errorf("Error setting preduplet status to pending on the peer: %s", err)
-	// }
-
-	// err = w.PredWorkflow(task)
-	// if err != nil {
-	// 	// TODO: handle fatal and non-fatal errors differently and set preduplet status to failed only
-	// 	// if the error was fatal
-	// 	err2 := w.peer.UpdateUpletStatus(common.TypePredUplet, common.TaskStatusFailed, task.Key, task.Worker)
-	// 	if err2 != nil {
-	// 		return fmt.Errorf("2 Errors: Error in PredWorkflow: %s. Error setting preduplet status to failed on the peer: %s", err, err2)
-	// 	}
-	// 	return fmt.Errorf("Error in PredWorkflow: %s", err)
-	// }
+// handleTaskError applies the retry policy matching the class of a workflow error. As long as the
+// task has attempts left, its status is set back to todo on the peer and a *RequeueError is
+// returned so that the consumer hands the task back to the broker, to be delivered again (to any
+// worker) after the policy's backoff. Otherwise, reportFailure is called to mark the task as
+// failed on the peer and the task is acknowledged.
+//
+// Attempts are counted by the broker: attempt is the number of times the task was delivered.
+func (w *Worker) handleTaskError(ctx context.Context, key string, attempt int, err error, reportFailure func() error) error {
+	return w.retryTask(ctx, key, attempt, err, func() error { return w.resetUplet(ctx, key) }, reportFailure)
+}
+
+// retryTask works like handleTaskError for tasks whose status may not be on the peer: reset is
+// called instead of resetUplet before the task is requeued (if it isn't nil).
+func (w *Worker) retryTask(ctx context.Context, key string, attempt int, err error, reset, reportFailure func() error) error {
+	logger := logging.FromContext(ctx)
+
+	// Tasks interrupted because the worker is stopping aren't to blame: they're simply requeued
+	if w.stopped() {
+		if reset != nil {
+			if err := reset(); err != nil {
+				logger.Errorf("Error setting %s status back to todo on the peer: %s", key, err)
+			}
+		}
+		return &RequeueError{Err: fmt.Errorf("Worker stopped while running %s: %s", key, err)}
+	}
+
+	// Tasks canceled by an operator aren't retried
+	if w.taskCanceled(key) {
+		if err2 := reportFailure(); err2 != nil {
+			return fmt.Errorf("%s canceled: %s. Error setting uplet status to failed on the peer: %s", key, err, err2)
+		}
+		logger.With(logging.FieldError, err).Warningf("%s marked as failed after being canceled: %s", key, err)
+		return nil
+	}
+
+	class := ErrorClassOf(err)
+	policy := w.retryPolicy(class)
+
+	if policy.Retryable(attempt) {
+		// Any worker should be able to pick the task up again
+		if reset != nil {
+			if err := reset(); err != nil {
+				logger.Errorf("Error setting %s status back to todo on the peer: %s", key, err)
+			}
+		}
+
+		delay := policy.Delay(attempt)
+		logger.With(logging.FieldError, err).Infof("Requeuing %s in %s after a %s error (attempt %d/%d): %s", key, delay, class, attempt, policy.MaxAttempts, err)
+		return &RequeueError{
+			Delay: delay,
+			Err:   fmt.Errorf("Retryable %s error on %s: %s", class, key, err),
+		}
+	}
+
+	if err2 := reportFailure(); err2 != nil {
+		return fmt.Errorf("Fatal %s error on %s: %s. Error setting uplet status to failed on the peer: %s", class, key, err, err2)
+	}
+	logger.With(logging.FieldError, err).Errorf("%s marked as failed after a %s error (attempt %d/%d): %s", key, class, attempt, policy.MaxAttempts, err)
 	return nil
 }
 
+// retryPolicy returns the retry policy for a given error class. Classes without a policy are
+// never retried.
+func (w *Worker) retryPolicy(class ErrorClass) RetryPolicy {
+	policies := w.retryPolicies
+	if policies == nil {
+		policies = DefaultRetryPolicies
+	}
+	if policy, ok := policies[class]; ok {
+		return policy
+	}
+	return RetryPolicy{MaxAttempts: 1}
+}
+
+// SetRetryPolicy overrides the retry policy used for a given error class
+func (w *Worker) SetRetryPolicy(class ErrorClass, policy RetryPolicy) {
+	w.retryPoliciesLock.Lock()
+	defer w.retryPoliciesLock.Unlock()
+
+	if w.retryPolicies == nil {
+		w.retryPolicies = make(map[ErrorClass]RetryPolicy)
+		for c, p := range DefaultRetryPolicies {
+			w.retryPolicies[c] = p
+		}
+	}
+	w.retryPolicies[class] = policy
+}
+
 // LearnWorkflow implements our learning workflow
-func (w *Worker) LearnWorkflow(task common.Learnuplet) (err error) {
-	log.Printf("[DEBUG][learn] Starting learning workflow for %s", task.Key)
+func (w *Worker) LearnWorkflow(ctx context.Context, task common.Learnuplet) (err error) {
+	logger := logging.FromContext(ctx)
+	logger.Debugf("Starting learning workflow for %s", task.Key)
 
 	// Setup directory structure
 	taskDataFolder := filepath.Join(w.dataFolder, task.Algo.String())
@@ -196,7 +420,7 @@ func (w *Worker) LearnWorkflow(task common.Learnuplet) (err error) {
 	for _, path := range pathList {
 		err = os.MkdirAll(path, os.ModeDir)
 		if err != nil {
-			return fmt.Errorf("Error creating folder under %s: %s", path, err)
+			return NewTaskError(ErrorClassRuntime, "Error creating folder under %s: %s", path, err)
 		}
 	}
 
@@ -204,405 +428,349 @@ func (w *Worker) LearnWorkflow(task common.Learnuplet) (err error) {
 	defer os.RemoveAll(taskDataFolder)
 
 	// Load problem workflow
-	problemWorkflow, err := w.storage.GetProblemWorkflowBlob(task.Problem)
+	problemWorkflow, err := w.openBlob(ctx, problemBlob, task.Problem)
 	if err != nil {
-		return fmt.Errorf("Error pulling problem workflow %s from storage: %s", task.Problem, err)
+		return wrapTaskError(err, ErrorClassStorage, "Error pulling problem workflow %s from storage: %s", task.Problem, err)
 	}
 	problemImageName := fmt.Sprintf("%s-%s", w.problemImagePrefix, task.Problem)
-	err = w.ImageLoad(problemImageName, problemWorkflow)
+	problemImageName, releaseProblemImage, err := w.loadImage(ctx, problemImageName, problemWorkflow)
 	if err != nil {
-		return fmt.Errorf("Error loading problem workflow image %s in Docker daemon: %s", task.Problem, err)
+		return wrapTaskError(err, ErrorClassRuntime, "Error loading problem workflow image %s in Docker daemon: %s", task.Problem, err)
 	}
 	problemWorkflow.Close()
-	defer w.containerRuntime.ImageUnload(problemImageName)
+	defer releaseProblemImage()
 
-	log.Println("[DEBUG][learn] 1st Image loaded")
+	logger.Debugf("1st Image loaded")
 	// Load algo
-	algo, err := w.storage.GetAlgoBlob(task.Algo)
+	algo, err := w.openBlob(ctx, algoBlob, task.Algo)
 	if err != nil {
-		return fmt.Errorf("Error pulling algo %s from storage: %s", task.Algo, err)
+		return wrapTaskError(err, ErrorClassStorage, "Error pulling algo %s from storage: %s", task.Algo, err)
 	}
 
 	algoImageName := fmt.Sprintf("%s-%s", w.algoImagePrefix, task.Algo)
-	err = w.ImageLoad(algoImageName, algo)
+	algoImageName, releaseAlgoImage, err := w.loadImage(ctx, algoImageName, algo)
 	if err != nil {
-		return fmt.Errorf("Error loading algo image %s in Docker daemon: %s", algoImageName, err)
+		return wrapTaskError(err, ErrorClassSubmission, "Error loading algo image %s in Docker daemon: %s", algoImageName, err)
 	}
 	algo.Close()
-	defer w.containerRuntime.ImageUnload(algoImageName)
+	defer releaseAlgoImage()
 
 	// Pull model if a model_start parameter was given in the learn-uplet
 	if task.Rank > 0 {
 		// Check that modelStart is set
 		if uuid.Equal(uuid.Nil, task.ModelStart) {
-			return fmt.Errorf("Error in learnuplet: ModelStart is a Nil uuid, although Rank is set to %d", task.Rank)
+			return NewTaskError(ErrorClassTask, "Error in learnuplet: ModelStart is a Nil uuid, although Rank is set to %d", task.Rank)
 		}
 		// Pull model from storage
-		model, err := w.storage.GetModelBlob(task.ModelStart)
+		model, err := w.openBlob(ctx, modelBlob, task.ModelStart)
 		if err != nil {
-			return fmt.Errorf("Error pulling start model %s from storage: %s", task.ModelStart, err)
+			return wrapTaskError(err, ErrorClassStorage, "Error pulling start model %s from storage: %s", task.ModelStart, err)
+		}
+		err = w.UnarchiveInFolder(modelFolder, model)
+		if verifyErr := model.Verify(); verifyErr != nil {
+			return verifyErr
 		}
-		err = w.UntargzInFolder(modelFolder, model)
 		if err != nil {
-			return fmt.Errorf("Error un-tar-gz-ing model: %s", err)
+			return NewTaskError(ErrorClassSubmission, "Error unarchiving model: %s", err)
 		}
 		model.Close()
 	}
 
-	// Pulling train dataset
+	// Pulling train and test datasets
+	datasets := make([]dataset, 0, len(task.TrainData)+len(task.TestData))
 	for _, dataID := range task.TrainData {
-		data, err := w.storage.GetDataBlob(dataID)
-		if err != nil {
-			return fmt.Errorf("Error pulling train dataset %s from storage: %s", dataID, err)
-		}
-		path := fmt.Sprintf("%s/%s", trainFolder, dataID)
-		dataFile, err := os.Create(path)
-		if err != nil {
-			return fmt.Errorf("Error creating file %s: %s", path, err)
-		}
-		n, err := io.Copy(dataFile, data)
-		if err != nil {
-			return fmt.Errorf("Error copying train data file %s (%d bytes written): %s", path, n, err)
-		}
-		dataFile.Close()
-		data.Close()
+		datasets = append(datasets, dataset{kind: "train", id: dataID, folder: trainFolder})
 	}
-
-	// And the test data
 	for _, dataID := range task.TestData {
-		data, err := w.storage.GetDataBlob(dataID)
-		if err != nil {
-			return fmt.Errorf("Error pulling test dataset %s from storage: %s", dataID, err)
-		}
-		path := fmt.Sprintf("%s/%s", testFolder, dataID)
-		dataFile, err := os.Create(path)
-		n, err := io.Copy(dataFile, data)
-		if err != nil {
-			return fmt.Errorf("Error copying test data file %s (%d bytes written): %s", path, n, err)
-		}
-		dataFile.Close()
-		data.Close()
+		datasets = append(datasets, dataset{kind: "test", id: dataID, folder: testFolder})
+	}
+	if err = w.pullDatasets(ctx, datasets); err != nil {
+		return err
 	}
 
+	// The algo container mustn't leak the datasets through its logs
+	w.redactLogs(ctx, trainFolder, testFolder)
+
 	// Let's copy test data into untargetedTestFolder and remove targets
-	_, err = w.UntargetTestingVolume(problemImageName, testFolder, untargetedTestFolder)
+	_, err = w.UntargetTestingVolume(ctx, problemImageName, testFolder, untargetedTestFolder)
 	if err != nil {
-		return fmt.Errorf("Error preparing problem %s for model %s: %s", task.Problem, task.ModelStart, err)
+		return NewTaskError(ErrorClassRuntime, "Error preparing problem %s for model %s: %s", task.Problem, task.ModelStart, err)
 	}
 
 	// Let's pass the task to our execution backend, now that everything should be in place
-	_, err = w.Train(algoImageName, trainFolder, untargetedTestFolder, modelFolder)
+	_, err = w.Train(ctx, algoImageName, trainFolder, untargetedTestFolder, modelFolder)
 	if err != nil {
-		return fmt.Errorf("Error in train task: %s -- Body: %s", err, task)
+		return NewTaskError(ErrorClassSubmission, "Error in train task %s: %s", task.Key, err)
 	}
 
-	// Let's compute the performance !
-	_, err = w.ComputePerf(problemImageName, trainFolder, testFolder, untargetedTestFolder, perfFolder)
-	if err != nil {
-		// FIXME: do not return here
-		return fmt.Errorf("Error computing perf for problem %s and model (new) %s: %s", task.Problem, task.ModelEnd, err)
+	// Let's compute the performance ! If the problem workflow fails, the model we trained is
+	// uploaded anyway and the task logs are saved, so that only the perf step has to run again.
+	// Interrupted tasks are simply failed though.
+	_, perfErr := w.ComputePerf(ctx, problemImageName, trainFolder, testFolder, untargetedTestFolder, perfFolder)
+	if perfErr != nil && ctx.Err() != nil {
+		return NewTaskError(ErrorClassRuntime, "Error computing perf for problem %s and model (new) %s: %s", task.Problem, task.ModelEnd, perfErr)
+	}
+	if perfErr != nil {
+		logger.Warningf("Error computing perf for problem %s and model (new) %s, uploading the model anyway: %s", task.Problem, task.ModelEnd, perfErr)
 	}
 
 	// Let's create a new model and post it to storage
-	algoInfo, err := w.storage.GetAlgo(task.Algo)
+	var algoInfo *common.Algo
+	err = traceCall(ctx, "storage.GetAlgo", func() (err error) {
+		algoInfo, err = w.storage.GetAlgo(task.Algo)
+		return err
+	}, tracing.AttributeTask.String(task.Key))
 	if err != nil {
-		return fmt.Errorf("Error retrieving algorithm %s metadata: %s", task.Algo, err)
+		return NewTaskError(ErrorClassStorage, "Error retrieving algorithm %s metadata: %s", task.Algo, err)
 	}
 	newModel := common.NewModel(task.ModelEnd, algoInfo)
 	newModel.ID = task.ModelEnd
 
-	// Let's compress our model in a separate goroutine while writing it on disk on the fly
-	path := fmt.Sprintf("%s/model.tar.gz", taskDataFolder)
-	modelArchiveWriter, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("Error creating new model archive file %s: %s", path, err)
+	// Let's compress our model and stream it to storage on the fly
+	if err := w.postModel(ctx, newModel, modelFolder); err != nil {
+		return err
 	}
-	err = w.TargzFolder(modelFolder, modelArchiveWriter)
-	if err != nil {
-		return fmt.Errorf("Error tar-gzipping new model %s: %s", task.ModelEnd, err)
+
+	if err = w.reportLearn(ctx, task, perfFolder, perfErr); err != nil {
+		return err
+	}
+	if perfErr != nil {
+		logger.Infof("Train finished but perf failed, model %s uploaded, cleaning up...", task.ModelEnd)
+		return nil
 	}
-	modelArchiveWriter.Close()
+	logger.Infof("Train finished with success, cleaning up...")
+
+	return
+}
+
+// ResumeLearnWorkflow completes a learnuplet whose model has already been trained and posted to
+// storage: the model predicts the targets of its train and test data, as the train step would
+// have, and its performance is computed and reported to the peer.
+func (w *Worker) ResumeLearnWorkflow(ctx context.Context, task common.Learnuplet) (err error) {
+	logger := logging.FromContext(ctx)
+	logger.Debugf("Starting resumed learning workflow for %s (model %s)", task.Key, task.ModelEnd)
+
+	taskDataFolder := filepath.Join(w.dataFolder, task.Algo.String())
+	defer os.RemoveAll(taskDataFolder)
 
-	modelArchiveReader, err := os.Open(path)
+	perfErr, err := w.evaluateModel(ctx, task.Key, taskDataFolder, task.Problem, task.ModelEnd, task.TrainData, task.TestData)
 	if err != nil {
-		return fmt.Errorf("Error reading new model archive file %s: %s", path, err)
+		return err
 	}
-	modelArchiveStat, err := modelArchiveReader.Stat()
-	if err != nil {
-		return fmt.Errorf("Error reading new model archive size %s: %s", path, err)
+	if perfErr != nil && ctx.Err() != nil {
+		return NewTaskError(ErrorClassRuntime, "Error computing perf for problem %s and model %s: %s", task.Problem, task.ModelEnd, perfErr)
 	}
+	if perfErr != nil {
+		logger.Warningf("Error computing perf for problem %s and model %s: %s", task.Problem, task.ModelEnd, perfErr)
+	}
+	if err = w.reportLearn(ctx, task, filepath.Join(taskDataFolder, w.perfFolder), perfErr); err != nil {
+		return err
+	}
+	if perfErr != nil {
+		logger.Infof("Perf of model %s failed again, cleaning up...", task.ModelEnd)
+		return nil
+	}
+	logger.Infof("Perf of model %s computed with success, cleaning up...", task.ModelEnd)
+	return nil
+}
 
-	if err := w.storage.PostModel(newModel, modelArchiveReader, modelArchiveStat.Size()); err != nil {
-		return fmt.Errorf("Error streaming new model %s to storage: %s", task.ModelEnd, err)
+// reportLearn reports the result of a learnuplet whose model has been posted to storage: it's
+// perf_failed if the perf step failed (perfErr), and done with the performance file found in
+// perfFolder otherwise.
+func (w *Worker) reportLearn(ctx context.Context, task common.Learnuplet, perfFolder string, perfErr error) error {
+	if perfErr != nil {
+		w.saveAndReportLogs(ctx, task.Key, taskLogsFrom(ctx))
+		err := traceCall(ctx, "peer.ReportLearn", func() error {
+			_, _, err := w.peer.ReportLearn(task.Key, TaskStatusPerfFailed, 0, nil, nil)
+			return err
+		}, tracing.AttributeTask.String(task.Key))
+		if err != nil {
+			return NewTaskError(ErrorClassPeer, "Error posting learn result %s to peer: %s", task.ModelEnd, err)
+		}
+		return nil
 	}
-	modelArchiveReader.Close()
 
 	// Let's send the perf file to the peer
-	performanceFilePath := fmt.Sprintf("%s/performance.json", perfFolder)
-	resultFile, err := os.Open(performanceFilePath)
+	perfuplet, err := w.readPerfuplet(ctx, perfFolder, task.Problem)
 	if err != nil {
-		return fmt.Errorf("Error reading performance file %s: %s", performanceFilePath, err)
+		return err
 	}
-	perfuplet := Perfuplet{}
-	err = json.NewDecoder(resultFile).Decode(&perfuplet)
+	err = traceCall(ctx, "peer.ReportLearn", func() error {
+		_, _, err := w.peer.ReportLearn(task.Key, common.TaskStatusDone, perfuplet.Perf, perfuplet.TrainPerf, perfuplet.TestPerf)
+		return err
+	}, tracing.AttributeTask.String(task.Key))
 	if err != nil {
-		return fmt.Errorf("Error un-marshaling performance file to JSON: %s", err)
-	}
-	if _, _, err := w.peer.ReportLearn(task.Key, common.TaskStatusDone, perfuplet.Perf, perfuplet.TrainPerf, perfuplet.TestPerf); err != nil {
-		return fmt.Errorf("Error posting learn result %s to peer: %s", task.ModelEnd, err)
+		return NewTaskError(ErrorClassPeer, "Error posting learn result %s to peer: %s", task.ModelEnd, err)
 	}
+	return nil
+}
 
-	resultFile.Close()
-	os.Remove(performanceFilePath)
+// PredWorkflow handles our prediction tasks
+func (w *Worker) PredWorkflow(ctx context.Context, task common.Preduplet) (err error) {
+	logger := logging.FromContext(ctx)
+	logger.Debugf("Starting predicting workflow for %s", task.Key)
 
-	log.Printf("[INFO][learn] Train finished with success, cleaning up...")
+	// Setup directory structure
+	taskDataFolder := filepath.Join(w.dataFolder, task.Model.String())
+	testFolder := filepath.Join(taskDataFolder, w.testFolder)
+	modelFolder := filepath.Join(taskDataFolder, w.modelFolder)
+	predFolder := filepath.Join(testFolder, w.predFolder)
 
-	return
-}
+	pathList := []string{taskDataFolder, testFolder, modelFolder, predFolder}
+	for _, path := range pathList {
+		err = os.MkdirAll(path, os.ModeDir)
+		if err != nil {
+			return NewTaskError(ErrorClassRuntime, "Error creating folder under %s: %s", path, err)
+		}
+	}
 
-// // PredWorkflow handles our prediction tasks
-// func (w *Worker) PredWorkflow(task common.Preduplet) (err error) {
-// 	log.Println("[DEBUG][pred] Starting predicting workflow")
-
-// 	// Setup directory structure
-// 	taskDataFolder := filepath.Join(w.dataFolder, task.Model.String())
-// 	testFolder := filepath.Join(taskDataFolder, w.testFolder)
-// 	modelFolder := filepath.Join(taskDataFolder, w.modelFolder)
-// 	predFolder := filepath.Join(testFolder, w.predFolder)
-
-// 	err = os.MkdirAll(testFolder, os.ModeDir)
-// 	if err != nil {
-// 		return fmt.Errorf("Error creating test folder under %s: %s", testFolder, err)
-// 	}
-// 	err = os.MkdirAll(modelFolder, os.ModeDir)
-// 	if err != nil {
-// 		return fmt.Errorf("Error creating model folder under %s: %s", modelFolder, err)
-// 	}
-// 	err = os.MkdirAll(predFolder, os.ModeDir)
-// 	if err != nil {
-// 		return fmt.Errorf("Error creating pred folder under %s: %s", predFolder, err)
-// 	}
-
-// 	// Pulling data from storage to testFolder
-// 	data, err := w.storage.GetDataBlob(task.Data)
-// 	if err != nil {
-// 		return fmt.Errorf("Error pulling data %s from storage: %s", task.Data, err)
-// 	}
-// 	path := fmt.Sprintf("%s/%s", testFolder, task.Data)
-// 	dataFile, err := os.Create(path)
-// 	if err != nil {
-// 		return fmt.Errorf("Error creating file %s: %s", path, err)
-// 	}
-// 	n, err := io.Copy(dataFile, data)
-// 	if err != nil {
-// 		return fmt.Errorf("Error copying data file %s (%d bytes written): %s", path, n, err)
-// 	}
-// 	dataFile.Close()
-// 	data.Close()
-
-// 	// Pull model from storage and store it in modelFolder
-// 	model, err := w.storage.GetModelBlob(task.Model)
-// 	if err != nil {
-// 		return fmt.Errorf("Error pulling model %s from storage: %s", task.Model, err)
-// 	}
-
-// 	err = w.UntargzInFolder(modelFolder, model)
-// 	if err != nil {
-// 		return fmt.Errorf("Error un-tar-gz-ing model: %s", err)
-// 	}
-// 	model.Close()
-
-// 	// Rename model
-// 	files, err := ioutil.ReadDir(modelFolder)
-// 	if err != nil {
-// 		return fmt.Errorf("Error reading modelFolder: %s", err)
-// 	}
-// 	if len(files) != 1 {
-// 		return fmt.Errorf("Error: several files in modelFolder")
-// 	}
-// 	for _, f := range files {
-// 		oldpath := filepath.Join(modelFolder, f.Name())
-// 		newpath := filepath.Join(modelFolder, "model_trained.json")
-// 		if err = os.Rename(oldpath, newpath); err != nil {
-// 			return fmt.Errorf("Error renaming model: %s", err)
-// 		}
-// 	}
-
-// 	// Pull associated algo and load it into a container
-// 	modelInfo, err := w.storage.GetModel(task.Model)
-// 	if err != nil {
-// 		return fmt.Errorf("Error retrieving model %s metadata: %s", task.Model, err)
-// 	}
-// 	algo, err := w.storage.GetAlgoBlob(modelInfo.Algo)
-// 	if err != nil {
-// 		return fmt.Errorf("Error pulling algo %s from storage: %s", modelInfo.Algo, err)
-// 	}
-// 	algoImageName := fmt.Sprintf("%s-%s", w.algoImagePrefix, modelInfo.Algo)
-// 	err = w.ImageLoad(algoImageName, algo)
-// 	if err != nil {
-// 		return fmt.Errorf("Error loading algo image %s in Docker daemon: %s", algoImageName, err)
-// 	}
-// 	algo.Close()
-// 	defer w.containerRuntime.ImageUnload(algoImageName)
-
-// 	// Let's pass the prediction task to our execution backend, now that everything should be in place
-// 	_, err = w.Predict(algoImageName, testFolder, predFolder, modelFolder)
-// 	if err != nil {
-// 		return fmt.Errorf("Error in pred task: %s -- Body: %s", err, task)
-// 	}
-
-// 	// Let's send the prediction to Storage and address & status to Peer
-// 	// Check if prediction file exists
-// 	path = filepath.Join(predFolder, task.Data.String())
-// 	if _, err := os.Stat(path); os.IsNotExist(err) {
-// 		return fmt.Errorf("Error: missing prediction file for data %s", task.Data.String())
-// 	}
-
-// 	// Open file and retrieve size
-// 	file, err := os.Open(path)
-// 	if err != nil {
-// 		return fmt.Errorf("Error opening prediction file from path %s: %s", path, err)
-// 	}
-// 	defer file.Close()
-
-// 	stat, err := file.Stat()
-// 	if err != nil {
-// 		return fmt.Errorf("Error retrieving file stat: %s", err)
-// 	}
-// 	filesize := stat.Size()
-
-// 	// // Let's tar-gz the file
-// 	// var targzFile bytes.Buffer
-// 	// err = TargzFile(file, &targzFile)
-// 	// if err != nil {
-// 	// 	log.Println("Error compressing prediction file from path %s: %s", path, err)
-// 	// 	continue
-// 	// }
-
-// 	// Send the prediction to storage
-// 	log.Println("[DEBUG][pred] sending the predictions to Storage...")
-// 	newPrediction := common.NewPrediction()
-// 	err = w.storage.PostPrediction(newPrediction, file, filesize)
-// 	if err != nil {
-// 		return fmt.Errorf("Error streaming new prediction %s to storage: %s", newPrediction.ID, err)
-// 	}
-
-// 	// Send status and prediction address to Peer
-// 	log.Println("[DEBUG][pred] sending the status and prediction UUID to Peer...")
-// 	err = w.peer.PostPredResult(task.Key, common.TaskStatusDone, newPrediction.ID)
-// 	if err != nil {
-// 		return fmt.Errorf("Error setting preduplet status to 'done' on the peer: %s", err)
-// 	}
-
-// 	log.Printf("[INFO][pred] Prediction finished with success, cleaning up...")
-// 	return nil
-// }
+	// Let's make sure these folders are wiped out once the task is done/failed
+	defer os.RemoveAll(taskDataFolder)
 
-// ImageLoad loads the docker image corresponding to a problem workflow/submission container in the
-// container runtime that will then run this problem workflow/submission container
-func (w *Worker) ImageLoad(imageName string, imageReader io.Reader) error {
-	imageTarReader, err := gzip.NewReader(imageReader)
+	// Pulling data from storage to testFolder
+	data, err := w.openBlob(ctx, dataBlob, task.Data)
 	if err != nil {
-		return fmt.Errorf("Error un-gzipping image %s: %s", imageName, err)
+		return wrapTaskError(err, ErrorClassStorage, "Error pulling data %s from storage: %s", task.Data, err)
 	}
-	defer imageTarReader.Close()
-
-	image, err := w.containerRuntime.ImageBuild(imageName, imageTarReader)
+	path := filepath.Join(testFolder, task.Data.String())
+	defer data.Close()
+	dataFile, err := os.Create(path)
 	if err != nil {
-		return fmt.Errorf("Error building image %s: %s", imageName, err)
+		return NewTaskError(ErrorClassRuntime, "Error creating file %s: %s", path, err)
+	}
+	defer dataFile.Close()
+	n, err := io.Copy(dataFile, data)
+	if err != nil {
+		return wrapTaskError(err, ErrorClassStorage, "Error copying data file %s (%d bytes written): %s", path, n, err)
 	}
-	defer image.Close()
 
-	log.Printf("[DEBUG][containerRuntime] Loading image %s...", imageName)
-	return w.containerRuntime.ImageLoad(imageName, image)
-}
+	// The algo container mustn't leak the data through its logs
+	w.redactLogs(ctx, testFolder)
+
+	// Pull model from storage and store it in modelFolder
+	model, err := w.openBlob(ctx, modelBlob, task.Model)
+	if err != nil {
+		return wrapTaskError(err, ErrorClassStorage, "Error pulling model %s from storage: %s", task.Model, err)
+	}
+	err = w.UnarchiveInFolder(modelFolder, model)
+	if verifyErr := model.Verify(); verifyErr != nil {
+		return verifyErr
+	}
+	if err != nil {
+		return NewTaskError(ErrorClassSubmission, "Error unarchiving model: %s", err)
+	}
+	model.Close()
 
-// UntargzInFolder unflattens a .tar.gz archive provided as an io.Reader into a given folder
-func (w *Worker) UntargzInFolder(folder string, tarGzReader io.Reader) error {
-	zipReader, err := gzip.NewReader(tarGzReader)
+	// Pull associated algo and load it into the container runtime
+	var modelInfo *common.Model
+	err = traceCall(ctx, "storage.GetModel", func() (err error) {
+		modelInfo, err = w.storage.GetModel(task.Model)
+		return err
+	}, tracing.AttributeTask.String(task.Key))
+	if err != nil {
+		return NewTaskError(ErrorClassStorage, "Error retrieving model %s metadata: %s", task.Model, err)
+	}
+	algo, err := w.openBlob(ctx, algoBlob, modelInfo.Algo)
+	if err != nil {
+		return wrapTaskError(err, ErrorClassStorage, "Error pulling algo %s from storage: %s", modelInfo.Algo, err)
+	}
+	algoImageName := fmt.Sprintf("%s-%s", w.algoImagePrefix, modelInfo.Algo)
+	algoImageName, releaseAlgoImage, err := w.loadImage(ctx, algoImageName, algo)
 	if err != nil {
-		return fmt.Errorf("Error un-gzipping model: %s", err)
+		return wrapTaskError(err, ErrorClassSubmission, "Error loading algo image %s in Docker daemon: %s", algoImageName, err)
 	}
-	defer zipReader.Close()
+	algo.Close()
+	defer releaseAlgoImage()
 
-	tarReader := tar.NewReader(zipReader)
+	// Let's pass the prediction task to our execution backend, now that everything should be in place
+	_, err = w.Predict(ctx, algoImageName, testFolder, predFolder, modelFolder)
+	if err != nil {
+		return NewTaskError(ErrorClassSubmission, "Error in pred task %s: %s", task.Key, err)
+	}
 
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return fmt.Errorf("Error reading model tar archive: %s", err)
-		}
+	// Let's send the prediction to storage and its address & status to the peer
+	path = filepath.Join(predFolder, task.Data.String())
+	predFile, err := os.Open(path)
+	if err != nil {
+		return NewTaskError(ErrorClassSubmission, "Error opening prediction file for data %s: %s", task.Data, err)
+	}
+	defer predFile.Close()
 
-		path := filepath.Join(folder, header.Name)
-		info := header.FileInfo()
-		if info.IsDir() {
-			if err := os.MkdirAll(path, info.Mode()); err != nil {
-				return fmt.Errorf("Error unflattening tar archive: error creating directory %s: %s", path, err)
-			}
-			continue
-		}
+	predStat, err := predFile.Stat()
+	if err != nil {
+		return NewTaskError(ErrorClassRuntime, "Error reading prediction file size %s: %s", path, err)
+	}
 
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
-		if err != nil {
-			return fmt.Errorf("Error unflattening tar archive: error creating file %s: %s", path, err)
-		}
-		defer file.Close()
+	newPrediction := common.NewPrediction()
+	err = traceCall(ctx, "storage.PostPrediction", func() error {
+		return w.storage.PostPrediction(newPrediction, w.metrics.countUpload(newContextReader(ctx, predFile)), predStat.Size())
+	}, tracing.AttributeTask.String(task.Key))
+	if err != nil {
+		return NewTaskError(ErrorClassStorage, "Error streaming new prediction %s to storage: %s", newPrediction.ID, err)
+	}
 
-		_, err = io.Copy(file, tarReader)
-		if err != nil {
-			return fmt.Errorf("Error unflattening tar archive: error writing to file %s: %s", path, err)
-		}
+	if err := w.reportPred(ctx, task.Key, common.TaskStatusDone, newPrediction.ID); err != nil {
+		return NewTaskError(ErrorClassPeer, "Error posting pred result %s to peer: %s", newPrediction.ID, err)
 	}
+
+	logger.With("prediction", newPrediction.ID.String()).Infof("Prediction finished with success, cleaning up...")
+
 	return nil
 }
 
-// TargzFolder tars and gzips a folder and forwards it to an io.Writer
-func (w *Worker) TargzFolder(folder string, dest io.Writer) error {
-	// Let's wire our writer together
-	zipWriter := gzip.NewWriter(dest)
-	defer zipWriter.Close()
-	tarWriter := tar.NewWriter(zipWriter)
-	defer tarWriter.Close()
-
-	// Let's walk the target folder recursively and add each file entry to the tar archive
-	return filepath.Walk(folder, func(path string, info os.FileInfo, walkerr error) error {
-		if walkerr != nil {
-			return fmt.Errorf("Error walking %s: %s", folder, walkerr)
-		}
+// resetUplet sets an uplet status back to todo on the peer, so that any worker can pick it up
+// again. The peer client has no dedicated method for it, so we invoke the chaincode directly.
+func (w *Worker) resetUplet(ctx context.Context, key string) error {
+	return traceCall(ctx, "peer.resetUplet", func() error {
+		_, _, err := w.peer.Invoke("resetUplet", []string{key})
+		return err
+	}, tracing.AttributeTask.String(key))
+}
 
-		if info.IsDir() {
-			return nil
-		}
+// reportPred sends a preduplet's status and prediction storage ID to the peer. The peer client
+// has no dedicated method for it, so we invoke the chaincode directly.
+func (w *Worker) reportPred(ctx context.Context, key, status string, predictionID uuid.UUID) error {
+	return traceCall(ctx, "peer.reportPred", func() error {
+		_, _, err := w.peer.Invoke("reportPred", []string{key, status, predictionID.String()})
+		return err
+	}, tracing.AttributeTask.String(key))
+}
 
-		filename, err := filepath.Rel(folder, path)
-		if err != nil {
-			return fmt.Errorf("Error removing %s component from path %s: %s", folder, path, err)
-		}
+// ImageLoad loads the docker image corresponding to a problem workflow/submission container in the
+// container runtime that will then run this problem workflow/submission container
+func (w *Worker) ImageLoad(ctx context.Context, imageName string, imageReader io.Reader) error {
+	imageTarReader, _, err := OpenArchive(imageReader)
+	if err != nil {
+		return fmt.Errorf("Error uncompressing image %s: %s", imageName, err)
+	}
+	defer imageTarReader.Close()
 
-		file, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("Error opening file from path %s: %s", path, err)
-		}
-		defer file.Close()
-		header := &tar.Header{
-			Name:    filename,
-			Size:    info.Size(),
-			Mode:    0664,
-			ModTime: info.ModTime(),
-		}
+	// The build is interrupted if ctx is done while the build context is being sent or the built
+	// image being read
+	image, err := w.containerRuntime.ImageBuild(imageName, newContextReader(ctx, imageTarReader))
+	if err != nil {
+		return fmt.Errorf("Error building image %s: %s", imageName, err)
+	}
+	builtImage := newContextReader(ctx, image)
+	defer builtImage.Close()
 
-		if err = tarWriter.WriteHeader(header); err != nil {
-			return fmt.Errorf("Error writing tar header for file %s: %s", path, err)
-		}
+	logging.FromContext(ctx).Debugf("Loading image %s...", imageName)
+	return w.containerRuntime.ImageLoad(imageName, builtImage)
+}
 
-		if _, err := io.Copy(tarWriter, file); err != nil {
-			return fmt.Errorf("Error writing file %s to tar archive: %s", path, err)
-		}
+// UnarchiveInFolder unflattens a tar archive (compressed in any of the supported formats) provided
+// as an io.Reader into a given folder. Entries escaping the folder, symlinks pointing outside of it,
+// hardlinks and special files are rejected, and the archive must fit in the worker's archive limits
+// (size, number of files and compression ratio).
+func (w *Worker) UnarchiveInFolder(folder string, archive io.Reader) error {
+	compressed := &countingReader{r: archive}
+	tarReader, _, err := OpenArchive(compressed)
+	if err != nil {
+		return fmt.Errorf("Error uncompressing model: %s", err)
+	}
+	defer tarReader.Close()
 
-		return nil
-	})
+	return w.untarInFolder(folder, tarReader, compressed)
 }
 
 // TargzFile tars and gzips a file and forwards it to an io.Writer
@@ -656,8 +824,10 @@ func (w *Worker) SetupDirectories(taskDataFolder string, filemode os.FileMode) e
 // UntargetTestingVolume copies test data from /<host-data-volume>/<model>/test to
 // /<host-data-volume>/<model>/untargeted_test and removes targets from files... using the problem
 // workflow container.
-func (w *Worker) UntargetTestingVolume(problemImage, testFolder, untargetedTestFolder string) (containerID string, err error) {
-	return w.containerRuntime.RunImageInUntrustedContainer(
+func (w *Worker) UntargetTestingVolume(ctx context.Context, problemImage, testFolder, untargetedTestFolder string) (containerID string, err error) {
+	return w.runStep(
+		ctx,
+		"detarget", false,
 		problemImage,
 		[]string{"-T", "detarget", "-i", "/hidden_data", "-s", "/submission_data"},
 		map[string]string{
@@ -667,8 +837,10 @@ func (w *Worker) UntargetTestingVolume(problemImage, testFolder, untargetedTestF
 }
 
 // Train launches the submission container's train routines
-func (w *Worker) Train(modelImage, trainFolder, testFolder, modelFolder string) (containerID string, err error) {
-	return w.containerRuntime.RunImageInUntrustedContainer(
+func (w *Worker) Train(ctx context.Context, modelImage, trainFolder, testFolder, modelFolder string) (containerID string, err error) {
+	return w.runStep(
+		ctx,
+		"train", true,
 		modelImage,
 		[]string{"-V", "/data", "-T", "train"},
 		map[string]string{
@@ -679,8 +851,10 @@ func (w *Worker) Train(modelImage, trainFolder, testFolder, modelFolder string)
 }
 
 // Predict launches the submission container's predict routines
-func (w *Worker) Predict(modelImage, testFolder string, predFolder string, modelFolder string) (containerID string, err error) {
-	return w.containerRuntime.RunImageInUntrustedContainer(
+func (w *Worker) Predict(ctx context.Context, modelImage, testFolder string, predFolder string, modelFolder string) (containerID string, err error) {
+	return w.runStep(
+		ctx,
+		"predict", true,
 		modelImage,
 		[]string{"-V", "/data", "-T", "predict"},
 		map[string]string{
@@ -691,8 +865,10 @@ func (w *Worker) Predict(modelImage, testFolder string, predFolder string, model
 }
 
 // ComputePerf analyses the prediction folders and computes a score for the model
-func (w *Worker) ComputePerf(problemImage, trainFolder, testFolder, untargetedTestFolder, perfFolder string) (containerID string, err error) {
-	return w.containerRuntime.RunImageInUntrustedContainer(
+func (w *Worker) ComputePerf(ctx context.Context, problemImage, trainFolder, testFolder, untargetedTestFolder, perfFolder string) (containerID string, err error) {
+	return w.runStep(
+		ctx,
+		"perf", false,
 		problemImage,
 		[]string{"-T", "perf", "-i", "/hidden_data", "-s", "/submission_data"},
 		map[string]string{
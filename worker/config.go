@@ -42,15 +42,41 @@ import (
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
 )
 
+// RedactedSecret replaces the secrets of the configuration exposed by the status server
+const RedactedSecret = "<redacted>"
+
 // ConsumerConfig holds the consumer configuration
 type ConsumerConfig struct {
 	// Broker
-	NsqlookupdURLs     []string
-	NsqdURL            string
-	LearnParallelism   int
-	PredictParallelism int
-	LearnTimeout       time.Duration
-	PredictTimeout     time.Duration
+	NsqlookupdURLs      []string
+	NsqdURL             string
+	LearnParallelism    int
+	PredictParallelism  int
+	EvaluateParallelism int
+	DownloadParallelism int
+	CacheFolder         string
+	CacheSize           int64
+	LogsFolder          string
+	LogsFolderMaxSize   int64
+	StepLogsMaxSize     int64
+	RedactUntrustedLogs bool
+	ImageCacheSize      int64
+	RequireChecksums    bool
+	ArchiveLimits       ArchiveLimits
+	ArchiveFormat       ArchiveFormat
+	LearnTimeout        time.Duration
+	PredictTimeout      time.Duration
+	EvaluateTimeout     time.Duration
+	DrainGracePeriod    time.Duration
+	LogLevel            string
+	MetricsAddress      string
+	OTLPEndpoint        string
+
+	// Status server (the admin routes need a password)
+	StatusAddress     string
+	StatusHistorySize int
+	AdminUser         string
+	AdminPassword     string
 
 	// Other compute services
 	OrchestratorHost     string
@@ -65,17 +91,43 @@ type ConsumerConfig struct {
 	// Container Runtime
 	DockerHost    string
 	DockerTimeout time.Duration
+
+	// Retry policies, per error class
+	RetryPolicies map[ErrorClass]RetryPolicy
 }
 
 // NewConsumerConfig parses CLI flags, generates and validates a ConsumerConfig
 func NewConsumerConfig() (conf *ConsumerConfig) {
 	var (
-		nsqlookupdURLs     common.MultiStringFlag
-		nsqdURL            string
-		learnParallelism   int
-		predictParallelism int
-		learnTimeout       time.Duration
-		predictTimeout     time.Duration
+		nsqlookupdURLs      common.MultiStringFlag
+		nsqdURL             string
+		learnParallelism    int
+		predictParallelism  int
+		evaluateParallelism int
+		downloadParallelism int
+		cacheFolder         string
+		cacheSize           int64
+		logsFolder          string
+		logsFolderMaxSize   int64
+		stepLogsMaxSize     int64
+		redactUntrustedLogs bool
+		imageCacheSize      int64
+		requireChecksums    bool
+		archiveMaxSize      int64
+		archiveMaxFiles     int
+		archiveMaxRatio     float64
+		archiveFormat       string
+		learnTimeout        time.Duration
+		predictTimeout      time.Duration
+		evaluateTimeout     time.Duration
+		drainGracePeriod    time.Duration
+		logLevel            string
+		metricsAddress      string
+		otlpEndpoint        string
+		statusAddress       string
+		statusHistorySize   int
+		adminUser           string
+		adminPassword       string
 
 		orchestratorHost     string
 		orchestratorPort     int
@@ -88,6 +140,15 @@ func NewConsumerConfig() (conf *ConsumerConfig) {
 
 		dockerHost    string
 		dockerTimeout time.Duration
+
+		storageMaxAttempts    int
+		storageBackoff        time.Duration
+		runtimeMaxAttempts    int
+		runtimeBackoff        time.Duration
+		submissionMaxAttempts int
+		submissionBackoff     time.Duration
+		peerMaxAttempts       int
+		peerBackoff           time.Duration
 	)
 
 	// CLI Flags
@@ -95,8 +156,31 @@ func NewConsumerConfig() (conf *ConsumerConfig) {
 	flag.StringVar(&nsqdURL, "http-address", "nsqd:4151", "URL of NSQd instance to connect to")
 	flag.IntVar(&learnParallelism, "learn-parallelism", 1, "Number of learning task that this worker can execute in parallel.")
 	flag.IntVar(&predictParallelism, "predict-parallelism", 1, "Number of learning task that this worker can execute in parallel.")
+	flag.IntVar(&evaluateParallelism, "evaluate-parallelism", 1, "Number of re-evaluation tasks that this worker can execute in parallel.")
+	flag.IntVar(&downloadParallelism, "download-parallelism", DefaultDownloadParallelism, "Number of datasets pulled from storage in parallel for each learning task.")
+	flag.StringVar(&cacheFolder, "cache-folder", "/data/.cache", "Folder where problem workflows, algos and datasets pulled from storage are cached")
+	flag.Int64Var(&cacheSize, "cache-size", 10<<30, "Size limit of the blob cache, in bytes (0 disables caching)")
+	flag.StringVar(&logsFolder, "logs-folder", "/data/.logs", "Folder where the logs of tasks are kept when storage can't store them (empty to drop them)")
+	flag.Int64Var(&logsFolderMaxSize, "logs-folder-max-size", DefaultLogsFolderMaxSize, "Size limit of the task logs kept in the logs folder, in bytes: the oldest ones are removed beyond it (0 keeps them all)")
+	flag.Int64Var(&stepLogsMaxSize, "step-logs-max-size", DefaultStepLogsMaxSize, "Size limit of the container output kept for each step of a task, in bytes")
+	flag.BoolVar(&redactUntrustedLogs, "redact-untrusted-logs", false, "Keep the output of untrusted (algo) containers in task logs, redacted, instead of withholding it (redaction is best effort: hidden data may still leak)")
+	flag.Int64Var(&archiveMaxSize, "archive-max-size", DefaultArchiveLimits.MaxSize, "Maximum total size of the files in a model archive, in bytes")
+	flag.IntVar(&archiveMaxFiles, "archive-max-files", DefaultArchiveLimits.MaxFiles, "Maximum number of entries in a model archive")
+	flag.Float64Var(&archiveMaxRatio, "archive-max-ratio", DefaultArchiveLimits.MaxRatio, "Maximum compression ratio of a model archive")
+	flag.BoolVar(&requireChecksums, "require-checksums", false, "Fail tasks pulling blobs that have no checksum in their storage metadata (they're only logged and counted otherwise)")
+	flag.StringVar(&archiveFormat, "archive-format", string(ArchiveFormatGzip), "Format of the model archives sent to storage: gzip, zstd or tar (archives are read whatever their format)")
+	flag.Int64Var(&imageCacheSize, "image-cache-size", 10<<30, "Total size of the build contexts of the images kept loaded in the container runtime once they're unused, in bytes (0 unloads images as soon as they're unused)")
 	flag.DurationVar(&learnTimeout, "learn-timeout", 20*time.Minute, "After this delay, learning tasks are timed out (default: 20m)")
 	flag.DurationVar(&predictTimeout, "predict-timeout", 20*time.Minute, "After this delay, prediction tasks are timed out (default: 20m)")
+	flag.DurationVar(&evaluateTimeout, "evaluate-timeout", 20*time.Minute, "After this delay, re-evaluation tasks are timed out")
+	flag.DurationVar(&drainGracePeriod, "drain-grace-period", 5*time.Minute, "On SIGTERM, delay given to running tasks to complete before they're interrupted and requeued (default: 5m)")
+	flag.StringVar(&metricsAddress, "metrics-address", "", "Address of the HTTP server exposing Prometheus metrics on /metrics, e.g. localhost:8080 (empty to disable it)")
+	flag.StringVar(&logLevel, "log-level", "debug", "Lowest level of the log lines written to stdout: debug, info, warning or error")
+	flag.StringVar(&statusAddress, "status-address", "", "Address of the HTTP server exposing the worker status on /status (empty to disable it)")
+	flag.IntVar(&statusHistorySize, "status-history-size", DefaultStatusHistorySize, "Number of finished tasks whose outcome is exposed by the status server")
+	flag.StringVar(&adminUser, "admin-user", "admin", "Basic Authentication username of the status server admin routes")
+	flag.StringVar(&adminPassword, "admin-password", "", "Basic Authentication password of the status server admin routes (leave blank to disable them)")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "URL of the OTLP/HTTP collector traces are sent to, e.g. http://otel-collector:4318 (leave blank to disable tracing)")
 
 	flag.StringVar(&orchestratorHost, "orchestrator-host", "", "Hostname of the orchestrator to send notifications to (leave blank to use the Orchestrator API Mock)")
 	flag.IntVar(&orchestratorPort, "orchestrator-port", 80, "TCP port to contact the orchestrator on (default: 80)")
@@ -110,6 +194,15 @@ func NewConsumerConfig() (conf *ConsumerConfig) {
 
 	flag.DurationVar(&dockerTimeout, "docker-timeout", 15*time.Minute, "Docker commands timeout (concerns builds, runs, pulls, etc...) (default: 15m)")
 
+	flag.IntVar(&storageMaxAttempts, "storage-max-attempts", DefaultRetryPolicies[ErrorClassStorage].MaxAttempts, "Number of times a task failing because of storage is attempted before being marked as failed")
+	flag.DurationVar(&storageBackoff, "storage-backoff", DefaultRetryPolicies[ErrorClassStorage].Backoff, "Delay before requeuing a task that failed because of storage (doubles with each attempt)")
+	flag.IntVar(&runtimeMaxAttempts, "runtime-max-attempts", DefaultRetryPolicies[ErrorClassRuntime].MaxAttempts, "Number of times a task failing because of the container runtime is attempted before being marked as failed")
+	flag.DurationVar(&runtimeBackoff, "runtime-backoff", DefaultRetryPolicies[ErrorClassRuntime].Backoff, "Delay before requeuing a task that failed because of the container runtime (doubles with each attempt)")
+	flag.IntVar(&submissionMaxAttempts, "submission-max-attempts", DefaultRetryPolicies[ErrorClassSubmission].MaxAttempts, "Number of times a task failing because of the user submission is attempted before being marked as failed")
+	flag.DurationVar(&submissionBackoff, "submission-backoff", DefaultRetryPolicies[ErrorClassSubmission].Backoff, "Delay before requeuing a task that failed because of the user submission (doubles with each attempt)")
+	flag.IntVar(&peerMaxAttempts, "peer-max-attempts", DefaultRetryPolicies[ErrorClassPeer].MaxAttempts, "Number of times a task failing because of the peer is attempted before being marked as failed")
+	flag.DurationVar(&peerBackoff, "peer-backoff", DefaultRetryPolicies[ErrorClassPeer].Backoff, "Delay before requeuing a task that failed because of the peer (doubles with each attempt)")
+
 	flag.Parse()
 
 	if len(nsqlookupdURLs) == 0 {
@@ -117,12 +210,39 @@ func NewConsumerConfig() (conf *ConsumerConfig) {
 	}
 
 	return &ConsumerConfig{
-		NsqlookupdURLs:     nsqlookupdURLs,
-		NsqdURL:            nsqdURL,
-		LearnParallelism:   learnParallelism,
-		PredictParallelism: predictParallelism,
-		LearnTimeout:       learnTimeout,
-		PredictTimeout:     predictTimeout,
+		NsqlookupdURLs:      nsqlookupdURLs,
+		NsqdURL:             nsqdURL,
+		LearnParallelism:    learnParallelism,
+		PredictParallelism:  predictParallelism,
+		EvaluateParallelism: evaluateParallelism,
+		DownloadParallelism: downloadParallelism,
+		CacheFolder:         cacheFolder,
+		CacheSize:           cacheSize,
+		LogsFolder:          logsFolder,
+		LogsFolderMaxSize:   logsFolderMaxSize,
+		StepLogsMaxSize:     stepLogsMaxSize,
+		RedactUntrustedLogs: redactUntrustedLogs,
+		ImageCacheSize:      imageCacheSize,
+		RequireChecksums:    requireChecksums,
+		ArchiveLimits: ArchiveLimits{
+			MaxSize:  archiveMaxSize,
+			MaxFiles: archiveMaxFiles,
+			MaxRatio: archiveMaxRatio,
+		},
+		ArchiveFormat:    ArchiveFormat(archiveFormat),
+		LearnTimeout:     learnTimeout,
+		PredictTimeout:   predictTimeout,
+		EvaluateTimeout:  evaluateTimeout,
+		DrainGracePeriod: drainGracePeriod,
+		LogLevel:         logLevel,
+		MetricsAddress:   metricsAddress,
+		OTLPEndpoint:     otlpEndpoint,
+
+		// Status server
+		StatusAddress:     statusAddress,
+		StatusHistorySize: statusHistorySize,
+		AdminUser:         adminUser,
+		AdminPassword:     adminPassword,
 
 		// Other compute services
 		OrchestratorHost:     orchestratorHost,
@@ -137,5 +257,27 @@ func NewConsumerConfig() (conf *ConsumerConfig) {
 		// Container Runtime
 		DockerHost:    dockerHost,
 		DockerTimeout: dockerTimeout,
+
+		// Retry policies
+		RetryPolicies: map[ErrorClass]RetryPolicy{
+			ErrorClassStorage:    {MaxAttempts: storageMaxAttempts, Backoff: storageBackoff},
+			ErrorClassRuntime:    {MaxAttempts: runtimeMaxAttempts, Backoff: runtimeBackoff},
+			ErrorClassSubmission: {MaxAttempts: submissionMaxAttempts, Backoff: submissionBackoff},
+			ErrorClassProblem:    DefaultRetryPolicies[ErrorClassProblem],
+			ErrorClassPeer:       {MaxAttempts: peerMaxAttempts, Backoff: peerBackoff},
+			ErrorClassTask:       DefaultRetryPolicies[ErrorClassTask],
+		},
+	}
+}
+
+// Redacted returns a copy of the configuration whose secrets are hidden, to be exposed by the
+// status server
+func (c *ConsumerConfig) Redacted() *ConsumerConfig {
+	redacted := *c
+	for _, secret := range []*string{&redacted.OrchestratorPassword, &redacted.StoragePassword, &redacted.AdminPassword} {
+		if *secret != "" {
+			*secret = RedactedSecret
+		}
 	}
+	return &redacted
 }
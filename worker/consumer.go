@@ -0,0 +1,166 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// MessageTimeout is how long NSQ waits for a task to be acknowledged before delivering it again.
+// Our consumer touches the tasks it's running at half that interval, so that long tasks aren't
+// delivered twice.
+const MessageTimeout = time.Minute
+
+// TaskHandler handles a task message. attempts is the number of times the broker has delivered
+// it, to any worker (starting at 1).
+type TaskHandler func(message []byte, attempts int) error
+
+// Consumer pulls tasks from NSQ and hands them to our task handlers. Unlike a plain NSQ handler,
+// ours decide when a failed task comes back: a handler returning a *RequeueError has its task
+// requeued with the given delay, without holding the handler slot (or backing the consumer off).
+type Consumer struct {
+	lookupdURLs  []string
+	nsqdURL      string
+	channel      string
+	pollInterval time.Duration
+	logger       *log.Logger
+	consumers    []*nsq.Consumer
+}
+
+// NewConsumer creates a consumer for a given channel, that finds the topics' nsqd nodes through
+// nsqlookupd (or connects to nsqdURL directly if no nsqlookupd URL is given)
+func NewConsumer(lookupdURLs []string, nsqdURL, channel string, pollInterval time.Duration, logger *log.Logger) *Consumer {
+	return &Consumer{
+		lookupdURLs:  lookupdURLs,
+		nsqdURL:      nsqdURL,
+		channel:      channel,
+		pollInterval: pollInterval,
+		logger:       logger,
+	}
+}
+
+// AddHandler consumes a topic with up to parallelism concurrent handler calls
+func (c *Consumer) AddHandler(topic string, handler TaskHandler, parallelism int) error {
+	config := nsq.NewConfig()
+	config.MaxInFlight = parallelism
+	config.MsgTimeout = MessageTimeout
+	config.LookupdPollInterval = c.pollInterval
+	// Retry policies decide when a task is out of attempts (and mark it as failed on the peer):
+	// NSQ mustn't discard messages that are still to be attempted
+	config.MaxAttempts = 0
+
+	consumer, err := nsq.NewConsumer(topic, c.channel, config)
+	if err != nil {
+		return fmt.Errorf("Error creating consumer for topic %s: %s", topic, err)
+	}
+	consumer.SetLogger(c.logger, nsq.LogLevelInfo)
+	consumer.AddConcurrentHandlers(nsq.HandlerFunc(func(msg *nsq.Message) error {
+		HandleMessage(msg, handler, c.logger)
+		return nil
+	}), parallelism)
+
+	if len(c.lookupdURLs) > 0 {
+		err = consumer.ConnectToNSQLookupds(c.lookupdURLs)
+	} else {
+		err = consumer.ConnectToNSQD(c.nsqdURL)
+	}
+	if err != nil {
+		consumer.Stop()
+		return fmt.Errorf("Error connecting consumer for topic %s: %s", topic, err)
+	}
+	c.consumers = append(c.consumers, consumer)
+	return nil
+}
+
+// ConsumeUntilKilled consumes our topics until the process receives SIGINT or SIGTERM, and waits
+// for the running handlers to return
+func (c *Consumer) ConsumeUntilKilled() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	for _, consumer := range c.consumers {
+		consumer.Stop()
+	}
+	for _, consumer := range c.consumers {
+		<-consumer.StopChan
+	}
+}
+
+// HandleMessage runs a task handler on an NSQ message, touching the message until the handler
+// returns. The message is then finished, or requeued if the handler returned an error.
+func HandleMessage(msg *nsq.Message, handler TaskHandler, logger *log.Logger) {
+	msg.DisableAutoResponse()
+
+	done := make(chan struct{})
+	touched := make(chan struct{})
+	go func() {
+		defer close(touched)
+		ticker := time.NewTicker(MessageTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				msg.Touch()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := handler(msg.Body, int(msg.Attempts))
+	close(done)
+	<-touched
+
+	if err == nil {
+		msg.Finish()
+		return
+	}
+	if requeue, ok := err.(*RequeueError); ok {
+		logger.Printf("Requeuing message %s in %s: %s", msg.ID, requeue.Delay, err)
+		msg.RequeueWithoutBackoff(requeue.Delay)
+		return
+	}
+	logger.Printf("Requeuing message %s: %s", msg.ID, err)
+	msg.Requeue(-1)
+}
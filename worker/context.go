@@ -0,0 +1,161 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// CancelableRuntime is implemented by container runtimes that kill and clean up the containers
+// they run as soon as a context is done
+type CancelableRuntime interface {
+	RunImageInUntrustedContainerContext(ctx context.Context, imageName string, args []string, mounts map[string]string, autoRemove bool) (containerID string, err error)
+}
+
+// baseContext returns the worker's root context, that is canceled when the worker is stopped
+func (w *Worker) baseContext() context.Context {
+	w.lifecycleOnce.Do(func() {
+		w.ctx, w.cancel = context.WithCancel(context.Background())
+	})
+	return w.ctx
+}
+
+// Stop cancels every task running on the worker
+func (w *Worker) Stop() {
+	w.baseContext()
+	w.cancel()
+}
+
+// SetTimeouts sets the duration after which learning, prediction and re-evaluation tasks are
+// interrupted (zero means no timeout)
+func (w *Worker) SetTimeouts(learnTimeout, predictTimeout, evaluateTimeout time.Duration) {
+	w.learnTimeout = learnTimeout
+	w.predictTimeout = predictTimeout
+	w.evaluateTimeout = evaluateTimeout
+}
+
+// stopped returns true once the worker has been stopped
+func (w *Worker) stopped() bool {
+	return w.baseContext().Err() != nil
+}
+
+// taskContext returns the context a running task runs in: it is canceled when the worker is
+// stopped, when the task is canceled or when it times out (if timeout isn't zero)
+func (w *Worker) taskContext(task *runningTask, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(w.baseContext(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(w.baseContext())
+	}
+	task.setCancel(cancel)
+	return withRunningTask(ctx, task), cancel
+}
+
+// runContainer runs an image in an untrusted container until it exits or ctx is done. Container
+// runtimes that aren't cancelable (our DockerRuntime is) run their containers to completion, or
+// until their own timeout expires (check out the -docker-timeout flag).
+func (w *Worker) runContainer(ctx context.Context, imageName string, args []string, mounts map[string]string, autoRemove bool) (containerID string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	if runtime, ok := w.containerRuntime.(CancelableRuntime); ok {
+		return runtime.RunImageInUntrustedContainerContext(ctx, imageName, args, mounts, autoRemove)
+	}
+	return w.containerRuntime.RunImageInUntrustedContainer(imageName, args, mounts, autoRemove)
+}
+
+// getBlob pulls a blob from storage. Reading the blob fails as soon as ctx is done.
+func getBlob(ctx context.Context, get func(id uuid.UUID) (io.ReadCloser, error), id uuid.UUID) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	blob, err := get(id)
+	if err != nil {
+		return nil, err
+	}
+	return newContextReader(ctx, blob), nil
+}
+
+// contextReader aborts reads from a blob once a context is done. The blob is closed when that
+// happens, which interrupts pending reads on the underlying connection.
+type contextReader struct {
+	ctx       context.Context
+	blob      io.ReadCloser
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newContextReader(ctx context.Context, blob io.ReadCloser) io.ReadCloser {
+	r := &contextReader{
+		ctx:  ctx,
+		blob: blob,
+		done: make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			blob.Close()
+		case <-r.done:
+		}
+	}()
+	return r
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.blob.Read(p)
+	if err != nil && r.ctx.Err() != nil {
+		return n, r.ctx.Err()
+	}
+	return n, err
+}
+
+func (r *contextReader) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return r.blob.Close()
+}
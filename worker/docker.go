@@ -0,0 +1,224 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+)
+
+// dockerCleanupTimeout bounds the Docker calls that kill and remove the containers of interrupted
+// tasks (their own context is done already)
+const dockerCleanupTimeout = 30 * time.Second
+
+// dockerLogsTimeout bounds the retrieval of the output of a container
+const dockerLogsTimeout = time.Minute
+
+// DockerClient holds the Docker API calls made by our runtime (*client.Client implements it)
+type DockerClient interface {
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error)
+	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerWait(ctx context.Context, containerID string) (int64, error)
+	ContainerKill(ctx context.Context, containerID, signal string) error
+	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
+	ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error)
+}
+
+// DockerRuntime is the container runtime of our workers. Images are built and loaded by the
+// runtime it wraps, but untrusted containers are run by the Docker client directly, so that they
+// are killed and removed as soon as their task is interrupted. It implements CancelableRuntime,
+// LogRuntime and ImageLister.
+type DockerRuntime struct {
+	common.ContainerRuntime
+	client  DockerClient
+	timeout time.Duration
+}
+
+// NewDockerRuntime connects to the Docker daemon set by the usual DOCKER_* environment variables.
+// Docker commands time out after timeout (zero means no timeout).
+func NewDockerRuntime(timeout time.Duration) (*DockerRuntime, error) {
+	runtime, err := common.NewDockerRuntime(timeout)
+	if err != nil {
+		return nil, err
+	}
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating Docker client: %s", err)
+	}
+	return NewDockerRuntimeWithClient(runtime, cli, timeout), nil
+}
+
+// NewDockerRuntimeWithClient creates a Docker runtime building and loading images with runtime,
+// and running containers with cli
+func NewDockerRuntimeWithClient(runtime common.ContainerRuntime, cli DockerClient, timeout time.Duration) *DockerRuntime {
+	return &DockerRuntime{
+		ContainerRuntime: runtime,
+		client:           cli,
+		timeout:          timeout,
+	}
+}
+
+// RunImageInUntrustedContainer runs an image in an untrusted container until it exits (or the
+// Docker timeout expires)
+func (r *DockerRuntime) RunImageInUntrustedContainer(imageName string, args []string, mounts map[string]string, autoRemove bool) (containerID string, err error) {
+	return r.RunImageInUntrustedContainerContext(context.Background(), imageName, args, mounts, autoRemove)
+}
+
+// RunImageInUntrustedContainerContext runs an image in a network-less container, with mounts
+// (host path to container path) bound in it, until it exits or ctx is done. Containers still
+// running when ctx is done are killed and removed: no container ID is returned then.
+func (r *DockerRuntime) RunImageInUntrustedContainerContext(ctx context.Context, imageName string, args []string, mounts map[string]string, autoRemove bool) (containerID string, err error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	config := &container.Config{
+		Image:           imageName,
+		Cmd:             args,
+		NetworkDisabled: true,
+	}
+	hostConfig := &container.HostConfig{
+		NetworkMode: "none",
+		CapDrop:     []string{"ALL"},
+		SecurityOpt: []string{"no-new-privileges"},
+	}
+	for hostPath, containerPath := range mounts {
+		hostConfig.Binds = append(hostConfig.Binds, fmt.Sprintf("%s:%s", hostPath, containerPath))
+	}
+
+	created, err := r.client.ContainerCreate(ctx, config, hostConfig, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("Error creating container for image %s: %s", imageName, err)
+	}
+	containerID = created.ID
+
+	if err := r.client.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+		r.remove(containerID)
+		return "", fmt.Errorf("Error starting container %s (image %s): %s", containerID, imageName, err)
+	}
+
+	status, err := r.client.ContainerWait(ctx, containerID)
+	if err != nil {
+		r.remove(containerID)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("Error waiting for container %s (image %s): %s", containerID, imageName, err)
+	}
+	if autoRemove {
+		r.remove(containerID)
+	}
+	if status != 0 {
+		return containerID, fmt.Errorf("Container %s (image %s) exited with status %d", containerID, imageName, status)
+	}
+	return containerID, nil
+}
+
+// RemoveContainer kills a container if it's still running and removes it
+func (r *DockerRuntime) RemoveContainer(containerID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerCleanupTimeout)
+	defer cancel()
+
+	// Containers that have exited already can't be killed: removing them is all we need
+	r.client.ContainerKill(ctx, containerID, "KILL")
+	err := r.client.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true})
+	if err != nil {
+		return fmt.Errorf("Error removing container %s: %s", containerID, err)
+	}
+	return nil
+}
+
+// ContainerLogs returns the output of a container, stdout and stderr interleaved. Containers are
+// run without a TTY: Docker multiplexes both streams, which we split back.
+func (r *DockerRuntime) ContainerLogs(containerID string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerLogsTimeout)
+	logs, err := r.client.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("Error retrieving logs of container %s: %s", containerID, err)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer cancel()
+		defer logs.Close()
+		_, err := stdcopy.StdCopy(writer, writer, logs)
+		writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// ListImages returns the names (tag included) of the images held by the Docker daemon
+func (r *DockerRuntime) ListImages() ([]string, error) {
+	ctx := context.Background()
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	images, err := r.client.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing images: %s", err)
+	}
+	var names []string
+	for _, image := range images {
+		names = append(names, image.RepoTags...)
+	}
+	return names, nil
+}
+
+// remove removes a container, logging failures (the container then has to be removed by hand)
+func (r *DockerRuntime) remove(containerID string) {
+	if err := r.RemoveContainer(containerID); err != nil {
+		logging.Default().With(logging.FieldComponent, "docker").Errorf("%s", err)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// DefaultDownloadParallelism is the number of datasets pulled in parallel when none is set
+const DefaultDownloadParallelism = 4
+
+// dataset is a data blob to pull from storage into a task folder
+type dataset struct {
+	kind   string // "train" or "test", for logging purposes
+	id     uuid.UUID
+	folder string
+}
+
+// SetDownloadParallelism sets the maximum number of datasets pulled in parallel for a task (the
+// default is used if n isn't positive)
+func (w *Worker) SetDownloadParallelism(n int) {
+	w.downloadParallelism = n
+}
+
+// pullDatasets pulls datasets from storage into their folders, each one in a file named after its
+// UUID. Up to downloadParallelism datasets are pulled at once and all the pending downloads are
+// aborted as soon as one of them fails.
+func (w *Worker) pullDatasets(ctx context.Context, datasets []dataset) (err error) {
+	ctx, span := startStepSpan(ctx, StepDataPull)
+	defer func() { tracing.End(span, err) }()
+
+	parallelism := w.downloadParallelism
+	if parallelism <= 0 {
+		parallelism = DefaultDownloadParallelism
+	}
+
+	defer w.metrics.timeStep(StepDataPull)()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	logger := logging.FromContext(ctx).Start("download")
+
+	var (
+		wg        sync.WaitGroup
+		lock      sync.Mutex
+		firstErr  error
+		pulled    int
+		pulledLen int64
+	)
+	slots := make(chan struct{}, parallelism)
+
+	for _, d := range datasets {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(d dataset) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			n, err := w.pullDataset(ctx, d)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				// The other downloads fail with ctx.Err() once we cancel them: let's keep the
+				// error that caused it
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			pulled++
+			pulledLen += n
+			logger.Debugf("Pulled %s dataset %s (%d bytes): %d/%d datasets, %d bytes pulled", d.kind, d.id, n, pulled, len(datasets), pulledLen)
+		}(d)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		logger.With(logging.FieldError, firstErr).Warningf("Error pulling datasets (%d/%d pulled)", pulled, len(datasets))
+		return firstErr
+	}
+	if ctx.Err() == nil {
+		logger.Infof("Pulled %d datasets (%d bytes)", pulled, pulledLen)
+	}
+	// The parent context may have been canceled before every download was started
+	return ctx.Err()
+}
+
+// pullDataset pulls a single dataset from storage and returns its size
+func (w *Worker) pullDataset(ctx context.Context, d dataset) (int64, error) {
+	pull, checksum, err := w.pullBlob(ctx, dataBlob, d.id)
+	if err != nil {
+		return 0, wrapTaskError(err, ErrorClassStorage, "Error pulling %s dataset %s from storage: %s", d.kind, d.id, err)
+	}
+
+	path := filepath.Join(d.folder, d.id.String())
+	if w.cache != nil {
+		n, err := w.cache.CopyTo(ctx, CacheKey(dataBlob.name, d.id, checksum), func() (io.ReadCloser, error) {
+			return pull()
+		}, path)
+		if err != nil {
+			return n, wrapTaskError(err, ErrorClassStorage, "Error pulling %s dataset %s through cache: %s", d.kind, d.id, err)
+		}
+		return n, nil
+	}
+
+	data, err := pull()
+	if err != nil {
+		return 0, NewTaskError(ErrorClassStorage, "Error pulling %s dataset %s from storage: %s", d.kind, d.id, err)
+	}
+	defer data.Close()
+
+	dataFile, err := os.Create(path)
+	if err != nil {
+		return 0, NewTaskError(ErrorClassRuntime, "Error creating file %s: %s", path, err)
+	}
+	defer dataFile.Close()
+
+	n, err := io.Copy(dataFile, data)
+	if err != nil {
+		return n, wrapTaskError(err, ErrorClassStorage, "Error copying %s data file %s (%d bytes written): %s", d.kind, path, n, err)
+	}
+	return n, nil
+}
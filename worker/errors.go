@@ -0,0 +1,142 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ErrorClass tells which part of the system a task error comes from. Our retry policies are
+// defined per error class.
+type ErrorClass string
+
+// Error classes
+const (
+	// ErrorClassStorage is used for failures to talk to storage (pull/push of blobs & metadata)
+	ErrorClassStorage ErrorClass = "storage"
+	// ErrorClassRuntime is used for container runtime failures (image builds, problem workflow
+	// containers) and worker host issues (disk space, permissions...)
+	ErrorClassRuntime ErrorClass = "runtime"
+	// ErrorClassSubmission is used when the user submission (algo or model) is to blame
+	ErrorClassSubmission ErrorClass = "submission"
+	// ErrorClassProblem is used when the problem workflow is to blame (missing or invalid
+	// performance file...)
+	ErrorClassProblem ErrorClass = "problem"
+	// ErrorClassPeer is used for failures to talk to the peer
+	ErrorClassPeer ErrorClass = "peer"
+	// ErrorClassTask is used for malformed tasks, that no retry could possibly fix
+	ErrorClassTask ErrorClass = "task"
+)
+
+// TaskError wraps an error that occurred while executing a task with its class
+type TaskError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *TaskError) Error() string {
+	return e.Err.Error()
+}
+
+// NewTaskError formats an error message and wraps it in a TaskError of the given class
+func NewTaskError(class ErrorClass, format string, a ...interface{}) error {
+	return &TaskError{
+		Class: class,
+		Err:   fmt.Errorf(format, a...),
+	}
+}
+
+// wrapTaskError works like NewTaskError, unless cause has been classified already: it is then
+// returned as is (a corrupted blob makes image builds fail, but it's a storage error)
+func wrapTaskError(cause error, class ErrorClass, format string, a ...interface{}) error {
+	if _, ok := cause.(*TaskError); ok {
+		return cause
+	}
+	return NewTaskError(class, format, a...)
+}
+
+// ErrorClassOf returns the class of an error returned by a workflow. Errors that weren't
+// classified are considered as runtime errors.
+func ErrorClassOf(err error) ErrorClass {
+	if taskErr, ok := err.(*TaskError); ok {
+		return taskErr.Class
+	}
+	return ErrorClassRuntime
+}
+
+// RetryPolicy tells how many times a task failing with a given class of error is attempted before
+// being marked as failed on the peer and how long we wait before handing it back to the broker.
+// The backoff doubles with each attempt.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+// Retryable returns true if a task that has already been attempted n times can be attempted again
+func (p RetryPolicy) Retryable(n int) bool {
+	return n < p.MaxAttempts
+}
+
+// Delay returns the backoff duration that applies after the n-th failed attempt
+func (p RetryPolicy) Delay(n int) time.Duration {
+	if n < 1 {
+		n = 1
+	}
+	return p.Backoff * time.Duration(1<<uint(n-1))
+}
+
+// DefaultRetryPolicies are the retry policies used by workers created with NewWorker: storage,
+// runtime and peer errors are likely to be transient, submission, problem and task errors aren't.
+var DefaultRetryPolicies = map[ErrorClass]RetryPolicy{
+	ErrorClassStorage:    {MaxAttempts: 3, Backoff: 10 * time.Second},
+	ErrorClassRuntime:    {MaxAttempts: 2, Backoff: 30 * time.Second},
+	ErrorClassSubmission: {MaxAttempts: 1},
+	ErrorClassProblem:    {MaxAttempts: 1},
+	ErrorClassPeer:       {MaxAttempts: 5, Backoff: 5 * time.Second},
+	ErrorClassTask:       {MaxAttempts: 1},
+}
+
+// RequeueError is returned by task handlers for tasks that are to be handed back to the broker
+// and delivered again once Delay has elapsed
+type RequeueError struct {
+	Delay time.Duration
+	Err   error
+}
+
+func (e *RequeueError) Error() string {
+	return e.Err.Error()
+}
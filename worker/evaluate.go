@@ -0,0 +1,310 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// EvaluateTopic is the broker topic of re-evaluation tasks (pushed by the compute API)
+const EvaluateTopic = "evaluate"
+
+// Evaluplet describes a re-evaluation task: the performance of a model that has already been
+// trained is computed again on its test data (once a problem's metric or detarget logic has been
+// fixed for instance) and reported to the peer for the learnuplet that trained it. The compute API
+// has the same definition, and keys evaluplets after the learnuplet that trained their model.
+type Evaluplet struct {
+	Key        string      `json:"key"`
+	Learnuplet string      `json:"learnuplet"`
+	Problem    uuid.UUID   `json:"problem"`
+	Model      uuid.UUID   `json:"model"`
+	TestData   []uuid.UUID `json:"test_data"`
+}
+
+// Check returns an error if the evaluplet is malformed
+func (e *Evaluplet) Check() error {
+	if e.Key == "" {
+		return fmt.Errorf("key field is unset")
+	}
+	// Keys name the task's data folder
+	if strings.ContainsAny(e.Key, `/\`) || e.Key == "." || e.Key == ".." {
+		return fmt.Errorf("key field %q isn't a valid folder name", e.Key)
+	}
+	if e.Learnuplet == "" {
+		return fmt.Errorf("learnuplet field is unset")
+	}
+	if uuid.Equal(e.Problem, uuid.Nil) {
+		return fmt.Errorf("problem field is unset")
+	}
+	if uuid.Equal(e.Model, uuid.Nil) {
+		return fmt.Errorf("model field is unset")
+	}
+	if len(e.TestData) == 0 {
+		return fmt.Errorf("test_data field is empty")
+	}
+	return nil
+}
+
+// HandleEvaluate manages a re-evaluation task. Re-evaluations aren't uplets: their status isn't
+// on the peer, and the learnuplet they re-evaluate is left as is when they fail for good.
+func (w *Worker) HandleEvaluate(message []byte, attempts int) (err error) {
+	const kind = "evaluate"
+	envelope := logging.Unwrap(message)
+	logger := w.taskLogger(kind, envelope)
+	logger.Debugf("Starting re-evaluation task")
+
+	traceCtx, span := w.startTaskSpan(kind, envelope)
+	defer func() { tracing.End(span, err) }()
+
+	// Unmarshal the evaluplet (no retry would ever fix a malformed task: we just drop it)
+	var task Evaluplet
+	err = json.NewDecoder(bytes.NewReader(envelope.Task)).Decode(&task)
+	if err != nil {
+		logger.Errorf("Dropping task. Error un-marshaling evaluplet: %s -- Body: %s", err, envelope.Task)
+		return nil
+	}
+	logger = logger.With(logging.FieldTask, task.Key)
+	span.SetAttributes(tracing.AttributeTask.String(task.Key))
+	ctx := logging.WithLogger(traceCtx, logger)
+
+	if err = task.Check(); err != nil {
+		logger.Errorf("Dropping task. Error in evaluate task: %s -- Body: %s", err, envelope.Task)
+		return nil
+	}
+
+	running, err := w.startTask(kind, task.Key, envelope.MessageID)
+	if err == errTaskRunning {
+		logger.Infof("Skipping %s: %s", task.Key, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Not starting %s: %s", task.Key, err)
+	}
+	defer func() { w.endTask(running, err) }()
+
+	w.metrics.taskStarted(kind)
+
+	// The output of the task's containers is saved once it's done, whatever its outcome
+	logs := w.newTaskLogs(task.Key)
+	reportFailure := func() error {
+		w.saveLogs(logs)
+		return nil
+	}
+
+	taskCtx, cancel := w.taskContext(running, w.evaluateTimeout)
+	defer cancel()
+
+	err = w.EvaluateWorkflow(WithTaskLogs(logging.WithLogger(tracing.ContextWithSpan(taskCtx, ctx), logger), logs), task)
+	w.taskEnded(running, err)
+	if err != nil {
+		return w.retryTask(ctx, task.Key, attempts, err, nil, reportFailure)
+	}
+	w.saveLogs(logs)
+	logger.Infof("Re-evaluation task done")
+	return nil
+}
+
+// EvaluateWorkflow implements our re-evaluation workflow: test data is detargeted by the problem
+// workflow, the model predicts the targets and the problem workflow computes its performance on
+// them, that is reported to the peer for the learnuplet that trained the model.
+func (w *Worker) EvaluateWorkflow(ctx context.Context, task Evaluplet) (err error) {
+	logger := logging.FromContext(ctx)
+	logger.Debugf("Starting re-evaluation workflow for %s (model %s)", task.Key, task.Model)
+
+	// Re-evaluations of the same model may run concurrently, for different learnuplets
+	taskDataFolder := filepath.Join(w.dataFolder, fmt.Sprintf("%s-evaluate", task.Key))
+	defer os.RemoveAll(taskDataFolder)
+
+	perfErr, err := w.evaluateModel(ctx, task.Key, taskDataFolder, task.Problem, task.Model, nil, task.TestData)
+	if err != nil {
+		return err
+	}
+	if perfErr != nil {
+		return NewTaskError(ErrorClassRuntime, "Error computing perf for problem %s and model %s: %s", task.Problem, task.Model, perfErr)
+	}
+
+	// Only the test performance makes sense: the model wasn't trained again (and its train data
+	// wasn't pulled)
+	perfuplet, err := w.readPerfuplet(ctx, filepath.Join(taskDataFolder, w.perfFolder), task.Problem)
+	if err != nil {
+		return err
+	}
+	if err := w.reportPerf(ctx, task, perfuplet); err != nil {
+		return NewTaskError(ErrorClassPeer, "Error posting re-evaluation result of %s to peer: %s", task.Learnuplet, err)
+	}
+	logger.With("learnuplet", task.Learnuplet).With("perf", perfuplet.Perf).With("test_perf", perfuplet.TestPerf).Infof("Re-evaluation of model %s finished with success, cleaning up...", task.Model)
+	return nil
+}
+
+// reportPerf sends the test performance of a re-evaluated model to the peer. Reporting it as a
+// learnuplet result would overwrite the model's train performance and mark its learnuplet done
+// again: the chaincode's reportPerf only updates the perf and test_perf of the learnuplet that
+// trained the model. The peer client has no dedicated method for it, so we invoke the chaincode
+// directly.
+func (w *Worker) reportPerf(ctx context.Context, task Evaluplet, perfuplet *Perfuplet) error {
+	testPerf, err := json.Marshal(perfuplet.TestPerf)
+	if err != nil {
+		return fmt.Errorf("Error marshaling test performance: %s", err)
+	}
+	return traceCall(ctx, "peer.reportPerf", func() error {
+		_, _, err := w.peer.Invoke("reportPerf", []string{task.Learnuplet, strconv.FormatFloat(perfuplet.Perf, 'g', -1, 64), string(testPerf)})
+		return err
+	}, tracing.AttributeTask.String(task.Key))
+}
+
+// evaluateModel has the trained model of task key predict the targets of detargeted test data (and of its train
+// data, if any is given) and lets the problem workflow compute its performance file, under
+// taskDataFolder (that callers wipe out once they're done). Errors of the perf step itself are
+// returned as perfErr, so that callers may still report what they can.
+func (w *Worker) evaluateModel(ctx context.Context, key, taskDataFolder string, problem, modelID uuid.UUID, trainData, testData []uuid.UUID) (perfErr, err error) {
+	// Setup directory structure
+	trainFolder := filepath.Join(taskDataFolder, w.trainFolder)
+	trainPredFolder := filepath.Join(trainFolder, w.predFolder)
+	testFolder := filepath.Join(taskDataFolder, w.testFolder)
+	untargetedTestFolder := filepath.Join(taskDataFolder, w.untargetedTestFolder)
+	predFolder := filepath.Join(untargetedTestFolder, w.predFolder)
+	modelFolder := filepath.Join(taskDataFolder, w.modelFolder)
+	perfFolder := filepath.Join(taskDataFolder, w.perfFolder)
+
+	pathList := []string{taskDataFolder, trainFolder, testFolder, untargetedTestFolder, predFolder, modelFolder, perfFolder}
+	if len(trainData) > 0 {
+		pathList = append(pathList, trainPredFolder)
+	}
+	for _, path := range pathList {
+		err = os.MkdirAll(path, os.ModeDir)
+		if err != nil {
+			return nil, NewTaskError(ErrorClassRuntime, "Error creating folder under %s: %s", path, err)
+		}
+	}
+
+	// Load problem workflow
+	problemWorkflow, err := w.openBlob(ctx, problemBlob, problem)
+	if err != nil {
+		return nil, wrapTaskError(err, ErrorClassStorage, "Error pulling problem workflow %s from storage: %s", problem, err)
+	}
+	problemImageName := fmt.Sprintf("%s-%s", w.problemImagePrefix, problem)
+	problemImageName, releaseProblemImage, err := w.loadImage(ctx, problemImageName, problemWorkflow)
+	if err != nil {
+		return nil, wrapTaskError(err, ErrorClassRuntime, "Error loading problem workflow image %s in Docker daemon: %s", problem, err)
+	}
+	problemWorkflow.Close()
+	defer releaseProblemImage()
+
+	// Pull model from storage and store it in modelFolder
+	model, err := w.openBlob(ctx, modelBlob, modelID)
+	if err != nil {
+		return nil, wrapTaskError(err, ErrorClassStorage, "Error pulling model %s from storage: %s", modelID, err)
+	}
+	err = w.UnarchiveInFolder(modelFolder, model)
+	if verifyErr := model.Verify(); verifyErr != nil {
+		return nil, verifyErr
+	}
+	if err != nil {
+		return nil, NewTaskError(ErrorClassSubmission, "Error unarchiving model: %s", err)
+	}
+	model.Close()
+
+	// Pull associated algo and load it into the container runtime
+	var modelInfo *common.Model
+	err = traceCall(ctx, "storage.GetModel", func() (err error) {
+		modelInfo, err = w.storage.GetModel(modelID)
+		return err
+	}, tracing.AttributeTask.String(key))
+	if err != nil {
+		return nil, NewTaskError(ErrorClassStorage, "Error retrieving model %s metadata: %s", modelID, err)
+	}
+	algo, err := w.openBlob(ctx, algoBlob, modelInfo.Algo)
+	if err != nil {
+		return nil, wrapTaskError(err, ErrorClassStorage, "Error pulling algo %s from storage: %s", modelInfo.Algo, err)
+	}
+	algoImageName := fmt.Sprintf("%s-%s", w.algoImagePrefix, modelInfo.Algo)
+	algoImageName, releaseAlgoImage, err := w.loadImage(ctx, algoImageName, algo)
+	if err != nil {
+		return nil, wrapTaskError(err, ErrorClassSubmission, "Error loading algo image %s in Docker daemon: %s", algoImageName, err)
+	}
+	algo.Close()
+	defer releaseAlgoImage()
+
+	// Pulling datasets
+	datasets := make([]dataset, 0, len(trainData)+len(testData))
+	for _, dataID := range trainData {
+		datasets = append(datasets, dataset{kind: "train", id: dataID, folder: trainFolder})
+	}
+	for _, dataID := range testData {
+		datasets = append(datasets, dataset{kind: "test", id: dataID, folder: testFolder})
+	}
+	if err = w.pullDatasets(ctx, datasets); err != nil {
+		return nil, err
+	}
+
+	// The algo container mustn't leak the datasets through its logs
+	w.redactLogs(ctx, trainFolder, testFolder)
+
+	// Let's copy test data into untargetedTestFolder and remove targets
+	_, err = w.UntargetTestingVolume(ctx, problemImageName, testFolder, untargetedTestFolder)
+	if err != nil {
+		return nil, NewTaskError(ErrorClassRuntime, "Error preparing problem %s for model %s: %s", problem, modelID, err)
+	}
+
+	// Let's have the model predict the targets of the test data, and of its train data as the
+	// train step would have
+	if len(trainData) > 0 {
+		_, err = w.Predict(ctx, algoImageName, trainFolder, trainPredFolder, modelFolder)
+		if err != nil {
+			return nil, NewTaskError(ErrorClassSubmission, "Error predicting train data with model %s: %s", modelID, err)
+		}
+	}
+	_, err = w.Predict(ctx, algoImageName, untargetedTestFolder, predFolder, modelFolder)
+	if err != nil {
+		return nil, NewTaskError(ErrorClassSubmission, "Error predicting test data with model %s: %s", modelID, err)
+	}
+
+	// Let's compute the performance
+	_, perfErr = w.ComputePerf(ctx, problemImageName, trainFolder, testFolder, untargetedTestFolder, perfFolder)
+	return perfErr, nil
+}
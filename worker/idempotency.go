@@ -0,0 +1,105 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+)
+
+// NSQ delivers messages at least once: a task can be delivered again while it's still running
+// (e.g. after a timeout) or after it's been completed. The helpers below let workers skip such
+// duplicates.
+
+// finalLearnupletStatuses are the statuses of learnuplets that are not to be computed again
+var finalLearnupletStatuses = []string{common.TaskStatusDone, common.TaskStatusFailed, TaskStatusPerfFailed}
+
+// learnupletStatus tells if a learnuplet has one of the given statuses on the peer, and which
+func (w *Worker) learnupletStatus(ctx context.Context, key string, statuses []string) (string, error) {
+	for _, status := range statuses {
+		var learnupletsBytes []byte
+		err := traceCall(ctx, "peer.QueryStatusLearnuplet", func() (err error) {
+			learnupletsBytes, err = w.peer.QueryStatusLearnuplet(status)
+			return err
+		}, tracing.AttributeTask.String(key))
+		if err != nil {
+			return "", fmt.Errorf("Error querying learnuplets with status %s: %s", status, err)
+		}
+
+		var learnuplets []struct {
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal(learnupletsBytes, &learnuplets); err != nil {
+			return "", fmt.Errorf("Error un-marshaling learnuplets with status %s: %s -- Body: %s", status, err, learnupletsBytes)
+		}
+		for _, learnuplet := range learnuplets {
+			if learnuplet.Key == key {
+				return status, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// duplicateLearn tells if a learnuplet has already been computed (and why). Tasks running on
+// this worker are caught by startTask, and running tasks are touched so that the broker doesn't
+// deliver them elsewhere. The peer is only checked on a best-effort basis: if it can't be
+// reached, the learnuplet isn't considered as a duplicate.
+func (w *Worker) duplicateLearn(ctx context.Context, task common.Learnuplet) (duplicate bool, reason string) {
+	status, err := w.learnupletStatus(ctx, task.Key, finalLearnupletStatuses)
+	if err != nil {
+		logging.FromContext(ctx).Warningf("Can't check if %s is a duplicate on the peer: %s", task.Key, err)
+	} else if status != "" {
+		return true, fmt.Sprintf("status is already %s on the peer", status)
+	}
+	return false, ""
+}
+
+// modelPosted tells if the model a learnuplet trains has already been posted to storage, by a
+// delivery that failed or was interrupted before its result reached the peer. Such learnuplets
+// needn't be trained again: only their performance is left to compute and report.
+func (w *Worker) modelPosted(ctx context.Context, task common.Learnuplet) bool {
+	err := traceCall(ctx, "storage.GetModel", func() error {
+		_, err := w.storage.GetModel(task.ModelEnd)
+		return err
+	}, tracing.AttributeTask.String(task.Key))
+	return err == nil
+}
@@ -0,0 +1,350 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// ImageRegistry keeps track of the problem workflow and algo images loaded in the container
+// runtime, so that tasks share them instead of building them again and again. Images are keyed by
+// the digest of their build context and reference-counted: unused images are kept loaded and
+// unloaded in least recently used order once the build contexts of the loaded images weigh more
+// than the registry's size limit.
+type ImageRegistry struct {
+	runtime common.ContainerRuntime
+	tmpDir  string
+	maxSize int64
+
+	lock   sync.Mutex
+	images map[string]*registeredImage // By digest
+	unused *list.List                  // Most recently released images first
+	size   int64
+}
+
+type registeredImage struct {
+	name      string
+	digest    string
+	size      int64
+	refs      int
+	ready     chan struct{} // Closed once the image has been loaded (or failed to be loaded)
+	err       error
+	elem      *list.Element // Set while the image is unused
+	unloading chan struct{} // Set while the image is being unloaded, closed once it's unloaded
+}
+
+// ImageLister is implemented by container runtimes that can list the images they hold, by name
+type ImageLister interface {
+	ListImages() ([]string, error)
+}
+
+// NewImageRegistry creates an image registry. Build contexts are spooled to tmpDir to compute their
+// digest.
+func NewImageRegistry(runtime common.ContainerRuntime, tmpDir string, maxSize int64) *ImageRegistry {
+	return &ImageRegistry{
+		runtime: runtime,
+		tmpDir:  tmpDir,
+		maxSize: maxSize,
+		images:  make(map[string]*registeredImage),
+		unused:  list.New(),
+	}
+}
+
+// Acquire returns the name of an image loaded from a build context, calling load to load it under
+// the given name unless an image with the same build context is loaded already. The build context
+// is read entirely before load is called, so that readers failing at their end (such as
+// ChecksumReader) never get loaded. The image can't be unloaded until release is called.
+func (r *ImageRegistry) Acquire(ctx context.Context, name string, buildContext io.Reader, load func(name string, buildContext io.Reader) error) (imageName string, release func(), err error) {
+	spool, digest, size, err := spoolBuildContext(r.tmpDir, buildContext)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error spooling build context of image %s: %s", name, err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	return r.acquire(ctx, name, spool, digest, size, load)
+}
+
+// acquire returns the name of an image loaded from a spooled build context
+func (r *ImageRegistry) acquire(ctx context.Context, name string, spool io.Reader, digest string, size int64, load func(name string, buildContext io.Reader) error) (imageName string, release func(), err error) {
+	r.lock.Lock()
+	img, ok := r.images[digest]
+	// Images being unloaded are loaded again once they're gone
+	for ok && img.unloading != nil {
+		unloading := img.unloading
+		r.lock.Unlock()
+		select {
+		case <-unloading:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+		r.lock.Lock()
+		img, ok = r.images[digest]
+	}
+	if ok {
+		if img.elem != nil {
+			r.unused.Remove(img.elem)
+			img.elem = nil
+		}
+		img.refs++
+		r.lock.Unlock()
+
+		select {
+		case <-img.ready:
+		case <-ctx.Done():
+			r.release(img)
+			return "", nil, ctx.Err()
+		}
+		if img.err != nil {
+			r.release(img)
+			return "", nil, img.err
+		}
+		logging.FromContext(ctx).Debugf("Reusing image %s for %s", img.name, name)
+		return img.name, r.releaser(img), nil
+	}
+
+	img = &registeredImage{
+		name:   name,
+		digest: digest,
+		size:   size,
+		refs:   1,
+		ready:  make(chan struct{}),
+	}
+	r.images[digest] = img
+	r.lock.Unlock()
+
+	err = load(name, spool)
+
+	r.lock.Lock()
+	if err != nil {
+		delete(r.images, digest)
+		img.err = err
+	} else {
+		r.size += size
+	}
+	close(img.ready)
+	r.lock.Unlock()
+
+	if err != nil {
+		return "", nil, err
+	}
+	return name, r.releaser(img), nil
+}
+
+// Size returns the total size of the build contexts of the loaded images
+func (r *ImageRegistry) Size() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.size
+}
+
+// Reconcile unloads the images named after one of the given prefixes that the container runtime
+// holds but the registry doesn't know about (e.g. images left behind by a worker that crashed).
+// It's meant to be called when the worker starts, before it runs any task.
+func (r *ImageRegistry) Reconcile(prefixes ...string) error {
+	lister, ok := r.runtime.(ImageLister)
+	if !ok {
+		return nil
+	}
+	names, err := lister.ListImages()
+	if err != nil {
+		return fmt.Errorf("Error listing images: %s", err)
+	}
+
+	r.lock.Lock()
+	known := make(map[string]bool, len(r.images))
+	for _, img := range r.images {
+		known[img.name] = true
+	}
+	r.lock.Unlock()
+
+	logger := logging.Default().With(logging.FieldComponent, "images")
+	for _, name := range names {
+		if known[imageRepository(name)] || !hasImagePrefix(name, prefixes) {
+			continue
+		}
+		logger.Infof("Unloading leftover image %s", name)
+		if err := r.runtime.ImageUnload(name); err != nil {
+			logger.Warningf("Error unloading leftover image %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// imageRepository strips the tag of an image name, if it has one
+func imageRepository(name string) string {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i]
+	}
+	return name
+}
+
+func hasImagePrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// spoolBuildContext copies a build context to a temporary file in dir, computing its SHA-256
+// digest. The file is rewound and must be closed and removed by the caller.
+func spoolBuildContext(dir string, buildContext io.Reader) (spool *os.File, digest string, size int64, err error) {
+	spool, err = ioutil.TempFile(dir, ".image-")
+	if err != nil {
+		return nil, "", 0, err
+	}
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(spool, hash), buildContext)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, "", 0, err
+	}
+	return spool, hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+func (r *ImageRegistry) releaser(img *registeredImage) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { r.release(img) })
+	}
+}
+
+func (r *ImageRegistry) release(img *registeredImage) {
+	r.lock.Lock()
+	img.refs--
+	if img.refs > 0 || img.err != nil {
+		r.lock.Unlock()
+		return
+	}
+	img.elem = r.unused.PushFront(img)
+	victims := r.gc()
+	r.lock.Unlock()
+
+	r.unload(victims)
+}
+
+// gc picks the unused images to unload, least recently used first, until the registry fits in its
+// size limit. r.lock must be held. Picked images stay registered, as being unloaded, until unload
+// is done with them: they can't be loaded again in the meantime.
+func (r *ImageRegistry) gc() (victims []*registeredImage) {
+	for r.size > r.maxSize && r.unused.Len() > 0 {
+		img := r.unused.Remove(r.unused.Back()).(*registeredImage)
+		img.elem = nil
+		img.unloading = make(chan struct{})
+		r.size -= img.size
+		victims = append(victims, img)
+	}
+	return victims
+}
+
+// unload unloads the images picked by gc from the container runtime, without holding r.lock
+func (r *ImageRegistry) unload(victims []*registeredImage) {
+	logger := logging.Default().With(logging.FieldComponent, "images")
+	for _, img := range victims {
+		logger.Debugf("Unloading image %s (%d bytes)", img.name, img.size)
+		if err := r.runtime.ImageUnload(img.name); err != nil {
+			logger.Warningf("Error unloading image %s: %s", img.name, err)
+		}
+
+		r.lock.Lock()
+		delete(r.images, img.digest)
+		close(img.unloading)
+		r.lock.Unlock()
+	}
+}
+
+// SetImageRegistry makes the worker share the images it loads across tasks (nil unloads images as
+// soon as their task is done)
+func (w *Worker) SetImageRegistry(images *ImageRegistry) {
+	w.images = images
+}
+
+// loadImage loads an image from a problem workflow or algo blob and returns the name of the loaded
+// image along with a function to call once it isn't used anymore. The blob is spooled and checked
+// against its checksum before anything is sent to the container runtime.
+func (w *Worker) loadImage(ctx context.Context, name string, blob *ChecksumReader) (imageName string, release func(), err error) {
+	defer w.metrics.timeStep(StepImageLoad)()
+	ctx, span := startStepSpan(ctx, StepImageLoad)
+	defer func() { tracing.End(span, err) }()
+
+	spool, digest, size, err := spoolBuildContext(w.dataFolder, blob)
+	if verifyErr := blob.Verify(); verifyErr != nil {
+		if err == nil {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+		return name, nil, verifyErr
+	}
+	if err != nil {
+		return name, nil, fmt.Errorf("Error spooling build context of image %s: %s", name, err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	load := func(name string, buildContext io.Reader) error {
+		return w.ImageLoad(ctx, name, buildContext)
+	}
+	if w.images == nil {
+		if err := load(name, spool); err != nil {
+			return name, nil, err
+		}
+		return name, func() { w.containerRuntime.ImageUnload(name) }, nil
+	}
+	imageName, release, err = w.images.acquire(ctx, name, spool, digest, size, load)
+	if err != nil {
+		return name, nil, err
+	}
+	return imageName, release, nil
+}
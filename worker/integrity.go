@@ -0,0 +1,218 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/client"
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// blobKind tells how to pull a kind of blob and its metadata from storage
+type blobKind struct {
+	name     string
+	cached   bool
+	metadata func(storage client.Storage, id uuid.UUID) (interface{}, error)
+	blob     func(storage client.Storage, id uuid.UUID) (io.ReadCloser, error)
+}
+
+var (
+	problemBlob = blobKind{
+		name:     "problem",
+		cached:   true,
+		metadata: func(s client.Storage, id uuid.UUID) (interface{}, error) { return s.GetProblemWorkflow(id) },
+		blob:     func(s client.Storage, id uuid.UUID) (io.ReadCloser, error) { return s.GetProblemWorkflowBlob(id) },
+	}
+	algoBlob = blobKind{
+		name:     "algo",
+		cached:   true,
+		metadata: func(s client.Storage, id uuid.UUID) (interface{}, error) { return s.GetAlgo(id) },
+		blob:     func(s client.Storage, id uuid.UUID) (io.ReadCloser, error) { return s.GetAlgoBlob(id) },
+	}
+	dataBlob = blobKind{
+		name:     "data",
+		cached:   true,
+		metadata: func(s client.Storage, id uuid.UUID) (interface{}, error) { return s.GetData(id) },
+		blob:     func(s client.Storage, id uuid.UUID) (io.ReadCloser, error) { return s.GetDataBlob(id) },
+	}
+	modelBlob = blobKind{
+		name:     "model",
+		metadata: func(s client.Storage, id uuid.UUID) (interface{}, error) { return s.GetModel(id) },
+		blob:     func(s client.Storage, id uuid.UUID) (io.ReadCloser, error) { return s.GetModelBlob(id) },
+	}
+)
+
+// MetadataChecksum returns the SHA-256 checksum (hex-encoded) found in the storage metadata of a
+// blob, or an empty string if there's none. Metadata types don't share a checksum accessor, so
+// let's look for it in their JSON representation, as served by storage.
+func MetadataChecksum(metadata interface{}) (string, error) {
+	raw, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	var fields struct {
+		Checksum string `json:"checksum"`
+	}
+	if err = json.Unmarshal(raw, &fields); err != nil {
+		return "", err
+	}
+	return strings.ToLower(fields.Checksum), nil
+}
+
+// ChecksumReader computes the SHA-256 hash of a blob while it's being read. Reading the end of the
+// blob fails if it doesn't match the blob's checksum (a retryable storage error).
+type ChecksumReader struct {
+	blob     io.ReadCloser
+	kind     string
+	id       uuid.UUID
+	expected string
+	hash     hash.Hash
+	checked  bool
+	err      error
+}
+
+// NewChecksumReader wraps a blob of a given kind to check it against a checksum (blobs with an
+// empty checksum aren't checked)
+func NewChecksumReader(blob io.ReadCloser, kind string, id uuid.UUID, checksum string) *ChecksumReader {
+	return &ChecksumReader{
+		blob:     blob,
+		kind:     kind,
+		id:       id,
+		expected: checksum,
+		hash:     sha256.New(),
+	}
+}
+
+func (r *ChecksumReader) Read(p []byte) (int, error) {
+	n, err := r.blob.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.expected != "" {
+		if err := r.check(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// Verify reads what's left of the blob (consumers such as tar readers may stop before its end) and
+// checks it against its checksum
+func (r *ChecksumReader) Verify() error {
+	if r.expected == "" {
+		return nil
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return wrapTaskError(err, ErrorClassStorage, "Error reading %s %s from storage: %s", r.kind, r.id, err)
+	}
+	return r.check()
+}
+
+// Close closes the underlying blob
+func (r *ChecksumReader) Close() error {
+	return r.blob.Close()
+}
+
+func (r *ChecksumReader) check() error {
+	if r.checked {
+		return r.err
+	}
+	r.checked = true
+
+	actual := hex.EncodeToString(r.hash.Sum(nil))
+	if actual != r.expected {
+		logging.Default().With(logging.FieldComponent, "storage").Warningf("Checksum mismatch for %s %s: expected %s, got %s", r.kind, r.id, r.expected, actual)
+		r.err = NewTaskError(ErrorClassStorage, "Checksum mismatch for %s %s: expected %s, got %s", r.kind, r.id, r.expected, actual)
+	}
+	return r.err
+}
+
+// SetRequireChecksums makes tasks fail when a blob they pull has no checksum in its storage
+// metadata (such blobs are pulled without being verified otherwise)
+func (w *Worker) SetRequireChecksums(require bool) {
+	w.requireChecksums = require
+}
+
+// pullBlob returns a function pulling a blob from storage and checking it against the checksum in
+// its metadata, along with that checksum. Errors are left unclassified, except for required
+// checksums that are missing: no retry would fix those, they're task errors.
+func (w *Worker) pullBlob(ctx context.Context, kind blobKind, id uuid.UUID) (pull func() (*ChecksumReader, error), checksum string, err error) {
+	var metadata interface{}
+	err = traceCall(ctx, "storage.metadata", func() (err error) {
+		metadata, err = kind.metadata(w.storage, id)
+		return err
+	}, tracing.AttributeBlobKind.String(kind.name), tracing.AttributeBlobID.String(id.String()))
+	if err != nil {
+		return nil, "", fmt.Errorf("Error retrieving %s %s metadata: %s", kind.name, id, err)
+	}
+	checksum, err = MetadataChecksum(metadata)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading %s %s checksum: %s", kind.name, id, err)
+	}
+	if checksum == "" {
+		if w.requireChecksums {
+			return nil, "", NewTaskError(ErrorClassTask, "No checksum for %s %s in its storage metadata", kind.name, id)
+		}
+		logging.FromContext(ctx).Warningf("No checksum for %s %s, it won't be verified", kind.name, id)
+		w.metrics.countUnverified(kind.name)
+	}
+
+	get := func(id uuid.UUID) (blob io.ReadCloser, err error) {
+		err = traceCall(ctx, "storage.blob", func() (err error) {
+			blob, err = kind.blob(w.storage, id)
+			return err
+		}, tracing.AttributeBlobKind.String(kind.name), tracing.AttributeBlobID.String(id.String()))
+		return blob, err
+	}
+	pull = func() (*ChecksumReader, error) {
+		blob, err := getBlob(ctx, get, id)
+		if err != nil {
+			return nil, err
+		}
+		return NewChecksumReader(w.metrics.countDownload(blob), kind.name, id, checksum), nil
+	}
+	return pull, checksum, nil
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errTaskRunning    = errors.New("task already running on this worker")
+	errWorkerDraining = errors.New("worker is draining")
+)
+
+// startTask marks a task as running on this worker. It fails if the task is already running or if
+// the worker is draining.
+func (w *Worker) startTask(kind, key, messageID string) (*runningTask, error) {
+	w.inFlightLock.Lock()
+	defer w.inFlightLock.Unlock()
+
+	if w.draining {
+		return nil, errWorkerDraining
+	}
+	if w.inFlight == nil {
+		w.inFlight = make(map[string]*runningTask)
+	}
+	if w.inFlight[key] != nil {
+		return nil, errTaskRunning
+	}
+	task := &runningTask{kind: kind, key: key, messageID: messageID, started: time.Now()}
+	w.inFlight[key] = task
+	return task, nil
+}
+
+// endTask marks a task as not running anymore on this worker and records its outcome, given the
+// error returned by its handler
+func (w *Worker) endTask(task *runningTask, handlerErr error) {
+	w.inFlightLock.Lock()
+	defer w.inFlightLock.Unlock()
+
+	delete(w.inFlight, task.key)
+	if w.history == nil {
+		w.history = newTaskHistory(DefaultStatusHistorySize)
+	}
+	w.history.add(task.outcome(handlerErr, time.Now()))
+	if w.draining && len(w.inFlight) == 0 {
+		close(w.drained)
+	}
+}
+
+// Drain stops accepting new tasks and waits for the running ones to complete. Tasks still running
+// after gracePeriod are interrupted: their status is set back to todo on the peer and they're
+// handed back to the broker. Drain returns once no task is running anymore.
+func (w *Worker) Drain(gracePeriod time.Duration) {
+	w.inFlightLock.Lock()
+	if !w.draining {
+		w.draining = true
+		w.drained = make(chan struct{})
+		if len(w.inFlight) == 0 {
+			close(w.drained)
+		}
+	}
+	drained := w.drained
+	running := len(w.inFlight)
+	w.inFlightLock.Unlock()
+
+	w.logger().Infof("Draining worker: waiting up to %s for %d running task(s)", gracePeriod, running)
+	select {
+	case <-drained:
+		w.logger().Infof("Worker drained")
+		return
+	case <-time.After(gracePeriod):
+	}
+
+	w.logger().Infof("Drain grace period is over, interrupting running tasks")
+	w.Stop()
+	<-drained
+	w.logger().Infof("Worker drained")
+}
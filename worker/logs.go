@@ -0,0 +1,380 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// DefaultStepLogsMaxSize is the default size limit of the output kept for each workflow step
+const DefaultStepLogsMaxSize = 1 << 20
+
+// DefaultLogsFolderMaxSize is the default size limit of the task logs kept in the logs folder
+const DefaultLogsFolderMaxSize = 1 << 30
+
+// ArtifactStorage is implemented by storage clients that can store the artifacts of a task (such
+// as its logs) under the task's key
+type ArtifactStorage interface {
+	PostArtifact(key, name string, blobReader io.Reader, size int64) (artifactID string, err error)
+}
+
+// LogRuntime is implemented by container runtimes that can return the output of the containers
+// they ran and remove them (such as DockerRuntime). On such runtimes, the containers of workflow
+// steps are run without autoRemove so that we can collect their logs, and removed afterwards.
+type LogRuntime interface {
+	ContainerLogs(containerID string) (io.ReadCloser, error)
+	RemoveContainer(containerID string) error
+}
+
+// stepLog holds the output of the container ran for a workflow step. The output of untrusted
+// containers is either redacted or withheld.
+type stepLog struct {
+	step        string
+	containerID string
+	output      []byte
+	truncated   int64
+	filter      string
+}
+
+// TaskLogs collects the output of the containers ran for a task, capped for each step. The output
+// of untrusted (algo) containers is withheld, unless the task sets a redactor: redaction is best
+// effort, and can't prevent an algo from exfiltrating hidden data through its logs.
+type TaskLogs struct {
+	key     string
+	maxSize int64
+
+	lock     sync.Mutex
+	steps    []stepLog
+	redactor LogRedactor
+
+	// Number of steps the logs had when they were last saved, and artifact they were uploaded as
+	// then (if they were)
+	savedSteps int
+	artifactID string
+}
+
+// NewTaskLogs creates an empty log collection for a task, keeping up to maxSize bytes of output for
+// each step
+func NewTaskLogs(key string, maxSize int64) *TaskLogs {
+	if maxSize <= 0 {
+		maxSize = DefaultStepLogsMaxSize
+	}
+	return &TaskLogs{key: key, maxSize: maxSize}
+}
+
+// SetRedactor sets the redactor applied to the output of untrusted containers
+func (l *TaskLogs) SetRedactor(redactor LogRedactor) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.redactor = redactor
+}
+
+// collect reads (and redacts if it's untrusted) the output of a step's container
+func (l *TaskLogs) collect(step, containerID string, untrusted bool, output io.Reader) error {
+	captured, err := ioutil.ReadAll(io.LimitReader(output, l.maxSize))
+	if err != nil {
+		return err
+	}
+	truncated, err := io.Copy(ioutil.Discard, output)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry := stepLog{step: step, containerID: containerID, truncated: truncated}
+	if untrusted {
+		if l.redactor == nil {
+			entry.filter = "withheld"
+			captured = []byte(fmt.Sprintf("[output of untrusted container withheld: %d bytes]\n", int64(len(captured))+truncated))
+			entry.truncated = 0
+		} else {
+			entry.filter = "redacted"
+			captured = l.redactor.Redact(captured)
+		}
+	}
+	entry.output = captured
+	l.steps = append(l.steps, entry)
+	return nil
+}
+
+// Bytes renders the collected logs, step by step
+func (l *TaskLogs) Bytes() []byte {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var buf bytes.Buffer
+	for _, entry := range l.steps {
+		fmt.Fprintf(&buf, "=== %s (container %s", entry.step, entry.containerID)
+		if entry.filter != "" {
+			fmt.Fprintf(&buf, ", %s", entry.filter)
+		}
+		if entry.truncated > 0 {
+			fmt.Fprintf(&buf, ", %d bytes truncated", entry.truncated)
+		}
+		buf.WriteString(") ===\n")
+		buf.Write(entry.output)
+		if len(entry.output) > 0 && entry.output[len(entry.output)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+type taskLogsKey struct{}
+
+// WithTaskLogs returns a context in which the containers ran for workflow steps have their output
+// collected in logs
+func WithTaskLogs(ctx context.Context, logs *TaskLogs) context.Context {
+	return context.WithValue(ctx, taskLogsKey{}, logs)
+}
+
+// taskLogsFrom returns the logs collected in ctx (nil if there aren't any)
+func taskLogsFrom(ctx context.Context) *TaskLogs {
+	logs, _ := ctx.Value(taskLogsKey{}).(*TaskLogs)
+	return logs
+}
+
+// SetLogsFolder sets the folder where the logs of tasks are kept when storage can't store them
+// (empty to drop them)
+func (w *Worker) SetLogsFolder(folder string) {
+	w.logsFolder = folder
+}
+
+// SetLogsFolderMaxSize sets the size limit of the task logs kept in the logs folder: the oldest
+// ones are removed once it's exceeded (0 keeps them all)
+func (w *Worker) SetLogsFolderMaxSize(maxSize int64) {
+	w.logsFolderMaxSize = maxSize
+}
+
+// SetStepLogsMaxSize sets the size limit of the output kept for each workflow step
+func (w *Worker) SetStepLogsMaxSize(maxSize int64) {
+	w.stepLogsMaxSize = maxSize
+}
+
+// newTaskLogs creates the log collection of a task
+func (w *Worker) newTaskLogs(key string) *TaskLogs {
+	return NewTaskLogs(key, w.stepLogsMaxSize)
+}
+
+// runStep runs a workflow step's container and collects its output in the logs of ctx, if any and
+// if the container runtime can return it. Untrusted containers are the ones running user code.
+func (w *Worker) runStep(ctx context.Context, step string, untrusted bool, imageName string, args []string, mounts map[string]string, autoRemove bool) (containerID string, err error) {
+	ctx, span := startStepSpan(ctx, step)
+	logger := logging.FromContext(ctx).Start(step)
+	logger.Debugf("Running %s step in image %s", step, imageName)
+	defer func() {
+		w.metrics.observeStep(step, logger.Elapsed())
+		tracing.End(span, err)
+		if err != nil {
+			logger.With(logging.FieldError, err.Error()).Warningf("%s step failed", step)
+			return
+		}
+		logger.Infof("%s step done", step)
+	}()
+
+	logs := taskLogsFrom(ctx)
+	runtime, ok := w.containerRuntime.(LogRuntime)
+	if logs == nil || !ok {
+		return w.runContainer(ctx, imageName, args, mounts, autoRemove)
+	}
+
+	containerID, err = w.runContainer(ctx, imageName, args, mounts, false)
+	if containerID == "" {
+		return containerID, err
+	}
+
+	if output, logsErr := runtime.ContainerLogs(containerID); logsErr != nil {
+		logger.Warningf("Error retrieving logs of container %s (%s step): %s", containerID, step, logsErr)
+	} else {
+		if collectErr := logs.collect(step, containerID, untrusted, output); collectErr != nil {
+			logger.Warningf("Error reading logs of container %s (%s step): %s", containerID, step, collectErr)
+		}
+		output.Close()
+	}
+
+	if autoRemove {
+		if removeErr := runtime.RemoveContainer(containerID); removeErr != nil {
+			logger.Warningf("Error removing container %s: %s", containerID, removeErr)
+		}
+	}
+	return containerID, err
+}
+
+// saveLogs uploads a task's logs to storage as an artifact under the task key, and returns its
+// ID. If the storage client can't store artifacts (or fails to), they're written in the logs
+// folder instead, as <task key>.log, and no ID is returned. Logs that haven't changed since they
+// were last saved aren't saved again.
+func (w *Worker) saveLogs(logs *TaskLogs) (artifactID string) {
+	if logs == nil {
+		return ""
+	}
+	logs.lock.Lock()
+	steps, savedSteps, artifactID := len(logs.steps), logs.savedSteps, logs.artifactID
+	logs.lock.Unlock()
+	if steps == 0 || steps == savedSteps {
+		return artifactID
+	}
+	content := logs.Bytes()
+	logger := w.logger().With(logging.FieldTask, logs.key)
+
+	if storage, ok := w.storage.(ArtifactStorage); ok {
+		artifactID, err := storage.PostArtifact(logs.key, "logs", bytes.NewReader(content), int64(len(content)))
+		if err == nil {
+			logs.lock.Lock()
+			logs.savedSteps, logs.artifactID = steps, artifactID
+			logs.lock.Unlock()
+			logger.Infof("Logs of %s uploaded to storage as artifact %s", logs.key, artifactID)
+			return artifactID
+		}
+		logger.Warningf("Error uploading logs of %s to storage, keeping them locally: %s", logs.key, err)
+	}
+
+	if w.logsFolder == "" {
+		return ""
+	}
+	logPath := filepath.Join(w.logsFolder, fmt.Sprintf("%s.log", logs.key))
+	if err := os.MkdirAll(w.logsFolder, 0755); err != nil {
+		logger.Warningf("Error creating logs folder %s: %s", w.logsFolder, err)
+		return ""
+	}
+	if err := ioutil.WriteFile(logPath, content, 0644); err != nil {
+		logger.Warningf("Error writing logs of %s to %s: %s", logs.key, logPath, err)
+		return ""
+	}
+	logs.lock.Lock()
+	logs.savedSteps, logs.artifactID = steps, ""
+	logs.lock.Unlock()
+	logger.Infof("Logs of %s kept in %s", logs.key, logPath)
+	w.pruneLogs(logPath)
+	return ""
+}
+
+// pruneLogs removes the oldest task logs from the logs folder until they fit in its size limit.
+// The logs that were just written (kept) are left alone, even if they don't fit on their own.
+func (w *Worker) pruneLogs(kept string) {
+	if w.logsFolderMaxSize <= 0 {
+		return
+	}
+	w.logsFolderLock.Lock()
+	defer w.logsFolderLock.Unlock()
+
+	logger := w.logger()
+	files, err := ioutil.ReadDir(w.logsFolder)
+	if err != nil {
+		logger.Warningf("Error listing logs folder %s: %s", w.logsFolder, err)
+		return
+	}
+	var size int64
+	logFiles := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		if file.Mode().IsRegular() && filepath.Ext(file.Name()) == ".log" {
+			logFiles = append(logFiles, file)
+			size += file.Size()
+		}
+	}
+	sort.Slice(logFiles, func(i, j int) bool { return logFiles[i].ModTime().Before(logFiles[j].ModTime()) })
+
+	for _, file := range logFiles {
+		if size <= w.logsFolderMaxSize {
+			return
+		}
+		path := filepath.Join(w.logsFolder, file.Name())
+		if path == kept {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Warningf("Error removing logs %s: %s", path, err)
+			continue
+		}
+		size -= file.Size()
+		logger.Debugf("Removed logs %s to fit in %d bytes", path, w.logsFolderMaxSize)
+	}
+}
+
+// reportLogs references the artifact holding a task's logs on the peer (if they were uploaded).
+// The peer client has no dedicated method for it, so we invoke the chaincode directly.
+func (w *Worker) reportLogs(ctx context.Context, key, artifactID string) error {
+	if artifactID == "" {
+		return nil
+	}
+	return traceCall(ctx, "peer.reportLogs", func() error {
+		_, _, err := w.peer.Invoke("reportLogs", []string{key, artifactID})
+		return err
+	}, tracing.AttributeTask.String(key))
+}
+
+// saveAndReportLogs saves a task's logs and references them on the peer, before its failure is
+// reported. Errors are only logged: they mustn't keep the failure from being reported.
+func (w *Worker) saveAndReportLogs(ctx context.Context, key string, logs *TaskLogs) {
+	if err := w.reportLogs(ctx, key, w.saveLogs(logs)); err != nil {
+		logging.FromContext(ctx).Warningf("Error referencing logs of %s on the peer: %s", key, err)
+	}
+}
+
+// SetRedactUntrustedLogs makes the worker keep the output of untrusted containers, redacted,
+// instead of withholding it. Redaction is best effort: short tokens and data transformed by the
+// algo go through.
+func (w *Worker) SetRedactUntrustedLogs(redact bool) {
+	w.redactUntrustedLogs = redact
+}
+
+// redactLogs sets the redactor of the logs of ctx if the worker keeps the output of untrusted
+// containers, hiding the data found in folders from it. If the data can't be indexed, their output
+// stays withheld.
+func (w *Worker) redactLogs(ctx context.Context, folders ...string) {
+	logs := taskLogsFrom(ctx)
+	if _, ok := w.containerRuntime.(LogRuntime); logs == nil || !ok || !w.redactUntrustedLogs {
+		return
+	}
+	redactor, err := NewDataRedactor(folders...)
+	if err != nil {
+		logging.FromContext(ctx).Warningf("Error indexing hidden data of %s, the output of its untrusted containers is withheld: %s", logs.key, err)
+		return
+	}
+	logs.SetRedactor(redactor)
+}
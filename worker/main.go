@@ -36,19 +36,41 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/satori/go.uuid"
 
 	"github.com/MorpheoOrg/morpheo-go-packages/client"
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
 )
 
 func main() {
 	conf := NewConsumerConfig()
 
+	// Let's log JSON lines, one per event, so that they can be joined by task key with the API's
+	logLevel, err := logging.ParseLevel(conf.LogLevel)
+	if err != nil {
+		logging.Default().Panicf("Impossible to parse log level: %s", err)
+	}
+	logging.SetDefault(logging.New(os.Stdout, logLevel))
+	logger := logging.Default().With(logging.FieldComponent, "main")
+
+	// Let's trace tasks from their ingestion by the API to their completion (if we have a collector)
+	shutdownTracing, err := tracing.Setup("compute-worker", conf.OTLPEndpoint)
+	if err != nil {
+		logger.Panicf("Impossible to set tracing up: %s", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Let's connect with Storage (or use our mock if no storage host was provided)
 	var storageBackend client.Storage
 	// if conf.StorageHost != "" {
@@ -70,14 +92,19 @@ func main() {
 		"mycc",
 	)
 	if err != nil {
-		log.Panicf("Error creating peer client: %s", err)
+		logger.Panicf("Error creating peer client: %s", err)
 	}
 
 	// Let's hook to our container backend and create a Worker instance containing
 	// our message handlers
-	containerRuntime, err := common.NewDockerRuntime(conf.DockerTimeout)
+	containerRuntime, err := NewDockerRuntime(conf.DockerTimeout)
+	if err != nil {
+		logger.Panicf("Impossible to connect to Docker container backend: %s", err)
+	}
+
+	archiveCodec, err := CodecFor(conf.ArchiveFormat)
 	if err != nil {
-		log.Panicf("[FATAL ERROR] Impossible to connect to Docker container backend: %s", err)
+		logger.Panicf("%s", err)
 	}
 
 	worker := &Worker{
@@ -98,27 +125,111 @@ func main() {
 		containerRuntime: containerRuntime,
 		storage:          storageBackend,
 		peer:             peer,
+		// Retry policies per error class
+		retryPolicies: conf.RetryPolicies,
+		// Task timeouts
+		learnTimeout:    conf.LearnTimeout,
+		predictTimeout:  conf.PredictTimeout,
+		evaluateTimeout: conf.EvaluateTimeout,
+		// Whether blobs must have a checksum to be pulled
+		requireChecksums: conf.RequireChecksums,
+		// Datasets pulled in parallel
+		downloadParallelism: conf.DownloadParallelism,
+		// What model archives may unpack to, and how we compress them
+		archiveLimits: conf.ArchiveLimits,
+		archiveCodec:  archiveCodec,
+		// How much container output we keep, where we keep it if storage can't and whether we keep
+		// untrusted output
+		stepLogsMaxSize:     conf.StepLogsMaxSize,
+		logsFolder:          conf.LogsFolder,
+		logsFolderMaxSize:   conf.LogsFolderMaxSize,
+		redactUntrustedLogs: conf.RedactUntrustedLogs,
+	}
+
+	// Let's expose our metrics to Prometheus
+	metrics := NewMetrics()
+	metrics.SetParallelism("learn", conf.LearnParallelism)
+	metrics.SetParallelism("predict", conf.PredictParallelism)
+	metrics.SetParallelism("evaluate", conf.EvaluateParallelism)
+	worker.SetMetrics(metrics)
+	if conf.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle(MetricsRoute, metrics.Handler())
+		// Both servers may share the same address
+		if conf.StatusAddress == conf.MetricsAddress {
+			NewStatusServer(worker, conf.Redacted(), conf.AdminUser, conf.AdminPassword).Register(mux)
+		}
+		go func() {
+			logger.Panicf("Error serving metrics on %s: %s", conf.MetricsAddress, http.ListenAndServe(conf.MetricsAddress, mux))
+		}()
 	}
 
+	// Let's tell operators what we're doing, and let them cancel tasks
+	worker.SetStatusHistorySize(conf.StatusHistorySize)
+	if conf.StatusAddress != "" && conf.StatusAddress != conf.MetricsAddress {
+		status := NewStatusServer(worker, conf.Redacted(), conf.AdminUser, conf.AdminPassword)
+		go func() {
+			logger.Panicf("Error serving status on %s: %s", conf.StatusAddress, http.ListenAndServe(conf.StatusAddress, status.Handler()))
+		}()
+	}
+
+	// Let's cache the blobs we pull from storage across tasks
+	if conf.CacheSize > 0 {
+		cache, err := NewBlobCache(conf.CacheFolder, conf.CacheSize)
+		if err != nil {
+			logger.Panicf("Impossible to create blob cache: %s", err)
+		}
+		worker.SetCache(cache)
+		metrics.WatchCache(cache)
+	}
+
+	// Let's share the images we load across tasks
+	images := NewImageRegistry(containerRuntime, worker.dataFolder, conf.ImageCacheSize)
+	if err := images.Reconcile(worker.problemImagePrefix, worker.algoImagePrefix); err != nil {
+		logger.Warningf("Error unloading leftover images: %s", err)
+	}
+	worker.SetImageRegistry(images)
+
 	// Let's hook with our consumer
-	consumer := common.NewNSQConsumer(
+	consumer := NewConsumer(
 		conf.NsqlookupdURLs,
 		conf.NsqdURL,
 		"compute",
 		5*time.Second,
-		log.New(os.Stdout, "[NSQ]", log.LstdFlags),
+		log.New(logging.Default().With(logging.FieldComponent, "nsq").Writer(logging.LevelInfo), "", 0),
 	)
 
 	// Wire our message handlers
-	consumer.AddHandler(common.TrainTopic, worker.HandleLearn, conf.LearnParallelism, conf.LearnTimeout)
-	consumer.AddHandler(common.PredictTopic, worker.HandlePred, conf.PredictParallelism, conf.PredictTimeout)
-
-	if err != nil {
-		log.Panicln(err)
+	handlers := []struct {
+		topic       string
+		handler     TaskHandler
+		parallelism int
+	}{
+		{common.TrainTopic, worker.HandleLearn, conf.LearnParallelism},
+		{common.PredictTopic, worker.HandlePred, conf.PredictParallelism},
+		{EvaluateTopic, worker.HandleEvaluate, conf.EvaluateParallelism},
+	}
+	for _, h := range handlers {
+		if err := consumer.AddHandler(h.topic, h.handler, h.parallelism); err != nil {
+			logger.Panicf("%s", err)
+		}
 	}
+
+	// Let's drain the worker when it's asked to terminate (rolling deploys...). The consumer
+	// stops pulling messages on these signals as well.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		worker.Drain(conf.DrainGracePeriod)
+	}()
+
 	// Let's connect to the for real and start pulling tasks
 	consumer.ConsumeUntilKilled()
 
-	log.Println("[INFO] Consumer has been gracefully stopped... Bye bye!")
+	// Let's wait for the drain to complete (or drain the tasks that may still be running)
+	worker.Drain(conf.DrainGracePeriod)
+
+	worker.logger().Infof("Consumer has been gracefully stopped... Bye bye!")
 	return
 }
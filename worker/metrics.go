@@ -0,0 +1,290 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsRoute is the HTTP route our metrics are exposed on
+const MetricsRoute = "/metrics"
+
+// Workflow steps whose duration is measured
+const (
+	StepImageLoad   = "image_load"
+	StepDataPull    = "data_pull"
+	StepModelUpload = "model_upload"
+)
+
+// Metrics holds the Prometheus metrics of a worker. A nil *Metrics records nothing, so that
+// workers can run without metrics.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	tasksStarted   *prometheus.CounterVec
+	tasksSucceeded *prometheus.CounterVec
+	tasksFailed    *prometheus.CounterVec
+	tasksInFlight  *prometheus.GaugeVec
+	parallelism    *prometheus.GaugeVec
+	stepDuration   *prometheus.HistogramVec
+	downloaded     prometheus.Counter
+	uploaded       prometheus.Counter
+	unverified     *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics of a worker, in their own registry (along with the Go runtime
+// and process metrics)
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		tasksStarted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "worker",
+			Name:      "tasks_started_total",
+			Help:      "Number of tasks started, by kind (learn, predict or evaluate)",
+		}, []string{"kind"}),
+		tasksSucceeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "worker",
+			Name:      "tasks_succeeded_total",
+			Help:      "Number of tasks that succeeded, by kind",
+		}, []string{"kind"}),
+		tasksFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "worker",
+			Name:      "tasks_failed_total",
+			Help:      "Number of task attempts that failed, by kind and error class (retried attempts included)",
+		}, []string{"kind", "class"}),
+		tasksInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "morpheo",
+			Subsystem: "worker",
+			Name:      "tasks_in_flight",
+			Help:      "Number of tasks running, by kind",
+		}, []string{"kind"}),
+		parallelism: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "morpheo",
+			Subsystem: "worker",
+			Name:      "task_parallelism",
+			Help:      "Number of tasks that can run in parallel, by kind",
+		}, []string{"kind"}),
+		stepDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "morpheo",
+			Subsystem: "worker",
+			Name:      "step_duration_seconds",
+			Help:      "Duration of workflow steps, by step",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 14),
+		}, []string{"step"}),
+		downloaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "worker",
+			Name:      "downloaded_bytes_total",
+			Help:      "Number of bytes pulled from storage (cache hits excluded)",
+		}),
+		uploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "worker",
+			Name:      "uploaded_bytes_total",
+			Help:      "Number of bytes sent to storage",
+		}),
+		unverified: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "morpheo",
+			Subsystem: "worker",
+			Name:      "unverified_blobs_total",
+			Help:      "Number of blobs pulled from storage without a checksum to verify them against, by kind",
+		}, []string{"kind"}),
+	}
+	m.registry.MustRegister(
+		m.tasksStarted, m.tasksSucceeded, m.tasksFailed, m.tasksInFlight, m.parallelism,
+		m.stepDuration, m.downloaded, m.uploaded, m.unverified,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler returns an HTTP handler exposing the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// SetParallelism records the number of tasks of a kind that can run in parallel
+func (m *Metrics) SetParallelism(kind string, n int) {
+	if m == nil {
+		return
+	}
+	m.parallelism.WithLabelValues(kind).Set(float64(n))
+}
+
+// taskStarted records a task starting
+func (m *Metrics) taskStarted(kind string) {
+	if m == nil {
+		return
+	}
+	m.tasksStarted.WithLabelValues(kind).Inc()
+	m.tasksInFlight.WithLabelValues(kind).Inc()
+}
+
+// taskEnded records the end of a task, with the error it failed with (if any)
+func (m *Metrics) taskEnded(kind string, err error) {
+	if m == nil {
+		return
+	}
+	m.tasksInFlight.WithLabelValues(kind).Dec()
+	if err != nil {
+		m.tasksFailed.WithLabelValues(kind, string(ErrorClassOf(err))).Inc()
+		return
+	}
+	m.tasksSucceeded.WithLabelValues(kind).Inc()
+}
+
+// observeStep records the duration of a workflow step
+func (m *Metrics) observeStep(step string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.stepDuration.WithLabelValues(step).Observe(duration.Seconds())
+}
+
+// timeStep starts measuring the duration of a workflow step, and returns the function recording it
+func (m *Metrics) timeStep(step string) func() {
+	start := time.Now()
+	return func() { m.observeStep(step, time.Since(start)) }
+}
+
+// countDownload counts the bytes read from a blob pulled from storage
+func (m *Metrics) countDownload(blob io.ReadCloser) io.ReadCloser {
+	if m == nil {
+		return blob
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(blob, counterWriter{m.downloaded}), blob}
+}
+
+// countUpload counts the bytes read from a stream sent to storage
+func (m *Metrics) countUpload(r io.Reader) io.Reader {
+	if m == nil {
+		return r
+	}
+	return io.TeeReader(r, counterWriter{m.uploaded})
+}
+
+// countUploaded counts bytes sent to storage in one go
+func (m *Metrics) countUploaded(n int64) {
+	if m == nil {
+		return
+	}
+	m.uploaded.Add(float64(n))
+}
+
+// countUnverified records a blob pulled without a checksum to verify it against
+func (m *Metrics) countUnverified(kind string) {
+	if m == nil {
+		return
+	}
+	m.unverified.WithLabelValues(kind).Inc()
+}
+
+// counterWriter adds the size of what's written to it to a counter
+type counterWriter struct {
+	counter prometheus.Counter
+}
+
+func (c counterWriter) Write(p []byte) (int, error) {
+	c.counter.Add(float64(len(p)))
+	return len(p), nil
+}
+
+// WatchCache exposes the usage metrics of a blob cache
+func (m *Metrics) WatchCache(cache *BlobCache) {
+	if m == nil || cache == nil {
+		return
+	}
+	m.registry.MustRegister(cacheCollector{cache})
+}
+
+var (
+	cacheHitsDesc = prometheus.NewDesc("morpheo_worker_cache_hits_total",
+		"Number of blob cache lookups that found the blob cached", nil, nil)
+	cacheMissesDesc = prometheus.NewDesc("morpheo_worker_cache_misses_total",
+		"Number of blob cache lookups that pulled the blob from storage", nil, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("morpheo_worker_cache_evictions_total",
+		"Number of blobs evicted from the blob cache", nil, nil)
+	cacheEvictedBytesDesc = prometheus.NewDesc("morpheo_worker_cache_evicted_bytes_total",
+		"Number of bytes evicted from the blob cache", nil, nil)
+	cacheEntriesDesc = prometheus.NewDesc("morpheo_worker_cache_entries",
+		"Number of blobs in the blob cache", nil, nil)
+	cacheSizeDesc = prometheus.NewDesc("morpheo_worker_cache_size_bytes",
+		"Size of the blobs in the blob cache, in bytes", nil, nil)
+)
+
+// cacheCollector reads the usage metrics of a blob cache when they're scraped, so that they're
+// consistent with each other
+type cacheCollector struct {
+	cache *BlobCache
+}
+
+func (c cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheEvictedBytesDesc
+	ch <- cacheEntriesDesc
+	ch <- cacheSizeDesc
+}
+
+func (c cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheEvictedBytesDesc, prometheus.CounterValue, float64(stats.EvictedBytes))
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries))
+	ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(stats.Size))
+}
+
+// SetMetrics makes the worker record its metrics (nil disables them)
+func (w *Worker) SetMetrics(metrics *Metrics) {
+	w.metrics = metrics
+}
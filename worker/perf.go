@@ -0,0 +1,288 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+)
+
+// Versions of the performance.json schema. Files without a version field are version 1 files.
+const (
+	// PerfupletV1 files hold the model's performance and its train and test metrics
+	PerfupletV1 = 1
+	// PerfupletV2 files may also hold per-sample metrics and confidence intervals
+	PerfupletV2 = 2
+)
+
+// Bounds of the performance files written by problem workflows
+const (
+	// Maximum size of a performance file, in bytes
+	maxPerfFileSize = 32 << 20
+	// Maximum number of metrics in each of the train_perf, test_perf, samples and confidence maps
+	maxPerfMetrics = 256
+	// Maximum length of a metric name
+	maxPerfMetricName = 128
+	// Maximum number of values of a per-sample metric
+	maxPerfSamples = 1 << 20
+)
+
+// Perfuplet describes the performance.json file, an output of learning tasks
+type Perfuplet struct {
+	Version   int                `json:"version"`
+	Perf      float64            `json:"perf"`
+	TrainPerf map[string]float64 `json:"train_perf"`
+	TestPerf  map[string]float64 `json:"test_perf"`
+
+	// Per-sample values of some metrics (version 2 and up)
+	Samples map[string][]float64 `json:"samples,omitempty"`
+	// Confidence intervals of some metrics, "perf" standing for the model's performance (version 2
+	// and up)
+	Confidence map[string]Interval `json:"confidence,omitempty"`
+}
+
+// Interval is a confidence interval
+type Interval struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+}
+
+// perfupletFile is what we decode performance files into, to tell missing fields apart from zero
+// values
+type perfupletFile struct {
+	Version    *int                 `json:"version"`
+	Perf       *float64             `json:"perf"`
+	TrainPerf  map[string]float64   `json:"train_perf"`
+	TestPerf   map[string]float64   `json:"test_perf"`
+	Samples    map[string][]float64 `json:"samples"`
+	Confidence map[string]Interval  `json:"confidence"`
+}
+
+// DecodePerfuplet reads and validates a performance file. Fields that aren't part of the schema
+// are rejected.
+func DecodePerfuplet(r io.Reader) (*Perfuplet, error) {
+	lr := &io.LimitedReader{R: r, N: maxPerfFileSize + 1}
+	var file perfupletFile
+	decoder := json.NewDecoder(lr)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		if lr.N <= 0 {
+			return nil, fmt.Errorf("performance file is larger than %d bytes", maxPerfFileSize)
+		}
+		return nil, fmt.Errorf("malformed JSON: %s", err)
+	}
+	if lr.N <= 0 {
+		return nil, fmt.Errorf("performance file is larger than %d bytes", maxPerfFileSize)
+	}
+
+	perfuplet := &Perfuplet{
+		Version:    PerfupletV1,
+		TrainPerf:  file.TrainPerf,
+		TestPerf:   file.TestPerf,
+		Samples:    file.Samples,
+		Confidence: file.Confidence,
+	}
+	if file.Version != nil {
+		perfuplet.Version = *file.Version
+	}
+	if file.Perf == nil {
+		return nil, fmt.Errorf("missing perf field")
+	}
+	perfuplet.Perf = *file.Perf
+	if file.TrainPerf == nil {
+		return nil, fmt.Errorf("missing train_perf field")
+	}
+	if file.TestPerf == nil {
+		return nil, fmt.Errorf("missing test_perf field")
+	}
+
+	if err := perfuplet.Validate(); err != nil {
+		return nil, err
+	}
+	return perfuplet, nil
+}
+
+// readPerfuplet reads and validates the performance file written by a problem workflow in
+// perfFolder. Missing or invalid files are problem errors. The peer only records perf, train_perf
+// and test_perf: the per-sample metrics and confidence intervals of version 2 files are kept on
+// the Perfuplet and logged.
+func (w *Worker) readPerfuplet(ctx context.Context, perfFolder string, problem uuid.UUID) (*Perfuplet, error) {
+	performanceFilePath := filepath.Join(perfFolder, "performance.json")
+	resultFile, err := os.Open(performanceFilePath)
+	if err != nil {
+		return nil, NewTaskError(ErrorClassProblem, "Error reading performance file %s: %s", performanceFilePath, err)
+	}
+	defer resultFile.Close()
+
+	perfuplet, err := DecodePerfuplet(resultFile)
+	if err != nil {
+		return nil, NewTaskError(ErrorClassProblem, "Invalid performance file for problem %s: %s", problem, err)
+	}
+	if len(perfuplet.Samples) > 0 || len(perfuplet.Confidence) > 0 {
+		// Per-sample metrics may hold up to maxPerfSamples values: only their sizes are logged
+		samples := make(map[string]int, len(perfuplet.Samples))
+		for name, values := range perfuplet.Samples {
+			samples[name] = len(values)
+		}
+		logging.FromContext(ctx).With("samples", samples).With("confidence", perfuplet.Confidence).Infof("Performance file for problem %s holds per-sample metrics or confidence intervals", problem)
+	}
+	return perfuplet, nil
+}
+
+// Validate checks that a Perfuplet complies with its schema version
+func (p *Perfuplet) Validate() error {
+	switch p.Version {
+	case PerfupletV1:
+		if p.Samples != nil || p.Confidence != nil {
+			return fmt.Errorf("samples and confidence fields require version %d", PerfupletV2)
+		}
+	case PerfupletV2:
+	default:
+		return fmt.Errorf("unsupported version %d (supported versions: %d to %d)", p.Version, PerfupletV1, PerfupletV2)
+	}
+
+	if err := checkFinite("perf", p.Perf); err != nil {
+		return err
+	}
+	if err := checkMetrics("train_perf", p.TrainPerf); err != nil {
+		return err
+	}
+	if err := checkMetrics("test_perf", p.TestPerf); err != nil {
+		return err
+	}
+
+	if len(p.Samples) > maxPerfMetrics {
+		return fmt.Errorf("samples has %d metrics (max. %d)", len(p.Samples), maxPerfMetrics)
+	}
+	for _, name := range sortedKeys(p.Samples) {
+		values := p.Samples[name]
+		if err := checkMetricName("samples", name); err != nil {
+			return err
+		}
+		if len(values) > maxPerfSamples {
+			return fmt.Errorf("samples.%s has %d values (max. %d)", name, len(values), maxPerfSamples)
+		}
+		for i, value := range values {
+			if err := checkFinite(fmt.Sprintf("samples.%s[%d]", name, i), value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(p.Confidence) > maxPerfMetrics {
+		return fmt.Errorf("confidence has %d metrics (max. %d)", len(p.Confidence), maxPerfMetrics)
+	}
+	for _, name := range sortedKeys(p.Confidence) {
+		interval := p.Confidence[name]
+		if err := checkMetricName("confidence", name); err != nil {
+			return err
+		}
+		if err := checkFinite("confidence."+name+".lower", interval.Lower); err != nil {
+			return err
+		}
+		if err := checkFinite("confidence."+name+".upper", interval.Upper); err != nil {
+			return err
+		}
+		if interval.Lower > interval.Upper {
+			return fmt.Errorf("confidence.%s: lower bound %g is greater than upper bound %g", name, interval.Lower, interval.Upper)
+		}
+	}
+	return nil
+}
+
+func checkMetrics(field string, metrics map[string]float64) error {
+	if len(metrics) > maxPerfMetrics {
+		return fmt.Errorf("%s has %d metrics (max. %d)", field, len(metrics), maxPerfMetrics)
+	}
+	for _, name := range sortedKeys(metrics) {
+		if err := checkMetricName(field, name); err != nil {
+			return err
+		}
+		if err := checkFinite(field+"."+name, metrics[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkMetricName(field, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s has a metric with an empty name", field)
+	}
+	if len(name) > maxPerfMetricName {
+		return fmt.Errorf("%s has a metric name longer than %d bytes", field, maxPerfMetricName)
+	}
+	return nil
+}
+
+func checkFinite(field string, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%s isn't a finite number (%g)", field, value)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a metrics map in order, so that validation errors are
+// deterministic
+func sortedKeys(metrics interface{}) []string {
+	var keys []string
+	switch m := metrics.(type) {
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string][]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]Interval:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
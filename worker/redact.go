@@ -0,0 +1,193 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"bufio"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LogRedactor rewrites the output of untrusted containers before it leaves the worker. Redaction is
+// a mitigation, not a guarantee: it's only used when the worker is told to keep untrusted output.
+type LogRedactor interface {
+	Redact(output []byte) []byte
+}
+
+// Bounds of the data redactor
+const (
+	// Tokens shorter than this are left as is (they'd match pretty much anything): an algo can
+	// leak hidden data by printing it a few characters at a time
+	minRedactedToken = 4
+	// Tokens made of base64/hex characters at least this long are always redacted (encoded data):
+	// shorter runs, or data encoded in any other way, go through
+	minEncodedToken = 32
+	// Size of the token index, in bits
+	redactorIndexBits = 1 << 24
+	// Beyond this amount of hidden data, the redactor gives up on indexing it and redacts every
+	// token it is given
+	maxRedactorIndexedBytes = 256 << 20
+)
+
+var redactedToken = []byte("[REDACTED]")
+
+// dataRedactor redacts the tokens (runs of letters, digits and number punctuation) found in a set
+// of hidden data files, along with anything that looks like encoded data. Tokens are indexed in a
+// fixed-size bitset: collisions only make it redact more than needed. Data the algo transformed
+// (split, rounded, shifted...) isn't recognized.
+type dataRedactor struct {
+	index  []uint64
+	strict bool
+}
+
+// NewDataRedactor indexes the tokens of the files found under a set of folders
+func NewDataRedactor(folders ...string) (LogRedactor, error) {
+	r := &dataRedactor{index: make([]uint64, redactorIndexBits/64)}
+	var indexed int64
+	for _, folder := range folders {
+		err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || r.strict {
+				return nil
+			}
+			if indexed += info.Size(); indexed > maxRedactorIndexedBytes {
+				r.strict = true
+				return nil
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			return r.indexTokens(file)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func isTokenByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_' || c == '+'
+}
+
+func isEncodedByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '/' || c == '='
+}
+
+func (r *dataRedactor) indexTokens(data io.Reader) error {
+	reader := bufio.NewReader(data)
+	var token []byte
+	for {
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			r.add(token)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isTokenByte(c) {
+			token = append(token, c)
+			continue
+		}
+		r.add(token)
+		token = token[:0]
+	}
+}
+
+func tokenHashes(token []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(token)
+	sum := h.Sum64()
+	return sum % redactorIndexBits, (sum >> 32) % redactorIndexBits
+}
+
+func (r *dataRedactor) add(token []byte) {
+	if len(token) < minRedactedToken {
+		return
+	}
+	h1, h2 := tokenHashes(token)
+	r.index[h1/64] |= 1 << (h1 % 64)
+	r.index[h2/64] |= 1 << (h2 % 64)
+}
+
+func (r *dataRedactor) contains(token []byte) bool {
+	if r.strict {
+		return true
+	}
+	h1, h2 := tokenHashes(token)
+	return r.index[h1/64]&(1<<(h1%64)) != 0 && r.index[h2/64]&(1<<(h2%64)) != 0
+}
+
+// Redact replaces the hidden data tokens and encoded data found in output with [REDACTED]
+func (r *dataRedactor) Redact(output []byte) []byte {
+	redacted := make([]byte, 0, len(output))
+	for i := 0; i < len(output); {
+		// Runs of encoded data (base64, hex) are redacted as a whole
+		j := i
+		for j < len(output) && isEncodedByte(output[j]) {
+			j++
+		}
+		if j-i >= minEncodedToken {
+			redacted = append(redacted, redactedToken...)
+			i = j
+			continue
+		}
+
+		j = i
+		for j < len(output) && isTokenByte(output[j]) {
+			j++
+		}
+		if j == i {
+			redacted = append(redacted, output[i])
+			i++
+			continue
+		}
+		if token := output[i:j]; len(token) >= minRedactedToken && r.contains(token) {
+			redacted = append(redacted, redactedToken...)
+		} else {
+			redacted = append(redacted, token...)
+		}
+		i = j
+	}
+	return redacted
+}
@@ -0,0 +1,402 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+)
+
+// Routes of the worker status server
+const (
+	StatusRoute = "/status"
+	// POST /tasks/<task key>/cancel cancels a running task (admin only)
+	TasksRoute = "/tasks/"
+)
+
+// DefaultStatusHistorySize is the default number of finished tasks whose outcome is kept
+const DefaultStatusHistorySize = 100
+
+// Task outcomes
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	OutcomeRequeued  = "requeued"
+	OutcomeCanceled  = "canceled"
+	OutcomeSkipped   = "skipped"
+)
+
+var errTaskNotRunning = errors.New("task isn't running on this worker")
+
+// TaskStatus describes a task running on a worker, or the outcome of a task it has run
+type TaskStatus struct {
+	Key       string     `json:"key"`
+	Kind      string     `json:"kind"`
+	MessageID string     `json:"message_id,omitempty"`
+	Step      string     `json:"step,omitempty"`
+	Started   time.Time  `json:"started"`
+	Ended     *time.Time `json:"ended,omitempty"`
+	// Time elapsed since the task started (or that it took, if it's done), in seconds
+	Elapsed float64 `json:"elapsed"`
+	// Set on running tasks once they've been canceled
+	Canceling  bool       `json:"canceling,omitempty"`
+	Outcome    string     `json:"outcome,omitempty"`
+	ErrorClass ErrorClass `json:"error_class,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// WorkerStatus is a snapshot of what a worker is doing, and of what it has done lately
+type WorkerStatus struct {
+	ID       string       `json:"id"`
+	Draining bool         `json:"draining"`
+	Config   interface{}  `json:"config,omitempty"`
+	Tasks    []TaskStatus `json:"tasks"`
+	History  []TaskStatus `json:"history"`
+}
+
+// runningTask keeps track of a task running on the worker: the step it's at and how to cancel it
+type runningTask struct {
+	kind      string
+	key       string
+	messageID string
+	started   time.Time
+
+	lock     sync.Mutex
+	step     string
+	cancel   context.CancelFunc
+	canceled bool
+	// Set once the task's workflow has returned (tasks skipped before that have no outcome)
+	ended bool
+	err   error
+}
+
+// setStep records the step a task is at (running tasks may be nil)
+func (t *runningTask) setStep(step string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.step = step
+}
+
+// setCancel sets the function canceling the context of a task, calling it right away if the task
+// has already been canceled
+func (t *runningTask) setCancel(cancel context.CancelFunc) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.cancel = cancel
+	if t.canceled {
+		cancel()
+	}
+}
+
+// cancelTask interrupts a task. Tasks that haven't started their workflow yet are interrupted as
+// soon as they do.
+func (t *runningTask) cancelTask() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.canceled = true
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// isCanceled returns true once a task has been canceled
+func (t *runningTask) isCanceled() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.canceled
+}
+
+// end records the outcome of a task's workflow
+func (t *runningTask) end(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.ended, t.err = true, err
+}
+
+// status describes a running task
+func (t *runningTask) status(now time.Time) TaskStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return TaskStatus{
+		Key:       t.key,
+		Kind:      t.kind,
+		MessageID: t.messageID,
+		Step:      t.step,
+		Started:   t.started,
+		Elapsed:   now.Sub(t.started).Seconds(),
+		Canceling: t.canceled,
+	}
+}
+
+// outcome describes a finished task, given the error returned by its handler (non-nil if the task
+// was handed back to the broker)
+func (t *runningTask) outcome(handlerErr error, now time.Time) TaskStatus {
+	status := t.status(now)
+	status.Ended = &now
+	status.Canceling = false
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch {
+	case !t.ended:
+		status.Outcome = OutcomeSkipped
+	case t.err == nil:
+		status.Outcome = OutcomeSucceeded
+	case t.canceled:
+		status.Outcome = OutcomeCanceled
+	case handlerErr != nil:
+		status.Outcome = OutcomeRequeued
+	default:
+		status.Outcome = OutcomeFailed
+	}
+	if t.err != nil {
+		status.ErrorClass = ErrorClassOf(t.err)
+		status.Error = t.err.Error()
+	}
+	return status
+}
+
+type runningTaskKey struct{}
+
+// withRunningTask returns a copy of ctx carrying a running task, whose step is updated by the
+// workflow
+func withRunningTask(ctx context.Context, task *runningTask) context.Context {
+	return context.WithValue(ctx, runningTaskKey{}, task)
+}
+
+// runningTaskFrom returns the running task carried by ctx, if any
+func runningTaskFrom(ctx context.Context) *runningTask {
+	task, _ := ctx.Value(runningTaskKey{}).(*runningTask)
+	return task
+}
+
+// taskHistory is a ring buffer of the outcomes of the last tasks run by a worker
+type taskHistory struct {
+	tasks []TaskStatus
+	next  int
+	full  bool
+}
+
+func newTaskHistory(size int) *taskHistory {
+	if size <= 0 {
+		size = DefaultStatusHistorySize
+	}
+	return &taskHistory{tasks: make([]TaskStatus, size)}
+}
+
+func (h *taskHistory) add(task TaskStatus) {
+	h.tasks[h.next] = task
+	h.next = (h.next + 1) % len(h.tasks)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the outcomes in the history, most recent first
+func (h *taskHistory) list() []TaskStatus {
+	n := h.next
+	if h.full {
+		n = len(h.tasks)
+	}
+	tasks := make([]TaskStatus, 0, n)
+	for i := 1; i <= n; i++ {
+		tasks = append(tasks, h.tasks[(h.next-i+len(h.tasks))%len(h.tasks)])
+	}
+	return tasks
+}
+
+// SetStatusHistorySize sets the number of finished tasks whose outcome is kept (the default is
+// used if n isn't positive). The outcomes kept so far are forgotten.
+func (w *Worker) SetStatusHistorySize(n int) {
+	w.inFlightLock.Lock()
+	defer w.inFlightLock.Unlock()
+	w.history = newTaskHistory(n)
+}
+
+// taskEnded records the outcome of a task's workflow, before it's retried or reported to the peer
+func (w *Worker) taskEnded(task *runningTask, err error) {
+	w.metrics.taskEnded(task.kind, err)
+	task.end(err)
+}
+
+// taskCanceled returns true if a running task has been canceled
+func (w *Worker) taskCanceled(key string) bool {
+	w.inFlightLock.Lock()
+	task := w.inFlight[key]
+	w.inFlightLock.Unlock()
+	return task != nil && task.isCanceled()
+}
+
+// CancelTask interrupts a task running on the worker. It is then marked as failed on the peer
+// rather than retried.
+func (w *Worker) CancelTask(key string) error {
+	w.inFlightLock.Lock()
+	task := w.inFlight[key]
+	w.inFlightLock.Unlock()
+	if task == nil {
+		return errTaskNotRunning
+	}
+	task.cancelTask()
+	w.logger().With(logging.FieldTask, key).Warningf("Canceling %s", key)
+	return nil
+}
+
+// Status returns a snapshot of the tasks running on the worker and of the outcome of the last
+// ones it has run
+func (w *Worker) Status() WorkerStatus {
+	w.inFlightLock.Lock()
+	defer w.inFlightLock.Unlock()
+
+	now := time.Now()
+	status := WorkerStatus{
+		ID:       w.ID.String(),
+		Draining: w.draining,
+		Tasks:    make([]TaskStatus, 0, len(w.inFlight)),
+		History:  []TaskStatus{},
+	}
+	for _, task := range w.inFlight {
+		status.Tasks = append(status.Tasks, task.status(now))
+	}
+	if w.history != nil {
+		status.History = w.history.list()
+	}
+	return status
+}
+
+// StatusServer serves the status of a worker over HTTP, along with an admin route to cancel the
+// tasks it runs. The admin route is disabled if there's no admin password.
+type StatusServer struct {
+	worker        *Worker
+	config        interface{}
+	adminUser     string
+	adminPassword string
+}
+
+// NewStatusServer creates a status server for a worker. config is served as is: secrets must have
+// been redacted.
+func NewStatusServer(worker *Worker, config interface{}, adminUser, adminPassword string) *StatusServer {
+	return &StatusServer{
+		worker:        worker,
+		config:        config,
+		adminUser:     adminUser,
+		adminPassword: adminPassword,
+	}
+}
+
+// Handler returns the HTTP handler of the status server routes
+func (s *StatusServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.Register(mux)
+	return mux
+}
+
+// Register adds the status server routes to a mux
+func (s *StatusServer) Register(mux *http.ServeMux) {
+	mux.HandleFunc(StatusRoute, s.status)
+	mux.HandleFunc(TasksRoute, s.cancelTask)
+}
+
+func (s *StatusServer) status(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJSON(rw, http.StatusMethodNotAllowed, common.NewAPIError(fmt.Sprintf("Method %s not allowed", req.Method)))
+		return
+	}
+	status := s.worker.Status()
+	status.Config = s.config
+	writeJSON(rw, http.StatusOK, status)
+}
+
+func (s *StatusServer) cancelTask(rw http.ResponseWriter, req *http.Request) {
+	key := strings.TrimPrefix(req.URL.Path, TasksRoute)
+	if !strings.HasSuffix(key, "/cancel") {
+		writeJSON(rw, http.StatusNotFound, common.NewAPIError(fmt.Sprintf("No route for %s", req.URL.Path)))
+		return
+	}
+	key = strings.TrimSuffix(key, "/cancel")
+	if req.Method != http.MethodPost {
+		writeJSON(rw, http.StatusMethodNotAllowed, common.NewAPIError(fmt.Sprintf("Method %s not allowed", req.Method)))
+		return
+	}
+	if s.adminPassword == "" {
+		writeJSON(rw, http.StatusForbidden, common.NewAPIError("Admin routes are disabled (no admin password)"))
+		return
+	}
+	if !s.authorized(req) {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="morpheo-compute worker"`)
+		writeJSON(rw, http.StatusUnauthorized, common.NewAPIError("Invalid admin credentials"))
+		return
+	}
+
+	if err := s.worker.CancelTask(key); err == errTaskNotRunning {
+		writeJSON(rw, http.StatusNotFound, common.NewAPIError(fmt.Sprintf("Task %s isn't running on this worker", key)))
+		return
+	} else if err != nil {
+		writeJSON(rw, http.StatusInternalServerError, common.NewAPIError(fmt.Sprintf("Error canceling task %s: %s", key, err)))
+		return
+	}
+	writeJSON(rw, http.StatusAccepted, map[string]string{"message": fmt.Sprintf("Task %s canceled", key)})
+}
+
+// authorized checks the admin credentials of a request (using HTTP Basic Authentication)
+func (s *StatusServer) authorized(req *http.Request) bool {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.adminUser)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.adminPassword)) == 1
+	return userOK && passwordOK
+}
+
+func writeJSON(rw http.ResponseWriter, code int, body interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(body)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// startTaskSpan starts the span of a task received in a broker message, as a child of the span
+// that pushed it (if its envelope carries one)
+func (w *Worker) startTaskSpan(kind string, envelope logging.Envelope) (context.Context, trace.Span) {
+	ctx := tracing.Extract(context.Background(), propagation.MapCarrier(envelope.Trace))
+	return tracing.Start(ctx, kind, trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		tracing.AttributeTask.String(envelope.Key),
+		tracing.AttributeMessageID.String(envelope.MessageID),
+		tracing.AttributeWorker.String(w.ID.String()),
+	))
+}
+
+// startStepSpan starts the span of a workflow step, as a child of the span of ctx. The step is
+// recorded as the current one of the running task of ctx as well.
+func startStepSpan(ctx context.Context, step string) (context.Context, trace.Span) {
+	runningTaskFrom(ctx).setStep(step)
+	return tracing.Start(ctx, step, trace.WithAttributes(tracing.AttributeStep.String(step)))
+}
+
+// traceCall runs a call to storage or to the peer (whose clients don't take contexts) in a child
+// span of ctx
+func traceCall(ctx context.Context, name string, call func() error, attrs ...attribute.KeyValue) error {
+	_, span := tracing.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	err := call()
+	tracing.End(span, err)
+	return err
+}
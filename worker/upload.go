@@ -0,0 +1,133 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
+)
+
+// ChunkedStorage is implemented by storage clients that can upload models without knowing their
+// size beforehand (using chunked transfer encoding or multipart uploads)
+type ChunkedStorage interface {
+	PostModelChunked(model *common.Model, blobReader io.Reader) error
+}
+
+// postModel archives a model folder and streams it to storage on the fly, in a single pass and
+// without writing the archive to disk: its size isn't known until it's been uploaded. Storage
+// clients that don't implement ChunkedStorage get an unknown (-1) size.
+func (w *Worker) postModel(ctx context.Context, model *common.Model, modelFolder string) (err error) {
+	defer w.metrics.timeStep(StepModelUpload)()
+	ctx, span := startStepSpan(ctx, StepModelUpload)
+	defer func() { tracing.End(span, err) }()
+
+	name := fmt.Sprintf("new model %s", model.ID)
+	if storage, ok := w.storage.(ChunkedStorage); ok {
+		return w.streamArchive(ctx, name, modelFolder, func(archive io.Reader) error {
+			return traceCall(ctx, "storage.PostModelChunked", func() error {
+				return storage.PostModelChunked(model, archive)
+			})
+		})
+	}
+	return w.streamArchive(ctx, name, modelFolder, func(archive io.Reader) error {
+		return traceCall(ctx, "storage.PostModel", func() error {
+			return w.storage.PostModel(model, archive, -1)
+		})
+	})
+}
+
+// countingWriter counts the bytes written to an io.Writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// streamArchive pipes an archive of a folder (in the worker's archive format) to an upload
+// function. Uploads that return before reading the whole archive fail, even if storage accepted
+// them. name describes the archive in errors.
+func (w *Worker) streamArchive(ctx context.Context, name, folder string, upload func(archive io.Reader) error) error {
+	var (
+		lock        sync.Mutex
+		uploaded    bool
+		archiveErr  error
+		afterUpload bool
+		written     int64
+	)
+	reader, writer := io.Pipe()
+	archived := make(chan struct{})
+	go func() {
+		defer close(archived)
+		archive := &countingWriter{w: writer}
+		err := w.ArchiveFolder(folder, archive)
+
+		lock.Lock()
+		archiveErr, afterUpload, written = err, uploaded, archive.n
+		lock.Unlock()
+		writer.CloseWithError(err)
+	}()
+
+	err := upload(w.metrics.countUpload(newContextReader(ctx, reader)))
+
+	// Let's unblock the archiver if the upload stopped reading the archive
+	lock.Lock()
+	uploaded = true
+	lock.Unlock()
+	reader.Close()
+	<-archived
+
+	switch {
+	case archiveErr != nil && !afterUpload:
+		return NewTaskError(ErrorClassRuntime, "Error archiving %s: %s", name, archiveErr)
+	case err != nil:
+		// Archiving errors that occur once the upload failed are caused by the upload
+		return NewTaskError(ErrorClassStorage, "Error streaming %s to storage: %s", name, err)
+	case archiveErr != nil:
+		return NewTaskError(ErrorClassStorage, "Error streaming %s to storage: it stopped reading the archive after %d bytes", name, written)
+	}
+	return nil
+}
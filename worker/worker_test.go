@@ -1,39 +1,56 @@
 package main_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/MorpheoOrg/morpheo-compute/logging"
+	"github.com/MorpheoOrg/morpheo-compute/tracing"
 	. "github.com/MorpheoOrg/morpheo-compute/worker"
 	"github.com/MorpheoOrg/morpheo-go-packages/client"
 	"github.com/MorpheoOrg/morpheo-go-packages/common"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/nsqio/go-nsq"
 	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 var (
 	worker      *Worker
+	storageMock client.Storage
 	fixtures    *common.DataParser
 	tmpPathData string
-	// preduplet   = &common.Preduplet{
-	// 	ID:                  uuid.NewV4(),
-	// 	Problem:             uuid.NewV4(),
-	// 	Workflow:            uuid.NewV4(),
-	// 	Model:               uuid.NewV4(),
-	// 	Data:                uuid.NewV4(),
-	// 	WorkerID:            uuid.NewV4(),
-	// 	Status:              "todo",
-	// 	RequestDate:         22,
-	// 	CompletionDate:      22,
-	// 	PredictionStorageID: uuid.NewV4(),
-	// }
+	preduplet   = &common.Preduplet{
+		Key:            "preduplet" + uuid.NewV4().String(),
+		Problem:        uuid.NewV4(),
+		Model:          uuid.NewV4(),
+		Data:           uuid.NewV4(),
+		Worker:         uuid.NewV4(),
+		Status:         "todo",
+		RequestDate:    22,
+		CompletionDate: 22,
+	}
 	learnuplet = &common.Learnuplet{
 		Key:            "learnuplet" + uuid.NewV4().String(),
 		Problem:        uuid.NewV4(),
@@ -59,18 +76,15 @@ func TestMain(m *testing.M) {
 	containerRuntime := common.NewMockRuntime()
 
 	// Create storage Mock
-	storageMock, err := client.NewStorageAPIMock()
+	var err error
+	storageMock, err = client.NewStorageAPIMock()
 	if err != nil {
 		log.Panicln("Error loading Storage Mock: ", err)
 	}
 
 	// Let's finally create our worker
 	tmpPathData = filepath.Join(os.TempDir(), "morpheo_tmp_data")
-	worker = NewWorker(
-		tmpPathData, "train", "test", "untargeted_test", "pred", "perf", "model",
-		"problem", "algo", containerRuntime,
-		storageMock, &client.PeerMock{},
-	)
+	worker = newRuntimeTestWorker(containerRuntime, newStorageStub(), newPeerStub())
 
 	// Run the tests
 	exitcode := m.Run()
@@ -87,49 +101,1787 @@ func TestHandleLearn(t *testing.T) {
 	// t.Parallel()
 
 	// Pre-setup directory structure for Learn to avoid permission issues
-	taskDataFolder := filepath.Join(tmpPathData, learnuplet.Algo.String())
-	assert.Nil(t, worker.SetupDirectories(taskDataFolder, 0777))
+	setupLearn(t, worker, learnuplet)
+
+	// Test the whole pipeline works...
+	msg, _ := json.Marshal(learnuplet)
+	assert.Nil(t, worker.HandleLearn(msg, 1))
+}
+
+func TestHandleLearnEnvelope(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := logging.Default()
+	logging.SetDefault(logging.New(&buf, logging.LevelDebug))
+	defer logging.SetDefault(defaultLogger)
+
+	setupLearn(t, worker, learnuplet)
+
+	// Learnuplets pushed in an envelope are processed, and their logs carry the envelope's IDs
+	task, _ := json.Marshal(learnuplet)
+	msg, err := logging.Wrap(learnuplet.Key, "message1", nil, task)
+	assert.Nil(t, err)
+	assert.Nil(t, worker.HandleLearn(msg, 1))
+
+	var steps []string
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(raw), &line), raw)
+		assert.Equal(t, learnuplet.Key, line[logging.FieldTask], raw)
+		assert.Equal(t, "message1", line[logging.FieldMessageID], raw)
+		assert.Equal(t, worker.ID.String(), line[logging.FieldWorker], raw)
+		assert.Contains(t, line, logging.FieldDuration, raw)
+		if step, ok := line[logging.FieldStep].(string); ok && (len(steps) == 0 || steps[len(steps)-1] != step) {
+			steps = append(steps, step)
+		}
+	}
+	assert.Contains(t, steps, "train")
+	assert.Contains(t, steps, "perf")
+}
+
+func TestHandleLearnTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	defer tracing.SetExporter("compute-worker", exporter)(context.Background())
+
+	setupLearn(t, worker, learnuplet)
+
+	// The span pushing the learnuplet travels in its envelope: the task continues its trace
+	ctx, push := tracing.Start(context.Background(), "push train")
+	task, _ := json.Marshal(learnuplet)
+	msg, err := logging.Wrap(learnuplet.Key, "message1", tracing.Inject(ctx), task)
+	assert.Nil(t, err)
+	push.End()
+	assert.Nil(t, worker.HandleLearn(msg, 1))
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	learn, ok := spans["learn"]
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, push.SpanContext().TraceID(), learn.SpanContext.TraceID())
+	assert.Equal(t, push.SpanContext().SpanID(), learn.Parent.SpanID())
+	assert.Contains(t, learn.Attributes, tracing.AttributeTask.String(learnuplet.Key))
+	assert.Contains(t, learn.Attributes, tracing.AttributeMessageID.String("message1"))
+
+	// Steps, storage and peer calls are part of the task's trace
+	for _, name := range []string{StepImageLoad, StepDataPull, "train", "perf", StepModelUpload, "storage.metadata", "storage.blob", "peer.SetUpletWorker", "peer.ReportLearn"} {
+		span, ok := spans[name]
+		if assert.True(t, ok, name) {
+			assert.Equal(t, learn.SpanContext.TraceID(), span.SpanContext.TraceID(), name)
+		}
+	}
+	assert.Equal(t, learn.SpanContext.SpanID(), spans["train"].Parent.SpanID())
+	assert.Equal(t, learn.SpanContext.SpanID(), spans["peer.ReportLearn"].Parent.SpanID())
+}
+
+// storageStub wraps our storage mock. It only knows about the models we tell it about, can
+// simulate storage timeouts and counts problem workflow pulls (one per task started). Tasks may
+// run in their own goroutines: failing and pulls are guarded by a mutex.
+type storageStub struct {
+	client.Storage
+	models  map[uuid.UUID]bool
+	lock    sync.Mutex
+	failing bool
+	pulls   int
+}
+
+func newStorageStub() *storageStub {
+	return &storageStub{
+		Storage: storageMock,
+		models:  map[uuid.UUID]bool{preduplet.Model: true},
+	}
+}
+
+func (s *storageStub) setFailing(failing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing = failing
+}
+
+func (s *storageStub) pullCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pulls
+}
+
+func (s *storageStub) GetModel(id uuid.UUID) (*common.Model, error) {
+	if !s.models[id] {
+		return nil, fmt.Errorf("model %s not found", id)
+	}
+	return s.Storage.GetModel(id)
+}
+
+func (s *storageStub) GetProblemWorkflowBlob(id uuid.UUID) (io.ReadCloser, error) {
+	s.lock.Lock()
+	s.pulls++
+	failing := s.failing
+	s.lock.Unlock()
+	if failing {
+		return nil, fmt.Errorf("storage timeout")
+	}
+	return s.Storage.GetProblemWorkflowBlob(id)
+}
+
+// peerStub wraps our peer mock and answers learnuplet status queries with the uplets we tell it
+// about
+type peerStub struct {
+	client.Peer
+	uplets   map[string]string
+	reported []string
+	statuses []string
+	perfs    []float64
+	invoked  []string
+}
+
+func newPeerStub() *peerStub {
+	return &peerStub{
+		Peer:   &client.PeerMock{},
+		uplets: make(map[string]string),
+	}
+}
+
+func (p *peerStub) QueryStatusLearnuplet(status string) ([]byte, error) {
+	learnuplets := []map[string]string{}
+	for key, s := range p.uplets {
+		if s == status {
+			learnuplets = append(learnuplets, map[string]string{"key": key})
+		}
+	}
+	return json.Marshal(learnuplets)
+}
+
+func (p *peerStub) ReportLearn(upletKey string, status string, perf float64, trainPerf map[string]float64, testPerf map[string]float64) (string, []byte, error) {
+	p.reported = append(p.reported, upletKey)
+	p.statuses = append(p.statuses, status)
+	p.perfs = append(p.perfs, perf)
+	return p.Peer.ReportLearn(upletKey, status, perf, trainPerf, testPerf)
+}
+
+func (p *peerStub) Invoke(fcn string, args []string) (string, []byte, error) {
+	p.invoked = append(p.invoked, fmt.Sprintf("%s(%s)", fcn, strings.Join(args, ",")))
+	return p.Peer.Invoke(fcn, args)
+}
+
+func newTestWorker(storage client.Storage, peer client.Peer) *Worker {
+	return newRuntimeTestWorker(common.NewMockRuntime(), storage, peer)
+}
+
+func newRuntimeTestWorker(runtime common.ContainerRuntime, storage client.Storage, peer client.Peer) *Worker {
+	return NewWorker(
+		tmpPathData, "train", "test", "untargeted_test", "pred", "perf", "model",
+		"problem", "algo", runtime,
+		storage, peer,
+	)
+}
+
+// setupLearn pre-creates a learnuplet's directory structure and the performance file that the
+// container runtime mock won't write
+func setupLearn(t *testing.T, w *Worker, task *common.Learnuplet) {
+	taskDataFolder := filepath.Join(tmpPathData, task.Algo.String())
+	assert.Nil(t, w.SetupDirectories(taskDataFolder, 0777))
 
-	// Create performance.json in tmp
 	tmpPathPerfFile := filepath.Join(taskDataFolder, "perf/performance.json")
-	f, err := os.Create(tmpPathPerfFile)
+	assert.Nil(t, ioutil.WriteFile(tmpPathPerfFile, []byte(perfString), 0666))
+}
+
+func TestHandleLearnRetry(t *testing.T) {
+	storage := newStorageStub()
+	storage.setFailing(true)
+	w := newTestWorker(storage, newPeerStub())
+	w.SetRetryPolicy(ErrorClassStorage, RetryPolicy{MaxAttempts: 2, Backoff: time.Hour})
+	setupLearn(t, w, learnuplet)
+
+	// Storage errors are retryable: the task must be handed back to the broker, that delivers it
+	// again after the policy's backoff (the handler doesn't wait for it)...
+	msg, _ := json.Marshal(learnuplet)
+	err := w.HandleLearn(msg, 1)
+	if assert.IsType(t, &RequeueError{}, err) {
+		assert.Equal(t, time.Hour, err.(*RequeueError).Delay)
+	}
+	assert.Contains(t, err.Error(), "storage timeout")
+
+	// ... until it is out of attempts, where it's marked as failed and acknowledged
+	assert.Nil(t, w.HandleLearn(msg, 2))
+	assert.Equal(t, 2, storage.pullCount())
+}
+
+// messageDelegate records how NSQ messages are responded to
+type messageDelegate struct {
+	finished bool
+	requeued bool
+	delay    time.Duration
+	backoff  bool
+}
+
+func (d *messageDelegate) OnFinish(m *nsq.Message) { d.finished = true }
+func (d *messageDelegate) OnTouch(m *nsq.Message)  {}
+func (d *messageDelegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.requeued, d.delay, d.backoff = true, delay, backoff
+}
+
+func TestHandleMessage(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+	handle := func(attempts uint16, handlerErr error) (*messageDelegate, int) {
+		delegate := &messageDelegate{}
+		msg := nsq.NewMessage(nsq.MessageID{}, []byte("task"))
+		msg.Attempts = attempts
+		msg.Delegate = delegate
+		var delivered int
+		HandleMessage(msg, func(message []byte, attempts int) error {
+			delivered = attempts
+			return handlerErr
+		}, logger)
+		return delegate, delivered
+	}
+
+	// Handled tasks are acknowledged, and handlers are told how many times they were delivered
+	delegate, delivered := handle(3, nil)
+	assert.True(t, delegate.finished)
+	assert.Equal(t, 3, delivered)
+
+	// Retryable tasks are requeued with their delay, without backing the consumer off
+	delegate, _ = handle(1, &RequeueError{Delay: time.Minute, Err: fmt.Errorf("storage timeout")})
+	assert.True(t, delegate.requeued)
+	assert.Equal(t, time.Minute, delegate.delay)
+	assert.False(t, delegate.backoff)
+
+	// Other errors are requeued with the broker's backoff
+	delegate, _ = handle(1, fmt.Errorf("drained"))
+	assert.True(t, delegate.requeued)
+	assert.True(t, delegate.backoff)
+}
+
+func TestHandleLearnRedelivery(t *testing.T) {
+	storage := newStorageStub()
+	peer := newPeerStub()
+	w := newTestWorker(storage, peer)
+	msg, _ := json.Marshal(learnuplet)
+
+	// Tasks that are done or failed are skipped
+	for _, status := range []string{common.TaskStatusDone, common.TaskStatusFailed, TaskStatusPerfFailed} {
+		peer.uplets[learnuplet.Key] = status
+		assert.Nil(t, w.HandleLearn(msg, 2))
+	}
+	assert.Equal(t, 0, storage.pullCount())
+
+	// But a requeued task that's still pending is computed again
+	peer.uplets[learnuplet.Key] = common.TaskStatusPending
+	setupLearn(t, w, learnuplet)
+	assert.Nil(t, w.HandleLearn(msg, 2))
+	assert.Equal(t, 1, storage.pullCount())
+}
+
+func TestHandleLearnModelPosted(t *testing.T) {
+	storage := newStorageStub()
+	peer := newPeerStub()
+	runtime := &stepRuntime{ContainerRuntime: common.NewMockRuntime()}
+	w := newRuntimeTestWorker(runtime, storage, peer)
+	msg, _ := json.Marshal(learnuplet)
+
+	// A pending task whose model was posted to storage by an earlier delivery isn't trained
+	// again: the model predicts its train and test data, and its performance is reported
+	peer.uplets[learnuplet.Key] = common.TaskStatusPending
+	storage.models[learnuplet.ModelEnd] = true
+	assert.Nil(t, w.HandleLearn(msg, 2))
+	assert.Equal(t, 1, storage.pullCount())
+	assert.Equal(t, []string{"detarget", "predict", "predict", "perf"}, runtime.steps)
+	assert.Equal(t, []string{learnuplet.Key}, peer.reported)
+	assert.Equal(t, []string{common.TaskStatusDone}, peer.statuses)
+
+	// Unless it's done already
+	peer.uplets[learnuplet.Key] = common.TaskStatusDone
+	assert.Nil(t, w.HandleLearn(msg, 3))
+	assert.Equal(t, 1, storage.pullCount())
+	assert.Equal(t, 1, len(peer.reported))
+}
+
+// blockingRuntime is a cancelable container runtime mock whose train containers run until they're
+// killed
+type blockingRuntime struct {
+	common.ContainerRuntime
+	started chan string
+	killed  chan string
+}
+
+func newBlockingRuntime() *blockingRuntime {
+	return &blockingRuntime{
+		ContainerRuntime: common.NewMockRuntime(),
+		started:          make(chan string, 1),
+		killed:           make(chan string, 1),
+	}
+}
+
+func (r *blockingRuntime) RunImageInUntrustedContainerContext(ctx context.Context, imageName string, args []string, mounts map[string]string, autoRemove bool) (string, error) {
+	for _, arg := range args {
+		if arg == "train" {
+			r.started <- imageName
+			<-ctx.Done()
+			r.killed <- imageName
+			return "", ctx.Err()
+		}
+	}
+	return r.RunImageInUntrustedContainer(imageName, args, mounts, autoRemove)
+}
+
+func TestHandleLearnTimeout(t *testing.T) {
+	runtime := newBlockingRuntime()
+	w := newRuntimeTestWorker(runtime, newStorageStub(), newPeerStub())
+	w.SetTimeouts(100*time.Millisecond, 0, 0)
+	setupLearn(t, w, learnuplet)
+
+	// The train container is killed once the task times out and the task is marked as failed
+	msg, _ := json.Marshal(learnuplet)
+	assert.Nil(t, w.HandleLearn(msg, 1))
+	select {
+	case imageName := <-runtime.killed:
+		assert.Equal(t, fmt.Sprintf("algo-%s", learnuplet.Algo), imageName)
+	default:
+		t.Error("Train container wasn't killed")
+	}
+}
+
+// dockerStub is a Docker API whose containers exit with a given status, or run until they're
+// killed if block is set
+type dockerStub struct {
+	status  int64
+	block   bool
+	lock    sync.Mutex
+	running map[string]bool
+	killed  []string
+	removed []string
+	images  []types.ImageSummary
+}
+
+func (d *dockerStub) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
+	if !config.NetworkDisabled || hostConfig.NetworkMode != "none" {
+		return container.ContainerCreateCreatedBody{}, fmt.Errorf("untrusted containers must have no network")
+	}
+	return container.ContainerCreateCreatedBody{ID: "container-" + config.Image}, nil
+}
+
+func (d *dockerStub) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.running == nil {
+		d.running = make(map[string]bool)
+	}
+	d.running[containerID] = true
+	return nil
+}
+
+func (d *dockerStub) ContainerWait(ctx context.Context, containerID string) (int64, error) {
+	if d.block {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.running[containerID] = false
+	return d.status, nil
+}
+
+func (d *dockerStub) ContainerKill(ctx context.Context, containerID, signal string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.running[containerID] {
+		return fmt.Errorf("container %s is not running", containerID)
+	}
+	d.running[containerID] = false
+	d.killed = append(d.killed, containerID)
+	return nil
+}
+
+func (d *dockerStub) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.running[containerID] && !options.Force {
+		return fmt.Errorf("container %s is running", containerID)
+	}
+	delete(d.running, containerID)
+	d.removed = append(d.removed, containerID)
+	return nil
+}
+
+func (d *dockerStub) ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("output of " + containerID)), nil
+}
+
+func (d *dockerStub) ImageList(ctx context.Context, options types.ImageListOptions) ([]types.ImageSummary, error) {
+	return d.images, nil
+}
+
+func TestDockerRuntime(t *testing.T) {
+	docker := &dockerStub{}
+	runtime := NewDockerRuntimeWithClient(common.NewMockRuntime(), docker, time.Minute)
+	mounts := map[string]string{"/data/train": "/data/train"}
+
+	// Containers that exit are removed if asked to, and fail with their exit status
+	containerID, err := runtime.RunImageInUntrustedContainerContext(context.Background(), "algo", nil, mounts, true)
 	assert.Nil(t, err)
-	_, err = f.Write([]byte(perfString))
+	assert.Equal(t, "container-algo", containerID)
+	assert.Equal(t, []string{"container-algo"}, docker.removed)
+
+	docker.status, docker.removed = 1, nil
+	containerID, err = runtime.RunImageInUntrustedContainerContext(context.Background(), "algo", nil, mounts, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, "container-algo", containerID)
+	assert.Nil(t, docker.removed)
+
+	// Containers of interrupted tasks are killed and removed right away
+	docker.block = true
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	containerID, err = runtime.RunImageInUntrustedContainerContext(ctx, "algo", nil, mounts, false)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, "", containerID)
+	assert.Equal(t, []string{"container-algo"}, docker.killed)
+	assert.Equal(t, []string{"container-algo"}, docker.removed)
+
+	// So are containers that outlive the Docker timeout
+	docker.killed, docker.removed = nil, nil
+	runtime = NewDockerRuntimeWithClient(common.NewMockRuntime(), docker, 50*time.Millisecond)
+	_, err = runtime.RunImageInUntrustedContainerContext(context.Background(), "algo", nil, mounts, false)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, []string{"container-algo"}, docker.killed)
+	assert.Equal(t, []string{"container-algo"}, docker.removed)
+
+	// Container output can be retrieved
+	logs, err := runtime.ContainerLogs("container-algo")
+	if assert.Nil(t, err) {
+		output, err := ioutil.ReadAll(logs)
+		assert.Nil(t, err)
+		assert.Equal(t, "output of container-algo", string(output))
+		logs.Close()
+	}
+
+	// Images are listed by name
+	docker.images = []types.ImageSummary{{RepoTags: []string{"algo-1:latest", "algo-1:v1"}}, {RepoTags: []string{"redis:3"}}}
+	names, err := runtime.ListImages()
 	assert.Nil(t, err)
-	f.Close()
+	assert.Equal(t, []string{"algo-1:latest", "algo-1:v1", "redis:3"}, names)
+}
 
-	// Test the whole pipeline works...
+func TestStop(t *testing.T) {
+	runtime := newBlockingRuntime()
+	w := newRuntimeTestWorker(runtime, newStorageStub(), newPeerStub())
+	setupLearn(t, w, learnuplet)
+
+	// Tasks interrupted by a worker shutdown are handed back to the broker
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		w.Stop()
+	}()
+	msg, _ := json.Marshal(learnuplet)
+	assert.NotNil(t, w.HandleLearn(msg, 1))
+	assert.Equal(t, 1, len(runtime.killed))
+}
+
+func TestDrain(t *testing.T) {
+	runtime := newBlockingRuntime()
+	storage := newStorageStub()
+	peer := newPeerStub()
+	w := newRuntimeTestWorker(runtime, storage, peer)
+	setupLearn(t, w, learnuplet)
+
+	msg, _ := json.Marshal(learnuplet)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- w.HandleLearn(msg, 1)
+	}()
+	<-runtime.started
+
+	// Tasks still running after the grace period are interrupted, set back to todo on the peer
+	// and handed back to the broker
+	w.Drain(100 * time.Millisecond)
+	assert.Equal(t, 1, len(runtime.killed))
+	assert.IsType(t, &RequeueError{}, <-errs)
+	assert.Equal(t, []string{fmt.Sprintf("resetUplet(%s)", learnuplet.Key)}, peer.invoked)
+
+	// New tasks are requeued without being started
+	pulls := storage.pullCount()
+	assert.NotNil(t, w.HandleLearn(msg, 1))
+	assert.Equal(t, pulls, storage.pullCount())
+
+	// Draining twice is fine
+	w.Drain(time.Millisecond)
+}
+
+// dataStub serves datasets whose content is their UUID, counts concurrent downloads and fails on
+// (or blocks until canceled on) the datasets we tell it about
+type dataStub struct {
+	*storageStub
+	failing  map[uuid.UUID]bool
+	blocking map[uuid.UUID]bool
+	lock     sync.Mutex
+	running  int
+	maxRun   int
+	opened   int
+}
+
+func newDataStub() *dataStub {
+	return &dataStub{
+		storageStub: newStorageStub(),
+		failing:     make(map[uuid.UUID]bool),
+		blocking:    make(map[uuid.UUID]bool),
+	}
+}
+
+func (s *dataStub) GetDataBlob(id uuid.UUID) (io.ReadCloser, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.opened++
+	if s.failing[id] {
+		return nil, fmt.Errorf("storage timeout")
+	}
+	s.running++
+	if s.running > s.maxRun {
+		s.maxRun = s.running
+	}
+	return &dataBlob{
+		content:  strings.NewReader(id.String()),
+		blocking: s.blocking[id],
+		stub:     s,
+		closed:   make(chan struct{}),
+	}, nil
+}
+
+type dataBlob struct {
+	content   io.Reader
+	blocking  bool
+	stub      *dataStub
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Read blocks until the blob is closed for blocking datasets
+func (b *dataBlob) Read(p []byte) (int, error) {
+	if b.blocking {
+		<-b.closed
+		return 0, fmt.Errorf("blob closed")
+	}
+	return b.content.Read(p)
+}
+
+func (b *dataBlob) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		b.stub.lock.Lock()
+		b.stub.running--
+		b.stub.lock.Unlock()
+	})
+	return nil
+}
+
+// datasetRuntime records the datasets the perf container gets
+type datasetRuntime struct {
+	common.ContainerRuntime
+	datasets map[string]map[string]string
+}
+
+func (r *datasetRuntime) RunImageInUntrustedContainer(imageName string, args []string, mounts map[string]string, autoRemove bool) (string, error) {
+	if args[1] == "perf" {
+		r.datasets = make(map[string]map[string]string)
+		for hostPath, containerPath := range mounts {
+			files, _ := ioutil.ReadDir(hostPath)
+			r.datasets[containerPath] = make(map[string]string)
+			for _, f := range files {
+				if f.IsDir() {
+					continue
+				}
+				content, _ := ioutil.ReadFile(filepath.Join(hostPath, f.Name()))
+				r.datasets[containerPath][f.Name()] = string(content)
+			}
+		}
+	}
+	return r.ContainerRuntime.RunImageInUntrustedContainer(imageName, args, mounts, autoRemove)
+}
+
+func TestPullDatasets(t *testing.T) {
+	task := *learnuplet
+	task.TrainData = []uuid.UUID{uuid.NewV4(), uuid.NewV4(), uuid.NewV4(), uuid.NewV4(), uuid.NewV4()}
+	task.TestData = []uuid.UUID{uuid.NewV4(), uuid.NewV4(), uuid.NewV4()}
+
+	storage := newDataStub()
+	runtime := &datasetRuntime{ContainerRuntime: common.NewMockRuntime()}
+	w := newRuntimeTestWorker(runtime, storage, newPeerStub())
+	w.SetDownloadParallelism(2)
+	setupLearn(t, w, &task)
+
+	// Every dataset ends up in its folder, named after its UUID
+	assert.Nil(t, w.LearnWorkflow(context.Background(), task))
+	assert.True(t, storage.maxRun <= 2)
+	for folder, ids := range map[string][]uuid.UUID{"/submission_data/train": task.TrainData, "/hidden_data/test": task.TestData} {
+		assert.Equal(t, len(ids), len(runtime.datasets[folder]))
+		for _, id := range ids {
+			assert.Equal(t, id.String(), runtime.datasets[folder][id.String()])
+		}
+	}
+
+	// The first failing download cancels the others
+	storage = newDataStub()
+	storage.blocking[task.TrainData[0]] = true
+	storage.failing[task.TrainData[1]] = true
+	w = newTestWorker(storage, newPeerStub())
+	w.SetDownloadParallelism(2)
+	setupLearn(t, w, &task)
+
+	err := w.LearnWorkflow(context.Background(), task)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorClassStorage, ErrorClassOf(err))
+	assert.Contains(t, err.Error(), task.TrainData[1].String())
+	assert.Equal(t, 0, storage.running)
+	assert.True(t, storage.opened <= 2)
+}
+
+func TestBlobCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cache, err := NewBlobCache(dir, 10)
+	assert.Nil(t, err)
+	pulls := 0
+	pull := func(content string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			pulls++
+			return ioutil.NopCloser(strings.NewReader(content)), nil
+		}
+	}
+	ctx := context.Background()
+
+	// Blobs are pulled once
+	for i := 0; i < 2; i++ {
+		blob, err := cache.Open(ctx, "a", pull("aaaaaa"))
+		assert.Nil(t, err)
+		content, _ := ioutil.ReadAll(blob)
+		blob.Close()
+		assert.Equal(t, "aaaaaa", string(content))
+	}
+	assert.Equal(t, 1, pulls)
+
+	dst := filepath.Join(dir, "..", "cache-copy-"+uuid.NewV4().String())
+	defer os.Remove(dst)
+	n, err := cache.CopyTo(ctx, "a", pull("aaaaaa"), dst)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), n)
+	content, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, "aaaaaa", string(content))
+	assert.Equal(t, 1, pulls)
+
+	// Copies don't share the cached file
+	copied, err := os.Stat(dst)
+	assert.Nil(t, err)
+	cached, err := os.Stat(filepath.Join(dir, "a"))
+	assert.Nil(t, err)
+	assert.False(t, os.SameFile(copied, cached))
+
+	// Failed pulls aren't cached
+	_, err = cache.Open(ctx, "b", func() (io.ReadCloser, error) { return nil, fmt.Errorf("storage timeout") })
+	assert.NotNil(t, err)
+
+	// Least recently used blobs are evicted once the cache is full
+	blob, err := cache.Open(ctx, "b", pull("bbbbbb"))
+	assert.Nil(t, err)
+	blob.Close()
+	stats := cache.Stats()
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 3, Evictions: 1, EvictedBytes: 6, Entries: 1, Size: 6}, stats)
+
+	// ... and its usage is exposed to Prometheus
+	metrics := NewMetrics()
+	metrics.WatchCache(cache)
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", MetricsRoute, nil))
+	for _, line := range []string{
+		"morpheo_worker_cache_hits_total 2",
+		"morpheo_worker_cache_misses_total 3",
+		"morpheo_worker_cache_evictions_total 1",
+		"morpheo_worker_cache_evicted_bytes_total 6",
+		"morpheo_worker_cache_entries 1",
+		"morpheo_worker_cache_size_bytes 6",
+	} {
+		assert.Contains(t, recorder.Body.String(), line+"\n")
+	}
+
+	// Cached blobs survive restarts
+	cache, err = NewBlobCache(dir, 10)
+	assert.Nil(t, err)
+	blob, err = cache.Open(ctx, "b", pull("bbbbbb"))
+	assert.Nil(t, err)
+	blob.Close()
+	assert.Equal(t, 2, pulls)
+}
+
+func TestRequireChecksums(t *testing.T) {
+	storage := newStorageStub()
+	peer := newPeerStub()
+	w := newTestWorker(storage, peer)
+	w.SetRequireChecksums(true)
+
+	// Blobs without checksum (our storage mock doesn't provide any) fail the task
+	setupLearn(t, w, learnuplet)
+	err := w.LearnWorkflow(context.Background(), *learnuplet)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorClassTask, ErrorClassOf(err))
+	assert.Contains(t, err.Error(), "No checksum")
+
+	// For good: the task isn't handed back to the broker, it's marked as failed right away
 	msg, _ := json.Marshal(learnuplet)
-	assert.Nil(t, worker.HandleLearn(msg))
+	assert.Nil(t, w.HandleLearn(msg, 1))
+	assert.Equal(t, []string{common.TaskStatusFailed}, peer.statuses)
 }
 
-// func TestHandlePred(t *testing.T) {
-// 	// t.Parallel()
+func TestLearnWorkflowCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cache, err := NewBlobCache(dir, 1<<20)
+	assert.Nil(t, err)
 
-// 	// Pre-setup directory structure for Pred to avoid permission issues
-// 	taskDataFolder := filepath.Join(tmpPathData, preduplet.Model.String())
-// 	assert.Nil(t, worker.SetupDirectories(taskDataFolder, 0777))
+	storage := newDataStub()
+	w := newTestWorker(storage, newPeerStub())
+	w.SetCache(cache)
 
-// 	// Create a tar-gzed model mock in tmp
-// 	modelID := preduplet.Data.String()
-// 	tmpPathPerfFile := filepath.Join(taskDataFolder, filepath.Join("test/pred/", modelID))
+	// Consecutive tasks on the same problem and datasets pull them once
+	for i := 0; i < 2; i++ {
+		setupLearn(t, w, learnuplet)
+		assert.Nil(t, w.LearnWorkflow(context.Background(), *learnuplet))
+	}
+	assert.Equal(t, 1, storage.pulls)
+	assert.Equal(t, len(learnuplet.TrainData)+len(learnuplet.TestData), storage.opened)
+}
 
-// 	f, err := os.Create(tmpPathPerfFile)
-// 	assert.Nil(t, err)
+// imageRuntime is a container runtime mock that keeps track of image builds and unloads. Unloads
+// can be blocked until a channel is closed.
+type imageRuntime struct {
+	common.ContainerRuntime
+	builds   int
+	unloaded []string
 
-// 	mock, err := TargzedMock()
-// 	assert.Nil(t, err)
+	block         chan struct{}
+	unloadStarted chan struct{}
+	startOnce     sync.Once
+}
 
-// 	_, err = io.Copy(f, mock)
-// 	assert.Nil(t, err)
+// ListImages lists the images of the wrapped runtime, if it can
+func (r *imageRuntime) ListImages() ([]string, error) {
+	if lister, ok := r.ContainerRuntime.(ImageLister); ok {
+		return lister.ListImages()
+	}
+	return nil, nil
+}
+
+func (r *imageRuntime) ImageBuild(name string, buildContext io.Reader) (io.ReadCloser, error) {
+	r.builds++
+	return r.ContainerRuntime.ImageBuild(name, buildContext)
+}
+
+func (r *imageRuntime) ImageUnload(name string) error {
+	if r.block != nil {
+		r.startOnce.Do(func() { close(r.unloadStarted) })
+		<-r.block
+	}
+	r.unloaded = append(r.unloaded, name)
+	return r.ContainerRuntime.ImageUnload(name)
+}
 
-// 	f.Close()
+func TestImageRegistry(t *testing.T) {
+	runtime := &imageRuntime{ContainerRuntime: common.NewMockRuntime()}
+	images := NewImageRegistry(runtime, "", 6)
+	loads := 0
+	load := func(name string, buildContext io.Reader) error {
+		loads++
+		return nil
+	}
+	ctx := context.Background()
+
+	// Images with the same build context are loaded once, and shared
+	name, releaseA, err := images.Acquire(ctx, "a", strings.NewReader("aaaaaa"), load)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", name)
+	name, releaseA2, err := images.Acquire(ctx, "a2", strings.NewReader("aaaaaa"), load)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", name)
+	assert.Equal(t, 1, loads)
+
+	// Unused images are kept loaded while the registry has room for them
+	releaseA()
+	releaseA()
+	releaseA2()
+	assert.Equal(t, 0, len(runtime.unloaded))
+	_, releaseA, err = images.Acquire(ctx, "a", strings.NewReader("aaaaaa"), load)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, loads)
 
-// 	// Test the whole pipeline works
-// 	preduplet := preduplet
-// 	msg, _ := json.Marshal(preduplet)
-// 	assert.Nil(t, worker.HandlePred(msg))
-// }
+	// Used images are never unloaded, unused ones are unloaded least recently used first
+	_, releaseB, err := images.Acquire(ctx, "b", strings.NewReader("bbbbbb"), load)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(runtime.unloaded))
+	releaseA()
+	assert.Equal(t, []string{"a"}, runtime.unloaded)
+	releaseB()
+	assert.Equal(t, []string{"a"}, runtime.unloaded)
+	assert.Equal(t, int64(6), images.Size())
+
+	// Failed loads aren't registered
+	_, _, err = images.Acquire(ctx, "c", strings.NewReader("cccccc"), func(string, io.Reader) error {
+		return fmt.Errorf("build failed")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(6), images.Size())
+
+	// Build contexts failing at their end (e.g. corrupted blobs) are never loaded
+	corrupted := NewChecksumReader(ioutil.NopCloser(strings.NewReader("dddddd")), "algo", uuid.NewV4(), strings.Repeat("0", 64))
+	_, _, err = images.Acquire(ctx, "d", corrupted, load)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, loads)
+
+	// Images being unloaded are loaded again once they're gone, not reused
+	unloading := make(chan struct{})
+	runtime.unloadStarted = make(chan struct{})
+	runtime.block = unloading
+	_, releaseC, err := images.Acquire(ctx, "c", strings.NewReader("cccccc"), load)
+	assert.Nil(t, err)
+	go releaseC()
+	<-runtime.unloadStarted
+	acquired := make(chan struct{})
+	go func() {
+		defer close(acquired)
+		_, releaseB, err := images.Acquire(ctx, "b", strings.NewReader("bbbbbb"), load)
+		assert.Nil(t, err)
+		releaseB()
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Image reused while it was being unloaded")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(unloading)
+	<-acquired
+	assert.Equal(t, 4, loads)
+}
+
+func TestImageRegistryReconcile(t *testing.T) {
+	docker := &dockerStub{images: []types.ImageSummary{
+		{RepoTags: []string{"problem-1:latest"}},
+		{RepoTags: []string{"algo-2:latest"}},
+		{RepoTags: []string{"redis:3"}},
+	}}
+	runtime := &imageRuntime{ContainerRuntime: NewDockerRuntimeWithClient(common.NewMockRuntime(), docker, 0)}
+	images := NewImageRegistry(runtime, "", 1<<20)
+
+	// Leftover images are unloaded, images that aren't ours are left alone
+	assert.Nil(t, images.Reconcile("problem", "algo"))
+	assert.Equal(t, []string{"problem-1:latest", "algo-2:latest"}, runtime.unloaded)
+}
+
+func TestLearnWorkflowImages(t *testing.T) {
+	runtime := &imageRuntime{ContainerRuntime: common.NewMockRuntime()}
+	w := newRuntimeTestWorker(runtime, newStorageStub(), newPeerStub())
+	w.SetImageRegistry(NewImageRegistry(runtime, "", 1<<20))
+
+	// Consecutive tasks on the same problem and algo build their images once (our storage mock
+	// serves the same blob for both, so they even share a single image)
+	for i := 0; i < 2; i++ {
+		setupLearn(t, w, learnuplet)
+		assert.Nil(t, w.LearnWorkflow(context.Background(), *learnuplet))
+	}
+	assert.Equal(t, 1, runtime.builds)
+	assert.Equal(t, 0, len(runtime.unloaded))
+}
+
+func TestChecksumReader(t *testing.T) {
+	content := "some dataset"
+	hash := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(hash[:])
+	id := uuid.NewV4()
+	blob := func() io.ReadCloser { return ioutil.NopCloser(strings.NewReader(content)) }
+
+	read, err := ioutil.ReadAll(NewChecksumReader(blob(), "data", id, checksum))
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(read))
+
+	// Corrupted blobs fail with a storage error once they're read entirely...
+	_, err = ioutil.ReadAll(NewChecksumReader(blob(), "data", id, strings.Repeat("0", 64)))
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorClassStorage, ErrorClassOf(err))
+	assert.Contains(t, err.Error(), id.String())
+
+	// ... or verified
+	reader := NewChecksumReader(blob(), "data", id, strings.Repeat("0", 64))
+	reader.Read(make([]byte, 4))
+	err = reader.Verify()
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorClassStorage, ErrorClassOf(err))
+	reader = NewChecksumReader(blob(), "data", id, checksum)
+	reader.Read(make([]byte, 4))
+	assert.Nil(t, reader.Verify())
+
+	// Blobs without checksum aren't checked
+	assert.Nil(t, NewChecksumReader(blob(), "data", id, "").Verify())
+
+	// Checksums are read from storage metadata
+	sum, err := MetadataChecksum(struct {
+		Checksum string `json:"checksum"`
+	}{strings.ToUpper(checksum)})
+	assert.Nil(t, err)
+	assert.Equal(t, checksum, sum)
+	sum, err = MetadataChecksum(&common.Data{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", sum)
+}
+
+// archiveEntry is an entry of a crafted tar.gz archive
+type archiveEntry struct {
+	header  tar.Header
+	content []byte
+}
+
+func craftTargz(t *testing.T, entries ...archiveEntry) []byte {
+	var buf bytes.Buffer
+	zipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(zipWriter)
+	for _, entry := range entries {
+		header := entry.header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.content))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		assert.Nil(t, tarWriter.WriteHeader(&header))
+		_, err := tarWriter.Write(entry.content)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, tarWriter.Close())
+	assert.Nil(t, zipWriter.Close())
+	return buf.Bytes()
+}
+
+func file(name, content string) archiveEntry {
+	return archiveEntry{header: tar.Header{Name: name, Typeflag: tar.TypeReg}, content: []byte(content)}
+}
+
+func TestUnarchiveInFolder(t *testing.T) {
+	root, err := ioutil.TempDir("", "unarchive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	w := newTestWorker(newStorageStub(), newPeerStub())
+	w.SetArchiveLimits(ArchiveLimits{MaxSize: 4 << 20, MaxFiles: 10, MaxRatio: 100})
+	unarchive := func(archive []byte) (string, error) {
+		folder, err := ioutil.TempDir(root, "model")
+		assert.Nil(t, err)
+		return folder, w.UnarchiveInFolder(folder, bytes.NewReader(archive))
+	}
+
+	// Regular archives unpack fine, without the permissions files mustn't have
+	folder, err := unarchive(craftTargz(t,
+		archiveEntry{header: tar.Header{Name: "weights/", Typeflag: tar.TypeDir, Mode: 0755}},
+		file("weights/layer1", "0.5"),
+		archiveEntry{header: tar.Header{Name: "nested/dir/run.sh", Typeflag: tar.TypeReg, Mode: 06777}, content: []byte("#!/bin/sh")},
+	))
+	assert.Nil(t, err)
+	content, err := ioutil.ReadFile(filepath.Join(folder, "weights/layer1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "0.5", string(content))
+	info, err := os.Stat(filepath.Join(folder, "nested/dir/run.sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode())
+
+	// Malicious archives are rejected
+	big := make([]byte, 5<<20)
+	rand.Read(big)
+	for _, malicious := range []struct {
+		archive []byte
+		reason  string
+	}{
+		{craftTargz(t, file("../../evil", "pwned")), "escapes"},
+		{craftTargz(t, file("weights/../../evil", "pwned")), "escapes"},
+		{craftTargz(t, file(filepath.Join(root, "evil"), "pwned")), "absolute path"},
+		{craftTargz(t, archiveEntry{header: tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}), "absolute path"},
+		{craftTargz(t, archiveEntry{header: tar.Header{Name: "weights/evil", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}}), "escapes"},
+		{craftTargz(t, archiveEntry{header: tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: "weights/../.."}}), "clean path"},
+		{craftTargz(t,
+			archiveEntry{header: tar.Header{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "."}},
+			archiveEntry{header: tar.Header{Name: "up/evil", Typeflag: tar.TypeSymlink, Linkname: ".."}},
+		), "goes through a symlink"},
+		{craftTargz(t,
+			archiveEntry{header: tar.Header{Name: "weights", Typeflag: tar.TypeSymlink, Linkname: "."}},
+			file("weights", "pwned"),
+		), "overwrites a symlink"},
+		{craftTargz(t, archiveEntry{header: tar.Header{Name: "evil", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}}), "hardlinks"},
+		{craftTargz(t, archiveEntry{header: tar.Header{Name: "evil", Typeflag: tar.TypeChar}}), "special files"},
+		{craftTargz(t, file("1", ""), file("2", ""), file("3", ""), file("4", ""), file("5", ""), file("6", ""), file("7", ""), file("8", ""), file("9", ""), file("10", ""), file("11", "")), "more than 10"},
+		{craftTargz(t, archiveEntry{header: tar.Header{Name: "big", Typeflag: tar.TypeReg}, content: big}), "bigger than"},
+		{craftTargz(t, archiveEntry{header: tar.Header{Name: "bomb", Typeflag: tar.TypeReg}, content: make([]byte, 3<<20)}), "compression ratio"},
+	} {
+		_, err := unarchive(malicious.archive)
+		if assert.NotNil(t, err, malicious.reason) {
+			assert.Contains(t, err.Error(), malicious.reason)
+		}
+	}
+	_, err = os.Stat(filepath.Join(root, "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// randomTree fills a folder with random directories, files and symlinks pointing inside the folder
+func randomTree(t *testing.T, r *rand.Rand, root string) {
+	dirModes := []os.FileMode{0700, 0750, 0755, 0775, 0777}
+	fileModes := []os.FileMode{0600, 0644, 0664, 0666, 0700, 0755, 0777, os.ModeSetuid | 0755}
+	entries := []string{"."}
+	dirs := []string{"."}
+
+	for i := 0; i < 1+r.Intn(30); i++ {
+		parent := dirs[r.Intn(len(dirs))]
+		name := filepath.Join(parent, fmt.Sprintf("entry%d", i))
+		path := filepath.Join(root, name)
+
+		switch r.Intn(3) {
+		case 0:
+			mode := dirModes[r.Intn(len(dirModes))]
+			assert.Nil(t, os.Mkdir(path, mode))
+			assert.Nil(t, os.Chmod(path, mode))
+			dirs = append(dirs, name)
+		case 1:
+			content := make([]byte, r.Intn(4096))
+			r.Read(content)
+			assert.Nil(t, ioutil.WriteFile(path, content, 0600))
+			assert.Nil(t, os.Chmod(path, fileModes[r.Intn(len(fileModes))]))
+		case 2:
+			// Let's climb up to the root and point to any entry from there (or to a missing one)
+			up := ""
+			if parent != "." {
+				up = strings.Repeat("../", strings.Count(parent, string(filepath.Separator))+1)
+			}
+			target := "missing"
+			if r.Intn(4) > 0 {
+				target = entries[r.Intn(len(entries))]
+			}
+			assert.Nil(t, os.Symlink(filepath.Clean(up+target), path))
+		}
+		entries = append(entries, name)
+	}
+}
+
+// describeTree describes the entries of a folder, masking their modes with mask
+func describeTree(t *testing.T, root string, mask os.FileMode) map[string]string {
+	tree := make(map[string]string)
+	assert.Nil(t, filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		assert.Nil(t, err)
+		rel, _ := filepath.Rel(root, path)
+		mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky) &^ mask
+		switch {
+		case info.IsDir():
+			tree[rel] = fmt.Sprintf("dir %s", mode)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			assert.Nil(t, err)
+			tree[rel] = fmt.Sprintf("symlink to %s", target)
+		default:
+			content, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+			tree[rel] = fmt.Sprintf("file %s %x", mode, sha256.Sum256(content))
+		}
+		return nil
+	}))
+	return tree
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	root, err := ioutil.TempDir("", "roundtrip")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	w := newTestWorker(newStorageStub(), newPeerStub())
+
+	// Unpacking a packed folder gives the same folder, without the permissions files mustn't have,
+	// whatever the archive format
+	for seed := int64(0); seed < 60; seed++ {
+		codec := Codecs[seed%int64(len(Codecs))]
+		w.SetArchiveFormat(codec)
+		src := filepath.Join(root, fmt.Sprintf("src%d", seed))
+		dst := filepath.Join(root, fmt.Sprintf("dst%d", seed))
+		assert.Nil(t, os.Mkdir(src, 0755))
+		assert.Nil(t, os.Mkdir(dst, 0755))
+		randomTree(t, rand.New(rand.NewSource(seed)), src)
+
+		var archive bytes.Buffer
+		assert.Nil(t, w.ArchiveFolder(src, &archive))
+		assert.Nil(t, w.UnarchiveInFolder(dst, &archive))
+		assert.Equal(t, describeTree(t, src, os.ModeSetuid|os.ModeSetgid|os.ModeSticky|0022), describeTree(t, dst, 0), "seed %d, format %s", seed, codec.Format())
+	}
+	w.SetArchiveFormat(nil)
+
+	// Symlinks pointing outside the folder are left out
+	src := filepath.Join(root, "links")
+	assert.Nil(t, os.Mkdir(src, 0755))
+	assert.Nil(t, os.Symlink("/etc/passwd", filepath.Join(src, "absolute")))
+	assert.Nil(t, os.Symlink("../..", filepath.Join(src, "escaping")))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(src, "weights"), []byte("0.5"), 0644))
+	var archive bytes.Buffer
+	assert.Nil(t, w.ArchiveFolder(src, &archive))
+	dst := filepath.Join(root, "links-dst")
+	assert.Nil(t, os.Mkdir(dst, 0755))
+	assert.Nil(t, w.UnarchiveInFolder(dst, &archive))
+	assert.Equal(t, map[string]string{
+		".":       describeTree(t, src, 0)["."],
+		"weights": describeTree(t, src, 0)["weights"],
+	}, describeTree(t, dst, 0))
+}
+
+// modelStorage records the models posted to storage
+type modelStorage struct {
+	*storageStub
+	sizes  []int64
+	models [][]byte
+}
+
+func (s *modelStorage) PostModel(model *common.Model, blobReader io.Reader, size int64) error {
+	content, err := ioutil.ReadAll(blobReader)
+	s.sizes = append(s.sizes, size)
+	s.models = append(s.models, content)
+	return err
+}
+
+// chunkedModelStorage records the models posted to storage, without knowing their size
+type chunkedModelStorage struct {
+	*modelStorage
+	chunked int
+}
+
+func (s *chunkedModelStorage) PostModelChunked(model *common.Model, blobReader io.Reader) error {
+	s.chunked++
+	return s.PostModel(model, blobReader, -1)
+}
+
+// countingCodec counts the archives it creates
+type countingCodec struct {
+	Codec
+	archives int
+}
+
+func (c *countingCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	c.archives++
+	return c.Codec.NewWriter(w)
+}
+
+func TestPostModel(t *testing.T) {
+	sized := &modelStorage{storageStub: newStorageStub()}
+	chunked := &chunkedModelStorage{modelStorage: &modelStorage{storageStub: newStorageStub()}}
+
+	for _, storage := range []struct {
+		client.Storage
+		*modelStorage
+	}{{sized, sized}, {chunked, chunked.modelStorage}} {
+		w := newTestWorker(storage.Storage, newPeerStub())
+		codec := &countingCodec{Codec: Codecs[0]}
+		w.SetArchiveFormat(codec)
+		setupLearn(t, w, learnuplet)
+		modelFolder := filepath.Join(tmpPathData, learnuplet.Algo.String(), "model")
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(modelFolder, "weights"), []byte("0.5"), 0644))
+
+		// The model archive is streamed to storage in a single pass, without being written to disk
+		assert.Nil(t, w.LearnWorkflow(context.Background(), *learnuplet))
+		assert.Equal(t, 1, codec.archives)
+		if assert.Equal(t, 1, len(storage.models)) {
+			dst, err := ioutil.TempDir("", "model")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dst)
+			assert.Nil(t, w.UnarchiveInFolder(dst, bytes.NewReader(storage.models[0])))
+			content, err := ioutil.ReadFile(filepath.Join(dst, "weights"))
+			assert.Nil(t, err)
+			assert.Equal(t, "0.5", string(content))
+		}
+	}
+
+	// Its size isn't known beforehand: storage clients that support chunked uploads are used
+	// as such
+	assert.Equal(t, []int64{-1}, sized.sizes)
+	assert.Equal(t, 1, chunked.chunked)
+}
+
+// truncatingStorage only reads the first bytes of the models posted to it
+type truncatingStorage struct {
+	*storageStub
+}
+
+func (s *truncatingStorage) PostModel(model *common.Model, blobReader io.Reader, size int64) error {
+	_, err := ioutil.ReadAll(io.LimitReader(blobReader, 16))
+	return err
+}
+
+func TestPostModelTruncated(t *testing.T) {
+	w := newTestWorker(&truncatingStorage{newStorageStub()}, newPeerStub())
+	setupLearn(t, w, learnuplet)
+
+	// Storage accepting a model before reading its whole archive fails the task
+	err := w.LearnWorkflow(context.Background(), *learnuplet)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrorClassStorage, ErrorClassOf(err))
+		assert.Contains(t, err.Error(), "stopped reading the archive")
+	}
+}
+
+// perfFailingRuntime fails perf containers, and keeps the logs of the containers it runs
+type perfFailingRuntime struct {
+	common.ContainerRuntime
+	autoRemove map[string]bool
+	removed    []string
+	// Called when a perf container runs, if set
+	onPerf func()
+}
+
+func (r *perfFailingRuntime) RunImageInUntrustedContainer(imageName string, args []string, mounts map[string]string, autoRemove bool) (string, error) {
+	r.autoRemove[args[1]] = autoRemove
+	if args[1] == "perf" {
+		if r.onPerf != nil {
+			r.onPerf()
+		}
+		return "perf-container", fmt.Errorf("perf container exited with status 1")
+	}
+	return r.ContainerRuntime.RunImageInUntrustedContainer(imageName, args, mounts, autoRemove)
+}
+
+func (r *perfFailingRuntime) ContainerLogs(containerID string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("Traceback: " + containerID)), nil
+}
+
+func (r *perfFailingRuntime) RemoveContainer(containerID string) error {
+	r.removed = append(r.removed, containerID)
+	return nil
+}
+
+func TestLearnWorkflowPerfFailed(t *testing.T) {
+	storage := &modelStorage{storageStub: newStorageStub()}
+	peer := newPeerStub()
+	runtime := &perfFailingRuntime{ContainerRuntime: common.NewMockRuntime(), autoRemove: make(map[string]bool)}
+	w := newRuntimeTestWorker(runtime, storage, peer)
+	logsFolder, err := ioutil.TempDir("", "logs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logsFolder)
+	w.SetLogsFolder(logsFolder)
+	setupLearn(t, w, learnuplet)
+
+	// The trained model is uploaded anyway and the task reported with a distinct status...
+	logs := NewTaskLogs(learnuplet.Key, 0)
+	assert.Nil(t, w.LearnWorkflow(WithTaskLogs(context.Background(), logs), *learnuplet))
+	assert.Equal(t, 1, len(storage.models))
+	assert.Equal(t, []string{TaskStatusPerfFailed}, peer.statuses)
+
+	// ... and the logs of its steps are kept in the logs folder (this storage can't store
+	// artifacts). Containers are kept until we've got their logs.
+	assert.False(t, runtime.autoRemove["perf"])
+	assert.False(t, runtime.autoRemove["detarget"])
+	assert.Equal(t, 2, len(runtime.removed))
+	assert.Equal(t, "perf-container", runtime.removed[1])
+	content, err := ioutil.ReadFile(filepath.Join(logsFolder, learnuplet.Key+".log"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "=== perf (container perf-container) ===\nTraceback: perf-container\n")
+	// The output of untrusted containers is withheld
+	assert.Regexp(t, "=== train \\(container [^,]*, withheld\\) ===\n\\[output of untrusted container withheld: [0-9]+ bytes\\]", string(content))
+
+	// Interrupted perf steps (timeouts, worker stopped...) fail the task
+	ctx, cancel := context.WithCancel(context.Background())
+	runtime.onPerf = cancel
+	setupLearn(t, w, learnuplet)
+	err = w.LearnWorkflow(ctx, *learnuplet)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Error computing perf")
+	assert.Equal(t, 1, len(storage.models))
+}
+
+func TestHandleLearnLogs(t *testing.T) {
+	storage := &modelStorage{storageStub: newStorageStub()}
+	storage.setFailing(true)
+	peer := newPeerStub()
+	runtime := &perfFailingRuntime{ContainerRuntime: common.NewMockRuntime(), autoRemove: make(map[string]bool)}
+	w := newRuntimeTestWorker(runtime, storage, peer)
+	logsFolder, err := ioutil.TempDir("", "logs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logsFolder)
+	w.SetLogsFolder(logsFolder)
+	w.SetRetryPolicy(ErrorClassStorage, RetryPolicy{MaxAttempts: 1})
+	w.SetStepLogsMaxSize(16)
+	w.SetRedactUntrustedLogs(true)
+	setupLearn(t, w, learnuplet)
+	logPath := filepath.Join(logsFolder, learnuplet.Key+".log")
+
+	// Tasks failing before any container ran have no logs
+	msg, _ := json.Marshal(learnuplet)
+	assert.Nil(t, w.HandleLearn(msg, 1))
+	_, err = os.Stat(logPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// Otherwise, their logs are kept under their key, capped for each step. The output of
+	// untrusted containers is redacted if the worker keeps it.
+	storage.setFailing(false)
+	setupLearn(t, w, learnuplet)
+	runtime.onPerf = func() { storage.setFailing(true) }
+	assert.Nil(t, w.HandleLearn(msg, 1))
+	content, err := ioutil.ReadFile(logPath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "=== perf (container perf-container, 9 bytes truncated) ===\nTraceback: perf-\n")
+	assert.Regexp(t, "=== train \\(container [^,]*, redacted[,)]", string(content))
+	assert.Equal(t, 0, len(peer.invoked))
+}
+
+// artifactStorage records the artifacts posted to storage
+type artifactStorage struct {
+	*modelStorage
+	artifacts map[string][]byte
+}
+
+func (s *artifactStorage) PostArtifact(key, name string, blobReader io.Reader, size int64) (string, error) {
+	content, err := ioutil.ReadAll(blobReader)
+	if err != nil {
+		return "", err
+	}
+	artifactID := fmt.Sprintf("%s-%s", name, key)
+	s.artifacts[artifactID] = content
+	return artifactID, nil
+}
+
+func TestHandleLearnLogsArtifact(t *testing.T) {
+	storage := &artifactStorage{modelStorage: &modelStorage{storageStub: newStorageStub()}, artifacts: make(map[string][]byte)}
+	peer := newPeerStub()
+	runtime := &perfFailingRuntime{ContainerRuntime: common.NewMockRuntime(), autoRemove: make(map[string]bool)}
+	w := newRuntimeTestWorker(runtime, storage, peer)
+	logsFolder, err := ioutil.TempDir("", "logs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logsFolder)
+	w.SetLogsFolder(logsFolder)
+	setupLearn(t, w, learnuplet)
+
+	// Storage clients that can store artifacts get the logs, that are referenced on the peer
+	// along with the perf_failed report, instead of being kept in the logs folder
+	msg, _ := json.Marshal(learnuplet)
+	assert.Nil(t, w.HandleLearn(msg, 1))
+	artifactID := "logs-" + learnuplet.Key
+	if assert.Contains(t, storage.artifacts, artifactID) {
+		assert.Contains(t, string(storage.artifacts[artifactID]), "=== perf (container perf-container) ===\nTraceback: perf-container\n")
+	}
+	assert.Equal(t, []string{fmt.Sprintf("reportLogs(%s,%s)", learnuplet.Key, artifactID)}, peer.invoked)
+	assert.Equal(t, []string{TaskStatusPerfFailed}, peer.statuses)
+	files, err := ioutil.ReadDir(logsFolder)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestLogsFolderMaxSize(t *testing.T) {
+	runtime := &perfFailingRuntime{ContainerRuntime: common.NewMockRuntime(), autoRemove: make(map[string]bool)}
+	w := newRuntimeTestWorker(runtime, &modelStorage{storageStub: newStorageStub()}, newPeerStub())
+	logsFolder, err := ioutil.TempDir("", "logs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logsFolder)
+	w.SetLogsFolder(logsFolder)
+
+	// The oldest logs are removed once the logs folder holds more than its size limit
+	var size int64
+	keys := []string{"first", "second", "third"}
+	for i, key := range keys {
+		task := *learnuplet
+		task.Key = key
+		setupLearn(t, w, &task)
+		assert.Nil(t, w.LearnWorkflow(WithTaskLogs(context.Background(), NewTaskLogs(key, 0)), task))
+
+		// Let's make sure the logs are ordered, whatever the resolution of modification times
+		logPath := filepath.Join(logsFolder, key+".log")
+		old := time.Now().Add(time.Duration(i-len(keys)) * time.Hour)
+		assert.Nil(t, os.Chtimes(logPath, old, old))
+		info, err := os.Stat(logPath)
+		assert.Nil(t, err)
+		size = info.Size()
+		w.SetLogsFolderMaxSize(2 * size)
+	}
+	files, err := ioutil.ReadDir(logsFolder)
+	assert.Nil(t, err)
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	assert.Equal(t, []string{"second.log", "third.log"}, names)
+}
+
+func TestStatusServer(t *testing.T) {
+	runtime := newBlockingRuntime()
+	peer := newPeerStub()
+	w := newRuntimeTestWorker(runtime, newStorageStub(), peer)
+	setupLearn(t, w, learnuplet)
+	config := &ConsumerConfig{StorageUser: "u", StoragePassword: "secret", AdminPassword: "admin"}
+	server := NewStatusServer(w, config.Redacted(), "admin", "admin").Handler()
+	serve := func(method, path string, auth bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		if auth {
+			req.SetBasicAuth("admin", "admin")
+		}
+		server.ServeHTTP(recorder, req)
+		return recorder
+	}
+	status := func() (status WorkerStatus) {
+		recorder := serve("GET", StatusRoute, false)
+		assert.Equal(t, 200, recorder.Code)
+		assert.NotContains(t, recorder.Body.String(), "secret")
+		assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&status))
+		return status
+	}
+
+	msg, _ := json.Marshal(learnuplet)
+	done := make(chan error)
+	go func() { done <- w.HandleLearn(msg, 1) }()
+	<-runtime.started
+
+	// Running tasks are listed with their current step, along with the worker's redacted config
+	current := status()
+	assert.Equal(t, w.ID.String(), current.ID)
+	assert.Equal(t, RedactedSecret, current.Config.(map[string]interface{})["StoragePassword"])
+	assert.Equal(t, "u", current.Config.(map[string]interface{})["StorageUser"])
+	if assert.Len(t, current.Tasks, 1) {
+		assert.Equal(t, learnuplet.Key, current.Tasks[0].Key)
+		assert.Equal(t, "learn", current.Tasks[0].Kind)
+		assert.Equal(t, "train", current.Tasks[0].Step)
+		assert.True(t, current.Tasks[0].Elapsed > 0)
+	}
+	assert.Empty(t, current.History)
+
+	// Canceling a task takes the admin credentials and a running task
+	cancelRoute := TasksRoute + learnuplet.Key + "/cancel"
+	assert.Equal(t, 401, serve("POST", cancelRoute, false).Code)
+	assert.Equal(t, 405, serve("GET", cancelRoute, true).Code)
+	assert.Equal(t, 404, serve("POST", TasksRoute+"unknown/cancel", true).Code)
+	assert.Equal(t, 202, serve("POST", cancelRoute, true).Code)
+
+	// Canceled tasks are marked as failed rather than retried
+	assert.Nil(t, <-done)
+	assert.Equal(t, 1, len(runtime.killed))
+	assert.Equal(t, []string{common.TaskStatusFailed}, peer.statuses)
+	current = status()
+	assert.Empty(t, current.Tasks)
+	if assert.Len(t, current.History, 1) {
+		assert.Equal(t, learnuplet.Key, current.History[0].Key)
+		assert.Equal(t, OutcomeCanceled, current.History[0].Outcome)
+		assert.NotNil(t, current.History[0].Ended)
+		assert.NotEqual(t, "", current.History[0].Error)
+	}
+
+	// Admin routes are disabled without a password
+	server = NewStatusServer(w, nil, "admin", "").Handler()
+	assert.Equal(t, 403, serve("POST", cancelRoute, true).Code)
+}
+
+func TestTaskHistory(t *testing.T) {
+	w := newTestWorker(newStorageStub(), newPeerStub())
+	w.SetStatusHistorySize(2)
+
+	// Malformed tasks are dropped before they start: they have no outcome
+	for _, key := range []string{"evaluplet1", "evaluplet2", "evaluplet3"} {
+		msg, _ := json.Marshal(Evaluplet{Key: key})
+		assert.Nil(t, w.HandleEvaluate(msg, 1))
+	}
+	assert.Empty(t, w.Status().History)
+
+	// Only the outcomes of the last tasks are kept, most recent first
+	keys := []string{}
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("learnuplet%d", i)
+		task := *learnuplet
+		task.Key = key
+		setupLearn(t, w, &task)
+		msg, _ := json.Marshal(task)
+		assert.Nil(t, w.HandleLearn(msg, 1))
+		keys = append([]string{key}, keys...)
+	}
+	history := w.Status().History
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, keys[:2], []string{history[0].Key, history[1].Key})
+		assert.Equal(t, OutcomeSucceeded, history[0].Outcome)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	storage := &modelStorage{storageStub: newStorageStub()}
+	w := newTestWorker(storage, newPeerStub())
+	w.SetRetryPolicy(ErrorClassStorage, RetryPolicy{MaxAttempts: 1})
+	metrics := NewMetrics()
+	metrics.SetParallelism("learn", 3)
+	w.SetMetrics(metrics)
+
+	// A learning task succeeds...
+	setupLearn(t, w, learnuplet)
+	msg, _ := json.Marshal(learnuplet)
+	assert.Nil(t, w.HandleLearn(msg, 1))
+
+	// ... and another one fails because of storage
+	failing := *learnuplet
+	failing.Key = "learnuplet" + uuid.NewV4().String()
+	setupLearn(t, w, &failing)
+	storage.setFailing(true)
+	msg, _ = json.Marshal(failing)
+	assert.Nil(t, w.HandleLearn(msg, 1))
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", MetricsRoute, nil))
+	assert.Equal(t, 200, recorder.Code)
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`morpheo_worker_tasks_started_total{kind="learn"} 2`,
+		`morpheo_worker_tasks_succeeded_total{kind="learn"} 1`,
+		`morpheo_worker_tasks_failed_total{class="storage",kind="learn"} 1`,
+		`morpheo_worker_tasks_in_flight{kind="learn"} 0`,
+		`morpheo_worker_task_parallelism{kind="learn"} 3`,
+		`morpheo_worker_step_duration_seconds_count{step="image_load"} 2`,
+		`morpheo_worker_step_duration_seconds_count{step="data_pull"} 1`,
+		`morpheo_worker_step_duration_seconds_count{step="detarget"} 1`,
+		`morpheo_worker_step_duration_seconds_count{step="train"} 1`,
+		`morpheo_worker_step_duration_seconds_count{step="perf"} 1`,
+		`morpheo_worker_step_duration_seconds_count{step="model_upload"} 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+	assert.Regexp(t, `morpheo_worker_downloaded_bytes_total [1-9]`, body)
+	// Our storage mock doesn't provide checksums
+	assert.Regexp(t, `morpheo_worker_unverified_blobs_total\{kind="algo"\} [1-9]`, body)
+	assert.Regexp(t, fmt.Sprintf(`morpheo_worker_uploaded_bytes_total %d\n`, len(storage.models[0])), body)
+}
+
+func TestDataRedactor(t *testing.T) {
+	folder, err := ioutil.TempDir("", "hidden")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(folder, "data.csv"), []byte("patient,stage\nalice42,0.8731\nbob,1\n"), 0644))
+
+	redactor, err := NewDataRedactor(folder)
+	assert.Nil(t, err)
+
+	// Tokens of the hidden data and encoded blobs are redacted, short tokens are left as is
+	output := "epoch 1: loss 0.8731 on alice42, bob\ndump " + strings.Repeat("QUJD", 10) + "\n"
+	assert.Equal(t, "epoch 1: loss [REDACTED] on [REDACTED], bob\ndump [REDACTED]\n", string(redactor.Redact([]byte(output))))
+}
+
+// stepRuntime records the steps of the containers it runs, and writes a performance file in the
+// perf container's output folder
+type stepRuntime struct {
+	common.ContainerRuntime
+	steps []string
+}
+
+func (r *stepRuntime) RunImageInUntrustedContainer(imageName string, args []string, mounts map[string]string, autoRemove bool) (string, error) {
+	for i, arg := range args {
+		if arg == "-T" && i+1 < len(args) {
+			r.steps = append(r.steps, args[i+1])
+		}
+	}
+	for hostPath, containerPath := range mounts {
+		if containerPath == "/hidden_data/perf" {
+			ioutil.WriteFile(filepath.Join(hostPath, "performance.json"), []byte(perfString), 0666)
+		}
+	}
+	return r.ContainerRuntime.RunImageInUntrustedContainer(imageName, args, mounts, autoRemove)
+}
+
+func TestHandleEvaluate(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := logging.Default()
+	logging.SetDefault(logging.New(&buf, logging.LevelDebug))
+	defer logging.SetDefault(defaultLogger)
+
+	runtime := &stepRuntime{ContainerRuntime: common.NewMockRuntime()}
+	peer := newPeerStub()
+	w := newRuntimeTestWorker(runtime, storageMock, peer)
+	task := Evaluplet{
+		Key:        "evaluplet" + uuid.NewV4().String(),
+		Learnuplet: learnuplet.Key,
+		Problem:    learnuplet.Problem,
+		Model:      learnuplet.ModelEnd,
+		TestData:   learnuplet.TestData,
+	}
+
+	// The model predicts the detargeted test data and its test performance is reported to the
+	// peer for the learnuplet that trained it (without marking it done again), and logged
+	msg, _ := json.Marshal(task)
+	assert.Nil(t, w.HandleEvaluate(msg, 1))
+	assert.Equal(t, []string{"detarget", "predict", "perf"}, runtime.steps)
+	assert.Equal(t, 0, len(peer.reported))
+	assert.Equal(t, []string{fmt.Sprintf(`reportPerf(%s,0.5,{"p":0.5})`, learnuplet.Key)}, peer.invoked)
+	var done map[string]interface{}
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line map[string]interface{}
+		if json.Unmarshal([]byte(raw), &line) == nil && line["perf"] != nil {
+			done = line
+		}
+	}
+	if assert.NotNil(t, done) {
+		assert.Equal(t, learnuplet.Key, done["learnuplet"])
+		assert.Equal(t, 0.5, done["perf"])
+		assert.Equal(t, map[string]interface{}{"p": 0.5}, done["test_perf"])
+	}
+
+	// Malformed evaluplets are dropped
+	for _, malformed := range []Evaluplet{{Key: task.Key, Learnuplet: task.Learnuplet, Problem: task.Problem, Model: task.Model}, {Key: "../evil", Learnuplet: task.Learnuplet, Problem: task.Problem, Model: task.Model, TestData: task.TestData}} {
+		msg, _ = json.Marshal(malformed)
+		assert.Nil(t, w.HandleEvaluate(msg, 1))
+	}
+	assert.Equal(t, 3, len(runtime.steps))
+}
+
+func TestOpenArchive(t *testing.T) {
+	folder, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(folder)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(folder, "weights"), []byte("0.5"), 0644))
+	w := newTestWorker(newStorageStub(), newPeerStub())
+
+	// The format of archives is detected from their magic bytes
+	for _, format := range []ArchiveFormat{ArchiveFormatGzip, ArchiveFormatZstd, ArchiveFormatTar} {
+		codec, err := CodecFor(format)
+		assert.Nil(t, err)
+		w.SetArchiveFormat(codec)
+
+		var archive bytes.Buffer
+		assert.Nil(t, w.ArchiveFolder(folder, &archive))
+		tarStream, detected, err := OpenArchive(&archive)
+		assert.Nil(t, err)
+		assert.Equal(t, format, detected)
+		header, err := tar.NewReader(tarStream).Next()
+		assert.Nil(t, err)
+		assert.Equal(t, "weights", header.Name)
+	}
+
+	_, err = CodecFor("rar")
+	assert.NotNil(t, err)
+	_, _, err = OpenArchive(strings.NewReader("not an archive"))
+	assert.NotNil(t, err)
+}
+
+func TestDecodePerfuplet(t *testing.T) {
+	// Legacy files without a version field are version 1 files
+	perfuplet, err := DecodePerfuplet(strings.NewReader(perfString))
+	assert.Nil(t, err)
+	assert.Equal(t, PerfupletV1, perfuplet.Version)
+	assert.Equal(t, 0.5, perfuplet.Perf)
+	assert.Equal(t, map[string]float64{"p": 0.5}, perfuplet.TestPerf)
+
+	perfuplet, err = DecodePerfuplet(strings.NewReader(`{"version":2,"perf":0.5,"train_perf":{},"test_perf":{"p":0.5},
+		"samples":{"p":[0.25,0.75]},"confidence":{"perf":{"lower":0.4,"upper":0.6}}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{0.25, 0.75}, perfuplet.Samples["p"])
+	assert.Equal(t, Interval{Lower: 0.4, Upper: 0.6}, perfuplet.Confidence["perf"])
+
+	manyMetrics := make(map[string]float64)
+	for i := 0; i < 1000; i++ {
+		manyMetrics[fmt.Sprintf("m%d", i)] = 0.5
+	}
+	tooManyMetrics, _ := json.Marshal(Perfuplet{Version: PerfupletV1, TrainPerf: manyMetrics, TestPerf: manyMetrics})
+
+	for name, file := range map[string]string{
+		"not JSON":         "not JSON",
+		"NaN":              `{"perf":NaN,"train_perf":{},"test_perf":{}}`,
+		"overflow":         `{"perf":1e400,"train_perf":{},"test_perf":{}}`,
+		"missing perf":     `{"train_perf":{},"test_perf":{}}`,
+		"missing test":     `{"perf":0.5,"train_perf":{}}`,
+		"null train":       `{"perf":0.5,"train_perf":null,"test_perf":{}}`,
+		"unknown version":  `{"version":3,"perf":0.5,"train_perf":{},"test_perf":{}}`,
+		"v1 with samples":  `{"version":1,"perf":0.5,"train_perf":{},"test_perf":{},"samples":{"p":[0.5]}}`,
+		"empty metric":     `{"perf":0.5,"train_perf":{"":0.5},"test_perf":{}}`,
+		"reversed bounds":  `{"version":2,"perf":0.5,"train_perf":{},"test_perf":{},"confidence":{"perf":{"lower":0.6,"upper":0.4}}}`,
+		"unknown field":    `{"perf":0.5,"train_perf":{},"test_perf":{},"tset_perf":{}}`,
+		"too many metrics": string(tooManyMetrics),
+	} {
+		_, err := DecodePerfuplet(strings.NewReader(file))
+		assert.NotNil(t, err, name)
+	}
+
+	// Non-finite values can't come from JSON, but Perfuplets built in Go are checked too
+	perfuplet = &Perfuplet{Version: PerfupletV2, TrainPerf: map[string]float64{"p": math.Inf(1)}}
+	assert.NotNil(t, perfuplet.Validate())
+}
+
+func TestLearnWorkflowInvalidPerf(t *testing.T) {
+	w := newTestWorker(storageMock, newPeerStub())
+	setupLearn(t, w, learnuplet)
+	perfFile := filepath.Join(tmpPathData, learnuplet.Algo.String(), "perf/performance.json")
+	assert.Nil(t, ioutil.WriteFile(perfFile, []byte(`{"perf":NaN,"train_perf":{},"test_perf":{}}`), 0666))
+
+	// A malformed performance file is the problem workflow's fault
+	err := w.LearnWorkflow(context.Background(), *learnuplet)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorClassProblem, ErrorClassOf(err))
+}
+
+func TestLearnWorkflowPerfV2(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLogger := logging.Default()
+	logging.SetDefault(logging.New(&buf, logging.LevelDebug))
+	defer logging.SetDefault(defaultLogger)
+
+	peer := newPeerStub()
+	w := newTestWorker(storageMock, peer)
+	setupLearn(t, w, learnuplet)
+	perfFile := filepath.Join(tmpPathData, learnuplet.Algo.String(), "perf/performance.json")
+	assert.Nil(t, ioutil.WriteFile(perfFile, []byte(`{"version":2,"perf":0.5,"train_perf":{"p":0.75},"test_perf":{"p":0.5},
+		"samples":{"p":[0.25,0.75]},"confidence":{"perf":{"lower":0.4,"upper":0.6}}}`), 0666))
+
+	// Version 2 files are reported to the peer, and their per-sample metrics (sizes) and
+	// confidence intervals are logged
+	assert.Nil(t, w.LearnWorkflow(context.Background(), *learnuplet))
+	assert.Equal(t, []string{common.TaskStatusDone}, peer.statuses)
+	assert.Equal(t, []float64{0.5}, peer.perfs)
+	assert.Contains(t, buf.String(), `"samples":{"p":2}`)
+	assert.Contains(t, buf.String(), `"confidence":{"perf":{"lower":0.4,"upper":0.6}}`)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Second}
+
+	assert.True(t, policy.Retryable(2))
+	assert.False(t, policy.Retryable(3))
+	assert.Equal(t, time.Second, policy.Delay(1))
+	assert.Equal(t, 4*time.Second, policy.Delay(3))
+
+	assert.Equal(t, ErrorClassPeer, ErrorClassOf(NewTaskError(ErrorClassPeer, "peer down")))
+	assert.Equal(t, ErrorClassRuntime, ErrorClassOf(fmt.Errorf("unclassified")))
+}
+
+func TestHandlePred(t *testing.T) {
+	// t.Parallel()
+	storage := newStorageStub()
+	peer := newPeerStub()
+	w := newTestWorker(storage, peer)
+
+	// Pre-setup directory structure for Pred to avoid permission issues
+	taskDataFolder := filepath.Join(tmpPathData, preduplet.Model.String())
+	assert.Nil(t, w.SetupDirectories(taskDataFolder, 0777))
+
+	// Create a tar-gzed prediction mock in tmp (the container runtime mock won't write it)
+	tmpPathPredFile := filepath.Join(taskDataFolder, "test/pred", preduplet.Data.String())
+	f, err := os.Create(tmpPathPredFile)
+	assert.Nil(t, err)
+
+	mock, err := TargzedMock()
+	assert.Nil(t, err)
+
+	_, err = io.Copy(f, mock)
+	assert.Nil(t, err)
+	f.Close()
+
+	// Test the whole pipeline works, and the prediction is reported to the peer
+	msg, _ := json.Marshal(preduplet)
+	assert.Nil(t, w.HandlePred(msg, 1))
+	if assert.Equal(t, 1, len(peer.invoked)) {
+		assert.Regexp(t, fmt.Sprintf(`^reportPred\(%s,%s,[0-9a-f-]{36}\)$`, preduplet.Key, common.TaskStatusDone), peer.invoked[0])
+		assert.NotContains(t, peer.invoked[0], uuid.Nil.String())
+	}
+
+	// Failed preduplets are reported as such, without a prediction
+	peer.invoked = nil
+	w.SetRetryPolicy(ErrorClassStorage, RetryPolicy{MaxAttempts: 1})
+	unknownModel := *preduplet
+	unknownModel.Model = uuid.NewV4()
+	msg, _ = json.Marshal(unknownModel)
+	assert.Nil(t, w.HandlePred(msg, 1))
+	assert.Equal(t, []string{fmt.Sprintf("reportPred(%s,%s,%s)", preduplet.Key, common.TaskStatusFailed, uuid.Nil)}, peer.invoked)
+}
 
 // TargzedMock create a Readcloser which can be ungzip-ed
 func TargzedMock() (io.ReadCloser, error) {